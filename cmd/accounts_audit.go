@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsAuditCmd)
+}
+
+var accountsAuditCmd = &cobra.Command{
+	Use:   "audit [username]",
+	Short: "Show the changes that the server made on its own for a user, such as registering devices",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		dataInterface := data.NewSQLite(database)
+
+		events, err := dataInterface.RetrieveAuditEvents(username)
+		if err != nil {
+			log.Fatalf("could not retrieve audit events: %#v", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tACTION\tDEVICE\tDETAIL")
+		for _, e := range events {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.CreatedAt.Format(time.RFC3339), e.Action, e.Device, e.Detail)
+		}
+		tw.Flush()
+	},
+}
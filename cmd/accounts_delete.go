@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var deleteYes bool
+
+func init() {
+	accountsCmd.AddCommand(accountsDeleteCmd)
+	accountsDeleteCmd.Flags().BoolVarP(&deleteYes, "yes", "y", false, "Delete without asking for confirmation")
+}
+
+var accountsDeleteCmd = &cobra.Command{
+	Use:   "delete [username]",
+	Short: "Delete user account together with its devices, subscriptions and episode actions",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		if !deleteYes && !confirm(fmt.Sprintf("Delete user %s and all of its data?", username)) {
+			log.Println("Aborted")
+			return
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.DeleteUser(username)
+		if err != nil {
+			log.Fatalf("could not delete user: %#v", err)
+		}
+
+		log.Printf("🗑️ User %s deleted!", username)
+	},
+}
+
+// confirm asks the question on the terminal and returns true only if it is
+// answered with a yes
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsDisableCmd)
+	accountsCmd.AddCommand(accountsEnableCmd)
+}
+
+var accountsDisableCmd = &cobra.Command{
+	Use:   "disable [username]",
+	Short: "Disable user account so that it can no longer login",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.SetUserDisabled(username, true)
+		if err != nil {
+			log.Fatalf("could not disable user: %#v", err)
+		}
+
+		log.Printf("🔒 User %s disabled!", username)
+	},
+}
+
+var accountsEnableCmd = &cobra.Command{
+	Use:   "enable [username]",
+	Short: "Enable a disabled user account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.SetUserDisabled(username, false)
+		if err != nil {
+			log.Fatalf("could not enable user: %#v", err)
+		}
+
+		log.Printf("🔓 User %s enabled!", username)
+	},
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsFederationCmd)
+}
+
+var accountsFederationCmd = &cobra.Command{
+	Use:   "federation [username] [on|off]",
+	Short: "Opt a user in or out of ActivityPub federation",
+	Long: `Opt a user in or out of ActivityPub federation.
+
+Users that opted in are ActivityPub actors (username@host) that remote servers
+can follow, and the podcasts that they subscribe to are announced to their
+followers.`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		var enabled bool
+		switch args[1] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			log.Fatalf("could not set federation: expecting on or off but got %s", args[1])
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.SetUserFederated(username, enabled)
+		if err != nil {
+			log.Fatalf("could not set federation: %#v", err)
+		}
+
+		log.Printf("🌐 Federation of %s turned %s!", username, args[1])
+	},
+}
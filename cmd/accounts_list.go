@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsListCmd)
+}
+
+var accountsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List user accounts with their device and subscription counts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dataInterface := data.NewSQLite(database)
+
+		users, err := dataInterface.RetrieveUsers()
+		if err != nil {
+			log.Fatalf("could not retrieve users: %#v", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "USERNAME\tNAME\tEMAIL\tSTATUS\tDEVICES\tSUBSCRIPTIONS")
+
+		for _, u := range users {
+			devices, err := dataInterface.RetrieveDevices(u.Name)
+			if err != nil {
+				log.Fatalf("could not retrieve devices of %s: %#v", u.Name, err)
+			}
+
+			subs, err := dataInterface.RetrieveAllDeviceSubscriptionsSlice(u.Name)
+			if err != nil {
+				log.Fatalf("could not retrieve subscriptions of %s: %#v", u.Name, err)
+			}
+
+			// the same podcast is returned once for each device
+			podcasts := map[string]bool{}
+			for _, v := range subs {
+				podcasts[v] = true
+			}
+
+			status := "active"
+			if u.Disabled {
+				status = "disabled"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", u.Name, u.DisplayName, u.Email, status, len(devices), len(podcasts))
+		}
+
+		tw.Flush()
+	},
+}
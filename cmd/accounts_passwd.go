@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var newPassword string
+
+func init() {
+	accountsCmd.AddCommand(accountsPasswdCmd)
+	accountsPasswdCmd.Flags().StringVarP(&newPassword, "password", "p", "", "New password to use for user, prompted for when not given")
+}
+
+var accountsPasswdCmd = &cobra.Command{
+	Use:   "passwd [username]",
+	Short: "Change the password of a user account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		if newPassword == "" {
+			var err error
+			newPassword, err = promptPassword()
+			if err != nil {
+				log.Fatalf("could not read password: %s", err)
+			}
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.UpdateUserPassword(username, newPassword)
+		if err != nil {
+			log.Fatalf("could not change password: %#v", err)
+		}
+
+		log.Printf("🔑 Password of user %s changed!", username)
+	},
+}
+
+// promptPassword reads a new password from the terminal without echoing it,
+// asking for it twice to guard against typos
+func promptPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal, use --password instead")
+	}
+
+	fmt.Print("New password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Print("Retype new password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+
+	if len(first) == 0 {
+		return "", errors.New("password cannot be empty")
+	}
+
+	return string(first), nil
+}
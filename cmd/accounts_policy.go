@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsPolicyCmd)
+}
+
+var accountsPolicyCmd = &cobra.Command{
+	Use:   "position-policy [username] [newest|furthest|default]",
+	Short: "Set the policy that picks the position to resume episodes at when the devices of a user disagree",
+	Long: `Set the policy that picks the position to resume episodes at when the devices of a user disagree.
+
+newest resumes at the position of the latest play action, furthest at the
+furthest position that any device played the episode to. default uses the
+--position-policy of the server.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		policy := args[1]
+		if policy == "default" {
+			policy = ""
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.SetUserPositionPolicy(username, policy)
+		if err != nil {
+			log.Fatalf("could not set position policy: %#v", err)
+		}
+
+		log.Printf("⏯️ Position policy of %s set to %s!", username, args[1])
+	},
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/sanitize"
+)
+
+var privacyPodcast string
+
+func init() {
+	accountsCmd.AddCommand(accountsPrivacyCmd)
+	accountsPrivacyCmd.Flags().StringVarP(&privacyPodcast, "podcast", "", "", "url of a podcast to set the privacy of instead of the one of the account")
+}
+
+var accountsPrivacyCmd = &cobra.Command{
+	Use:   "privacy [username] [private|instance|public|default]",
+	Short: "Set what the subscriptions of a user are shared in",
+	Long: `Set what the subscriptions of a user are shared in.
+
+private subscriptions are not shared at all, instance ones are counted in the
+directory and suggestions of the instance, and public ones are also counted in
+the toplist that the instance federates and announced to the followers of the
+user. The privacy of a podcast overrides the one of the account, and default
+removes it, which makes the account public or the podcast follow the account.
+
+This is the privacy setting of the account and podcast scopes of the Settings
+API.`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{data.PrivacyPrivate, data.PrivacyInstance, data.PrivacyPublic, "default"},
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		privacy := args[1]
+
+		switch privacy {
+		case data.PrivacyPrivate, data.PrivacyInstance, data.PrivacyPublic, "default":
+		default:
+			log.Fatalf("could not set privacy: expecting private, instance, public or default but got %s", privacy)
+		}
+
+		scope := data.SettingsScopeAccount
+		if privacyPodcast != "" {
+			podcast, err := sanitize.URL(privacyPodcast)
+			if err != nil {
+				log.Fatalf("could not set privacy: %#v", err)
+			}
+			scope = data.SettingsScopePodcast
+			privacyPodcast = podcast
+		}
+		target := data.SettingsTarget(scope, "", privacyPodcast, "")
+
+		set := map[string]interface{}{}
+		remove := []string{}
+		if privacy == "default" {
+			remove = append(remove, data.SettingPrivacy)
+		} else {
+			set[data.SettingPrivacy] = privacy
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		_, err := dataInterface.UpdateSettings(username, scope, target, set, remove)
+		if err != nil {
+			log.Fatalf("could not set privacy: %#v", err)
+		}
+
+		log.Printf("🔒 Privacy of %s set to %s!", username, privacy)
+	},
+}
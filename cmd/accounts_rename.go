@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsRenameCmd)
+}
+
+var accountsRenameCmd = &cobra.Command{
+	Use:   "rename [username] [new username]",
+	Short: "Change the username of a user account",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, newUsername := args[0], args[1]
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.RenameUser(username, newUsername)
+		if err != nil {
+			log.Fatalf("could not rename user: %#v", err)
+		}
+
+		log.Printf("✏️ User %s renamed to %s!", username, newUsername)
+	},
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	accountsCmd.AddCommand(accountsSuggestionsCmd)
+}
+
+var accountsSuggestionsCmd = &cobra.Command{
+	Use:   "suggestions [username] [on|off]",
+	Short: "Opt a user in or out of podcast suggestions",
+	Long: `Opt a user in or out of podcast suggestions.
+
+Users that opted in share their subscriptions for the suggestions of the other
+users that opted in, and get suggestions of the podcasts that are the most
+subscribed to together with theirs.`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		var enabled bool
+		switch args[1] {
+		case "on":
+			enabled = true
+		case "off":
+			enabled = false
+		default:
+			log.Fatalf("could not set suggestions: expecting on or off but got %s", args[1])
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.SetUserSuggestions(username, enabled)
+		if err != nil {
+			log.Fatalf("could not set suggestions: %#v", err)
+		}
+
+		log.Printf("💡 Suggestions of %s turned %s!", username, args[1])
+	},
+}
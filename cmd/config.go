@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, either table or json")
+}
+
+var configCmd = &cobra.Command{
+	Use:               "config",
+	Short:             "Inspect the configuration",
+	PersistentPreRunE: checkOutput,
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/oxtyped/gpodder2go/pkg/config"
+)
+
+func init() {
+	configCmd.AddCommand(configPrintCmd)
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the options that serve would run with",
+	Long: `Print the options that serve would run with, and whether they come from
+the config file, a G2G_* environment variable or the default. Secrets are
+redacted.
+
+Every flag of serve is an option of the config file and of an environment
+variable, --federation-host is federation-host (or host in a federation
+section) in the config file and G2G_FEDERATION_HOST in the environment. Flags
+take precedence over environment variables, which take precedence over the
+config file.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fs := serveFlags()
+		sources, err := applyConfig(fs)
+		if err != nil {
+			log.Fatalf("could not load config: %#v", err)
+		}
+
+		options := config.Options(fs, sources)
+
+		if output == "json" {
+			if err := printJSON(options); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "OPTION\tVALUE\tSOURCE")
+		for _, o := range options {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", o.Name, o.Value, o.Source)
+		}
+		tw.Flush()
+	},
+}
+
+// serveFlags returns the flags of serve along with the ones of the root
+// command, which cobra only merges when serve is run
+func serveFlags() *pflag.FlagSet {
+	fs := pflag.NewFlagSet(serveCmd.Name(), pflag.ContinueOnError)
+	fs.AddFlagSet(serveCmd.LocalNonPersistentFlags())
+	fs.AddFlagSet(rootCmd.PersistentFlags())
+	return fs
+}
@@ -1,14 +1,37 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+
 	"github.com/spf13/cobra"
 )
 
+var output string
+
 func init() {
 	rootCmd.AddCommand(devicesCmd)
+	devicesCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, either table or json")
 }
 
 var devicesCmd = &cobra.Command{
-	Use:   "devices",
-	Short: "Manage devices",
+	Use:               "devices",
+	Short:             "Manage devices",
+	PersistentPreRunE: checkOutput,
+}
+
+// checkOutput validates the --output flag of the commands that support it
+func checkOutput(cmd *cobra.Command, args []string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, expecting table or json", output)
+	}
+	return nil
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
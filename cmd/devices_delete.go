@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	devicesCmd.AddCommand(devicesDeleteCmd)
+	devicesDeleteCmd.Flags().BoolVarP(&deleteYes, "yes", "y", false, "Delete without asking for confirmation")
+}
+
+var devicesDeleteCmd = &cobra.Command{
+	Use:   "delete [username] [device]",
+	Short: "Delete a device together with its subscription and episode action history",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceName := args[0], args[1]
+
+		if !deleteYes && !confirm(fmt.Sprintf("Delete device %s of %s and its history?", deviceName, username)) {
+			log.Println("Aborted")
+			return
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.DeleteDevice(username, deviceName)
+		if err != nil {
+			log.Fatalf("could not delete device: %#v", err)
+		}
+
+		log.Printf("🗑️ Device %s deleted!", deviceName)
+	},
+}
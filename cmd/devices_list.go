@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"text/tabwriter"
 
 	"github.com/oxtyped/gpodder2go/pkg/data"
 	"github.com/spf13/cobra"
@@ -12,25 +14,53 @@ func init() {
 	devicesCmd.AddCommand(devicesListCmd)
 }
 
+type deviceListOutput struct {
+	Id            string `json:"id"`
+	Caption       string `json:"caption"`
+	Type          string `json:"type"`
+	Subscriptions int    `json:"subscriptions"`
+}
+
 var devicesListCmd = &cobra.Command{
 	Use:   "list [username]",
 	Short: "Get all devices belong to username",
-	Args:  cobra.MinimumNArgs(1),
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
 
-		if username == "" {
-			log.Fatalln("expected arguments to have 1")
-		}
-
 		dataInterface := data.NewSQLite(database)
-		devices, err := dataInterface.GetDevicesFromUsername(username)
+		devices, err := dataInterface.RetrieveDevices(username)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("devices are : %#v", devices)
-		// make apiAddr separate it out into username/port
-		return
 
+		list := []deviceListOutput{}
+		for _, v := range devices {
+			subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, v.Name)
+			if err != nil {
+				log.Fatalf("could not retrieve subscriptions of %s: %#v", v.Name, err)
+			}
+
+			list = append(list, deviceListOutput{
+				Id:            v.Name,
+				Caption:       v.Caption,
+				Type:          v.Type,
+				Subscriptions: len(subs),
+			})
+		}
+
+		if output == "json" {
+			if err := printJSON(list); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DEVICE\tTYPE\tCAPTION\tSUBSCRIPTIONS")
+		for _, v := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", v.Id, v.Type, v.Caption, v.Subscriptions)
+		}
+		tw.Flush()
 	},
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	devicesCmd.AddCommand(devicesMergeCmd)
+}
+
+var devicesMergeCmd = &cobra.Command{
+	Use:   "merge [username] [src device] [dst device]",
+	Short: "Move the history of a device onto another one and delete it",
+	Long:  "Move the subscription and episode action history of the src device onto the dst device and delete the src device. Useful when a reinstalled client starts syncing with a new device id.",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, src, dst := args[0], args[1], args[2]
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.MergeDevices(username, src, dst)
+		if err != nil {
+			log.Fatalf("could not merge devices: %#v", err)
+		}
+
+		log.Printf("🔀 Device %s merged into %s!", src, dst)
+	},
+}
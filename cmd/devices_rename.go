@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	devicesCmd.AddCommand(devicesRenameCmd)
+}
+
+var devicesRenameCmd = &cobra.Command{
+	Use:   "rename [username] [device] [new device]",
+	Short: "Change the device id of a device",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceName, newDeviceName := args[0], args[1], args[2]
+
+		dataInterface := data.NewSQLite(database)
+
+		err := dataInterface.RenameDevice(username, deviceName, newDeviceName)
+		if err != nil {
+			log.Fatalf("could not rename device: %#v", err)
+		}
+
+		log.Printf("✏️ Device %s renamed to %s!", deviceName, newDeviceName)
+	},
+}
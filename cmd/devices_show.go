@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	devicesCmd.AddCommand(devicesShowCmd)
+}
+
+type deviceShowOutput struct {
+	Id            string     `json:"id"`
+	Caption       string     `json:"caption"`
+	Type          string     `json:"type"`
+	SyncGroup     []string   `json:"sync_group"`
+	Subscriptions int        `json:"subscriptions"`
+	LastActivity  *time.Time `json:"last_activity"`
+}
+
+var devicesShowCmd = &cobra.Command{
+	Use:   "show [username] [device]",
+	Short: "Show the details of a device",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceName := args[0], args[1]
+
+		dataInterface := data.NewSQLite(database)
+		device, err := dataInterface.RetrieveDevice(username, deviceName)
+		if err != nil {
+			log.Fatalf("could not retrieve device: %#v", err)
+		}
+
+		subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, deviceName)
+		if err != nil {
+			log.Fatalf("could not retrieve subscriptions: %#v", err)
+		}
+
+		show := deviceShowOutput{
+			Id:            device.Name,
+			Caption:       device.Caption,
+			Type:          device.Type,
+			SyncGroup:     []string{},
+			Subscriptions: len(subs),
+		}
+
+		if device.SyncGroupId != nil {
+			names, err := dataInterface.GetDeviceNameFromDeviceSyncGroupId(*device.SyncGroupId)
+			if err != nil {
+				log.Fatalf("could not retrieve sync group: %#v", err)
+			}
+			show.SyncGroup = names
+		}
+
+		if !device.LastActivity.IsZero() {
+			show.LastActivity = &device.LastActivity
+		}
+
+		if output == "json" {
+			if err := printJSON(show); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		syncGroup := "-"
+		if len(show.SyncGroup) > 0 {
+			syncGroup = strings.Join(show.SyncGroup, ", ")
+		}
+
+		lastActivity := "never"
+		if show.LastActivity != nil {
+			lastActivity = show.LastActivity.Format(time.RFC3339)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Device:\t%s\n", show.Id)
+		fmt.Fprintf(tw, "Type:\t%s\n", show.Type)
+		fmt.Fprintf(tw, "Caption:\t%s\n", show.Caption)
+		fmt.Fprintf(tw, "Sync group:\t%s\n", syncGroup)
+		fmt.Fprintf(tw, "Subscriptions:\t%d\n", show.Subscriptions)
+		fmt.Fprintf(tw, "Last activity:\t%s\n", lastActivity)
+		tw.Flush()
+	},
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var federationHostFlag string
+
+func init() {
+	rootCmd.AddCommand(federationCmd)
+	federationCmd.PersistentFlags().StringVarP(&federationHostFlag, "host", "", "", "public base url of the instance, as passed to serve --federation-host")
+	federationCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, either table or json")
+}
+
+var federationCmd = &cobra.Command{
+	Use:   "federation",
+	Short: "Manage the ActivityPub federation of the instance",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if federationHostFlag == "" {
+			return fmt.Errorf("--host is required")
+		}
+		return checkOutput(cmd, args)
+	},
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/activitypub"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var (
+	federationFollowAs        string
+	federationFollowAllowHTTP bool
+)
+
+func init() {
+	federationCmd.AddCommand(federationFollowCmd)
+	federationFollowCmd.Flags().StringVarP(&federationFollowAs, "as", "", "", "username of the federated user to follow as, the instance when empty")
+	federationFollowCmd.Flags().BoolVarP(&federationFollowAllowHTTP, "allow-http", "", false, "follow an actor that is served over plain HTTP, as passed to serve --federation-allow-http")
+}
+
+var federationFollowCmd = &cobra.Command{
+	Use:   "follow [actor url or name@host]",
+	Short: "Follow a remote ActivityPub actor",
+	Long: `Follow a remote ActivityPub actor, such as another gpodder2go instance
+(example.com@example.com) or one of its users (username@example.com).
+
+The activities of the actor are kept once it accepts the follow, which needs the
+server to be running with --federation-host.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dataInterface := data.NewSQLite(database)
+		federation := activitypub.NewFederation(dataInterface, federationHostFlag)
+		federation.AllowHTTP = federationFollowAllowHTTP
+
+		actor := data.FederationInstanceActor
+		if federationFollowAs != "" {
+			federated, err := dataInterface.IsUserFederated(federationFollowAs)
+			if err != nil || !federated {
+				log.Fatalf("could not follow as %s: the user has not opted in to federation", federationFollowAs)
+			}
+			actor = data.UserActor(federationFollowAs)
+		}
+
+		id, err := federation.Follow(actor, args[0])
+		if err != nil {
+			log.Fatalf("could not follow %s: %#v", args[0], err)
+		}
+		federation.Wait()
+
+		log.Printf("🌐 Sent a follow request to %s!", id)
+	},
+}
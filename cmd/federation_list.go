@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	federationCmd.AddCommand(federationListCmd)
+}
+
+type federationListOutput struct {
+	Followers []data.FederationActor `json:"followers"`
+	Following []data.FederationActor `json:"following"`
+}
+
+var federationListCmd = &cobra.Command{
+	Use:   "list [username]",
+	Short: "List the followers and followed actors of the instance or of a user",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		actor := data.FederationInstanceActor
+		if len(args) == 1 {
+			actor = data.UserActor(args[0])
+		}
+
+		dataInterface := data.NewSQLite(database)
+
+		var list federationListOutput
+		var err error
+
+		list.Followers, err = dataInterface.RetrieveFederationFollowers(actor)
+		if err != nil {
+			log.Fatalf("could not retrieve followers: %#v", err)
+		}
+
+		list.Following, err = dataInterface.RetrieveFederationFollowing(actor)
+		if err != nil {
+			log.Fatalf("could not retrieve followed actors: %#v", err)
+		}
+
+		if output == "json" {
+			if list.Followers == nil {
+				list.Followers = []data.FederationActor{}
+			}
+			if list.Following == nil {
+				list.Following = []data.FederationActor{}
+			}
+			if err := printJSON(list); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RELATION\tACTOR\tACCEPTED")
+		for _, a := range list.Followers {
+			fmt.Fprintf(tw, "follower\t%s\t-\n", a.Id)
+		}
+		for _, a := range list.Following {
+			fmt.Fprintf(tw, "following\t%s\t%t\n", a.Id, a.Accepted)
+		}
+		tw.Flush()
+	},
+}
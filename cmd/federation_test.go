@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxtyped/gpodder2go/pkg/activitypub"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// newFederatedInstance starts a test server federating with a database that
+// is initialized by init, as serve does
+func newFederatedInstance(t *testing.T) (*activitypub.Federation, *data.SQLite) {
+	t.Helper()
+
+	db := filepath.Join(t.TempDir(), "g2g.db")
+	run(t, "", "init", "--database", db)
+	dataInterface := data.NewSQLite(db)
+
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+
+	federation := activitypub.NewFederation(dataInterface, ts.URL)
+	// the test servers are on the loopback over plain HTTP
+	federation.AllowHTTP = true
+	federation.Client = &http.Client{Timeout: 10 * time.Second}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/webfinger", federation.HandleWebFinger)
+	mux.Handle("/ap/", http.StripPrefix("/ap", federation.Router()))
+	handler = mux
+
+	// the deliveries in flight end before the database is closed
+	t.Cleanup(func() {
+		federation.Close()
+		ts.Close()
+		dataInterface.Close()
+	})
+
+	return federation, dataInterface
+}
+
+// TestFederationSQLite tests that two instances that keep their federation
+// data in SQLite follow each other and exchange subscriptions and toplists
+func TestFederationSQLite(t *testing.T) {
+	fa, a := newFederatedInstance(t)
+	fb, b := newFederatedInstance(t)
+
+	err := b.AddUser("alice", "pass", "alice@example.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetUserFederated("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := b.AddDevice("alice", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AddSubscriptionHistory(data.Subscription{User: "alice", Devices: []int{deviceId}, Podcast: "https://example.com/feed.xml", Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(fb.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.Peers = []string{u.Host}
+
+	for _, actor := range []string{data.FederationInstanceActor, data.UserActor("alice")} {
+		_, err := fa.Follow(data.FederationInstanceActor, fb.ActorId(actor))
+		if err != nil {
+			t.Fatalf("expecting %s to be followed but got %#v", actor, err)
+		}
+		// the follow and then the accept that answers it
+		fa.Wait()
+		fb.Wait()
+
+		followers, err := b.RetrieveFederationFollowers(actor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(followers) != 1 || followers[0].Id != fa.ActorId(data.FederationInstanceActor) {
+			t.Errorf("expecting %s to be followed by the other instance but got %#v", actor, followers)
+		}
+	}
+
+	following, err := a.RetrieveFederationFollowing(data.FederationInstanceActor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(following) != 2 || !following[0].Accepted || !following[1].Accepted {
+		t.Fatalf("expecting the follows to be accepted but got %#v", following)
+	}
+
+	err = fb.PublishSubscriptions("alice", []string{"https://example.com/feed.xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fb.PublishRecommendations(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.Wait()
+
+	inbox, err := a.RetrieveFederationActivities(data.FederationInstanceActor, data.FederationInbox, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, activity := range inbox {
+		types = append(types, activity.Type)
+	}
+	if len(inbox) != 2 || !strings.Contains(strings.Join(types, " "), "Add") || !strings.Contains(strings.Join(types, " "), "Create") {
+		t.Errorf("expecting the subscription and the recommendations to be received but got %#v", inbox)
+	}
+
+	toplist, err := a.RetrieveFederatedToplist(10, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toplist) != 1 || toplist[0].URL != "https://example.com/feed.xml" || toplist[0].Subscribers != 1 {
+		t.Errorf("expecting the toplist of the peer to be kept but got %#v", toplist)
+	}
+}
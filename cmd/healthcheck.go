@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var healthcheckTimeout time.Duration
+
+func init() {
+	rootCmd.AddCommand(healthcheckCmd)
+	healthcheckCmd.Flags().DurationVarP(&healthcheckTimeout, "timeout", "", 5*time.Second, "how long the server has to answer")
+}
+
+var healthcheckCmd = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Check that the server is ready",
+	Long: `Check that the server is ready by requesting its /readyz, exiting with 1
+when it is not, such as for container healthchecks.
+
+The server is reached at the address that serve listens at with the same
+config file and G2G_* environment variables, over its Unix socket when
+listen is one and over HTTPS when tls-cert is set.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fs := serveFlags()
+		_, err := applyConfig(fs)
+		if err != nil {
+			log.Fatalf("could not load config: %#v", err)
+		}
+
+		address := listen
+		if address == "" {
+			address = addr
+		}
+
+		transport := &http.Transport{}
+		host := ""
+		if path, ok := strings.CutPrefix(address, "unix://"); ok {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			}
+			host = "localhost"
+		} else {
+			h, port, err := net.SplitHostPort(strings.TrimPrefix(address, "tcp://"))
+			if err != nil {
+				log.Fatalf("could not check %s: %s", address, err)
+			}
+			// the server is reached locally when it listens on every
+			// interface
+			if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+				h = "localhost"
+			}
+			host = net.JoinHostPort(h, port)
+		}
+
+		scheme := "http"
+		if tlsCert != "" {
+			// the certificate is issued for the public name of the server
+			// rather than for the address it is reached at here
+			scheme = "https"
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+
+		client := &http.Client{Transport: transport, Timeout: healthcheckTimeout}
+		resp, err := client.Get(fmt.Sprintf("%s://%s/readyz", scheme, host))
+		if err != nil {
+			log.Fatalf("could not reach the server at %s: %s", address, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("could not check the server at %s: it is not ready (%s)", address, resp.Status)
+		}
+
+		log.Printf("💚 The server at %s is ready", address)
+	},
+}
@@ -3,17 +3,26 @@ package cmd
 import (
 	"database/sql"
 	"embed"
+	"errors"
 	"log"
+	"os"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
 )
 
 //go:embed migrations/*.sql
 var fs embed.FS
 
+// sanitizeHistoryVersion is the migration that normalizes the subscription
+// history, the urls that were stored before they were sanitized on upload are
+// sanitized once along with it
+const sanitizeHistoryVersion = 16
+
 func init() {
 	rootCmd.AddCommand(initCmd)
 }
@@ -45,9 +54,52 @@ var initCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
+		version, _, err := m.Version()
+		if err != nil && err != migrate.ErrNilVersion {
+			log.Fatal(err)
+		}
+
 		// modify for Down
-		if err := m.Up(); err != nil {
+		if err := m.Up(); err != nil && err != migrate.ErrNoChange {
 			log.Fatal(err)
 		}
+
+		if version >= sanitizeHistoryVersion {
+			return
+		}
+
+		changed, err := data.NewSQLite(database).SanitizeHistory()
+		if err != nil {
+			log.Fatalf("error sanitizing history: %#v", err)
+		}
+		if changed > 0 {
+			log.Printf("Sanitized %d rows of subscription and episode action history", changed)
+		}
 	},
 }
+
+// schemaVersion returns the version of the last embedded migration, which
+// init migrates the database to
+func schemaVersion() (uint, error) {
+	src, err := iofs.New(fs, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
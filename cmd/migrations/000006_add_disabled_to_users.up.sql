@@ -0,0 +1,2 @@
+ALTER TABLE users
+ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+CREATE TABLE 'audit_events' (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+user_id INT NOT NULL,
+device_id INT,
+action varchar(100) NOT NULL,
+detail varchar(255),
+created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+FOREIGN KEY (user_id) REFERENCES users(id),
+FOREIGN KEY (device_id) REFERENCES devices(id)
+);
@@ -0,0 +1,47 @@
+-- the previous schema holds neither the user and guid of actions nor the
+-- actions without a device, they are kept for the up migration to restore
+CREATE TABLE 'episode_actions_downgraded' (
+id INTEGER PRIMARY KEY,
+user_id INT,
+device_id INT,
+podcast varchar(255) NOT NULL,
+episode varchar(255) NOT NULL,
+guid varchar(255),
+action varchar(100) NOT NULL,
+position int,
+started int,
+total int,
+created_at varchar(255),
+updated_at varchar(255),
+timestamp varchar(255)
+);
+
+INSERT INTO episode_actions_downgraded (id, user_id, device_id, podcast, episode, guid, action, position, started, total, created_at, updated_at, timestamp)
+SELECT id, user_id, device_id, podcast, episode, guid, action, position, started, total, created_at, updated_at, timestamp
+FROM episode_actions;
+
+CREATE TABLE 'episode_actions_old' (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+device_id INT NOT NULL,
+podcast varchar(255) NOT NULL,
+episode varchar(255) NOT NULL,
+action varchar(100) NOT NULL,
+position int,
+started int,
+total int,
+created_at varchar(255),
+updated_at varchar(255),
+timestamp varchar(255),
+FOREIGN KEY (device_id) REFERENCES devices(id)
+);
+
+INSERT INTO episode_actions_old (id, device_id, podcast, episode, action, position, started, total, created_at, updated_at, timestamp)
+SELECT id, device_id, podcast, episode, action, position, started, total, created_at, updated_at, timestamp
+FROM episode_actions WHERE device_id IS NOT NULL;
+
+DROP TABLE episode_actions;
+ALTER TABLE episode_actions_old RENAME TO episode_actions;
+
+-- the ids of the kept actions are not given to new ones
+DELETE FROM sqlite_sequence WHERE name = 'episode_actions';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'episode_actions', MAX(id) FROM episode_actions_downgraded HAVING MAX(id) IS NOT NULL;
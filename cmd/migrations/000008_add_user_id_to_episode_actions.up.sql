@@ -0,0 +1,53 @@
+-- episode actions do not need to reference a device, so they are tied to the
+-- user directly and device_id becomes optional. The actions of devices that no
+-- longer exist are kept without a user.
+CREATE TABLE 'episode_actions_new' (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+user_id INT,
+device_id INT,
+podcast varchar(255) NOT NULL,
+episode varchar(255) NOT NULL,
+guid varchar(255),
+action varchar(100) NOT NULL,
+position int,
+started int,
+total int,
+created_at varchar(255),
+updated_at varchar(255),
+timestamp varchar(255),
+FOREIGN KEY (user_id) REFERENCES users(id),
+FOREIGN KEY (device_id) REFERENCES devices(id)
+);
+
+-- kept by the down migration for what the previous schema cannot hold
+CREATE TABLE IF NOT EXISTS 'episode_actions_downgraded' (
+id INTEGER PRIMARY KEY,
+user_id INT,
+device_id INT,
+podcast varchar(255) NOT NULL,
+episode varchar(255) NOT NULL,
+guid varchar(255),
+action varchar(100) NOT NULL,
+position int,
+started int,
+total int,
+created_at varchar(255),
+updated_at varchar(255),
+timestamp varchar(255)
+);
+
+INSERT INTO episode_actions_new (id, user_id, device_id, podcast, episode, guid, action, position, started, total, created_at, updated_at, timestamp)
+SELECT episode_actions.id, COALESCE(devices.user_id, downgraded.user_id), episode_actions.device_id, episode_actions.podcast, episode_actions.episode, downgraded.guid, episode_actions.action, episode_actions.position, episode_actions.started, episode_actions.total, episode_actions.created_at, episode_actions.updated_at, episode_actions.timestamp
+FROM episode_actions
+LEFT JOIN devices ON devices.id = episode_actions.device_id
+LEFT JOIN episode_actions_downgraded downgraded ON downgraded.id = episode_actions.id;
+
+-- the actions without a device of users that still exist
+INSERT INTO episode_actions_new (id, user_id, device_id, podcast, episode, guid, action, position, started, total, created_at, updated_at, timestamp)
+SELECT id, user_id, device_id, podcast, episode, guid, action, position, started, total, created_at, updated_at, timestamp
+FROM episode_actions_downgraded
+WHERE device_id IS NULL AND user_id IN (SELECT id FROM users);
+
+DROP TABLE episode_actions_downgraded;
+DROP TABLE episode_actions;
+ALTER TABLE episode_actions_new RENAME TO episode_actions;
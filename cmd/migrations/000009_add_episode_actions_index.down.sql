@@ -0,0 +1 @@
+DROP INDEX episode_actions_latest;
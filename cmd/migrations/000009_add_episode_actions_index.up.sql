@@ -0,0 +1,7 @@
+-- created_at is the upload time that since is compared against, actions that
+-- were uploaded before it was recorded fall back to their own timestamp
+UPDATE episode_actions SET created_at = timestamp WHERE created_at IS NULL;
+
+-- covers fetching the latest action of each episode of a user that was
+-- uploaded since
+CREATE INDEX episode_actions_latest ON episode_actions (user_id, podcast, episode, CAST(timestamp AS INTEGER), CAST(created_at AS INTEGER));
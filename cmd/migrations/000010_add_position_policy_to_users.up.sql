@@ -0,0 +1,3 @@
+-- an empty position policy means the default policy of the server
+ALTER TABLE users
+ADD COLUMN position_policy varchar(100) NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+DROP VIEW current_subscriptions;
+DROP INDEX subscriptions_device_podcast;
+DROP TABLE podcast_tags;
+DROP TABLE podcasts;
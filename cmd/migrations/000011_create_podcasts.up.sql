@@ -0,0 +1,27 @@
+-- metadata of the podcasts that users are subscribed to, as fetched from
+-- their feeds
+CREATE TABLE 'podcasts' (
+url varchar(255) PRIMARY KEY,
+title varchar(255),
+author varchar(255),
+description text,
+website varchar(255),
+logo_url varchar(255),
+fetched_at varchar(255)
+);
+
+CREATE TABLE 'podcast_tags' (
+podcast varchar(255) NOT NULL,
+tag varchar(100) NOT NULL,
+title varchar(255) NOT NULL,
+PRIMARY KEY (podcast, tag),
+FOREIGN KEY (podcast) REFERENCES podcasts(url)
+);
+
+CREATE INDEX subscriptions_device_podcast ON subscriptions (device_id, podcast);
+
+-- the podcasts that devices are currently subscribed to, which is when the
+-- latest change of a device on a podcast is a subscribe
+CREATE VIEW current_subscriptions AS
+SELECT user_id, device_id, podcast FROM subscriptions
+WHERE id IN (SELECT MAX(id) FROM subscriptions GROUP BY device_id, podcast) AND action = 'SUBSCRIBE';
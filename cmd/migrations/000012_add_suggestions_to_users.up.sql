@@ -0,0 +1,4 @@
+-- users that opted in share their subscriptions for the suggestions of other
+-- users and get suggestions themselves
+ALTER TABLE users
+ADD COLUMN suggestions BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+DROP INDEX federation_activities_box;
+DROP TABLE federation_activities;
+DROP TABLE federation_following;
+DROP TABLE federation_followers;
+DROP TABLE federation_keys;
+ALTER TABLE users DROP COLUMN federated;
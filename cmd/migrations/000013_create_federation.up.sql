@@ -0,0 +1,43 @@
+-- users that opted in are ActivityPub actors that publish their subscriptions
+ALTER TABLE users
+ADD COLUMN federated BOOLEAN NOT NULL DEFAULT 0;
+
+-- actors are the local ActivityPub actors, either instance or users/{username}
+CREATE TABLE 'federation_keys' (
+actor varchar(255) PRIMARY KEY,
+private_key text NOT NULL,
+created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- remote actors that follow a local actor
+CREATE TABLE 'federation_followers' (
+actor varchar(255) NOT NULL,
+follower varchar(255) NOT NULL,
+inbox varchar(255) NOT NULL,
+created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+PRIMARY KEY (actor, follower)
+);
+
+-- remote actors that a local actor follows, accepted once they replied
+CREATE TABLE 'federation_following' (
+actor varchar(255) NOT NULL,
+following varchar(255) NOT NULL,
+inbox varchar(255) NOT NULL,
+accepted BOOLEAN NOT NULL DEFAULT 0,
+created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+PRIMARY KEY (actor, following)
+);
+
+-- activities published by a local actor (outbox) or received by it (inbox)
+CREATE TABLE 'federation_activities' (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+actor varchar(255) NOT NULL,
+box varchar(10) NOT NULL,
+activity_id varchar(255) NOT NULL,
+type varchar(100) NOT NULL,
+sender varchar(255) NOT NULL,
+payload text NOT NULL,
+created_at varchar(255) NOT NULL
+);
+
+CREATE INDEX federation_activities_box ON federation_activities (actor, box, id);
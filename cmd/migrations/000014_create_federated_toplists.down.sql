@@ -0,0 +1 @@
+DROP TABLE federated_toplists;
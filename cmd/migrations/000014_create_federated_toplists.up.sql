@@ -0,0 +1,10 @@
+-- the latest toplists that peer instances published, as the podcasts with
+-- their number of subscribers on the peer
+CREATE TABLE 'federated_toplists' (
+peer varchar(255) NOT NULL,
+podcast varchar(255) NOT NULL,
+title varchar(255) NOT NULL DEFAULT '',
+subscribers INTEGER NOT NULL,
+received_at varchar(255) NOT NULL,
+PRIMARY KEY (peer, podcast)
+);
@@ -0,0 +1,4 @@
+DROP VIEW public_subscriptions;
+DROP VIEW instance_subscriptions;
+DROP VIEW current_subscriptions_privacy;
+DROP TABLE settings;
@@ -0,0 +1,29 @@
+-- settings of the Settings API, values are JSON. target is empty for the
+-- account scope, the device name for the device scope, the podcast url for
+-- the podcast scope and the podcast and episode urls separated by a space for
+-- the episode scope
+CREATE TABLE 'settings' (
+user_id INTEGER NOT NULL,
+scope varchar(10) NOT NULL,
+target varchar(255) NOT NULL DEFAULT '',
+key varchar(255) NOT NULL,
+value text NOT NULL,
+PRIMARY KEY (user_id, scope, target, key),
+FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- the current subscriptions with the privacy that applies to them, the one of
+-- the podcast setting, else the one of the account setting, else public
+CREATE VIEW current_subscriptions_privacy AS
+SELECT s.user_id, s.device_id, s.podcast, COALESCE(ps.value, us.value, '"public"') AS privacy
+FROM current_subscriptions s
+LEFT JOIN settings ps ON ps.user_id = s.user_id AND ps.scope = 'podcast' AND ps.target = s.podcast AND ps.key = 'privacy'
+LEFT JOIN settings us ON us.user_id = s.user_id AND us.scope = 'account' AND us.target = '' AND us.key = 'privacy';
+
+-- the subscriptions that may be counted in the aggregates of the instance
+CREATE VIEW instance_subscriptions AS
+SELECT user_id, device_id, podcast FROM current_subscriptions_privacy WHERE privacy != '"private"';
+
+-- the subscriptions that may be counted in what is federated
+CREATE VIEW public_subscriptions AS
+SELECT user_id, device_id, podcast FROM current_subscriptions_privacy WHERE privacy = '"public"';
@@ -0,0 +1,5 @@
+-- the repeated actions that the up migration dropped, and the urls that init
+-- sanitized along with it, cannot be restored. Migrating down past this
+-- version fails on purpose rather than reporting a downgrade that did not
+-- happen, restore a backup of the database taken before upgrading instead.
+SELECT * FROM "migration 16 normalize_subscriptions is irreversible, restore a backup instead";
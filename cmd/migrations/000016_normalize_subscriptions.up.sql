@@ -0,0 +1,13 @@
+-- the subscription diff counts a subscribe as +1 and an unsubscribe as -1, so
+-- repeated actions, such as a podcast that was added twice, took as many
+-- unsubscribes to remove. The repeats are dropped, oldest first, so that the
+-- count of every device and podcast is 1 when it is subscribed and 0 when it
+-- is not, which keeps what every device is subscribed to.
+DELETE FROM subscriptions WHERE id IN (
+SELECT id FROM (
+SELECT id, action,
+ROW_NUMBER() OVER (PARTITION BY device_id, podcast, action ORDER BY CAST(timestamp AS INTEGER), id) AS n,
+SUM(CASE action WHEN 'SUBSCRIBE' THEN 1 WHEN 'UNSUBSCRIBE' THEN -1 ELSE 0 END) OVER (PARTITION BY device_id, podcast) AS count
+FROM subscriptions
+) WHERE (action = 'SUBSCRIBE' AND n < count) OR (action = 'UNSUBSCRIBE' AND n <= -count)
+);
@@ -0,0 +1,5 @@
+DROP VIEW current_subscriptions;
+
+CREATE VIEW current_subscriptions AS
+SELECT user_id, device_id, podcast FROM subscriptions
+WHERE id IN (SELECT MAX(id) FROM subscriptions GROUP BY device_id, podcast) AND action = 'SUBSCRIBE';
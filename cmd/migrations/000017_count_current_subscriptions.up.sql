@@ -0,0 +1,10 @@
+-- the podcasts that devices are currently subscribed to, counted the way the
+-- subscription diff of the Subscriptions and Device APIs counts them, a
+-- subscribe as +1 and an unsubscribe as -1, so that the directory, the
+-- suggestions and what is federated agree with the subscriptions of devices
+DROP VIEW current_subscriptions;
+
+CREATE VIEW current_subscriptions AS
+SELECT user_id, device_id, podcast FROM subscriptions
+GROUP BY device_id, podcast
+HAVING SUM(CASE action WHEN 'SUBSCRIBE' THEN 1 WHEN 'UNSUBSCRIBE' THEN -1 ELSE 0 END) > 0;
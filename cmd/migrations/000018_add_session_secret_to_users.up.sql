@@ -0,0 +1,7 @@
+-- session cookies are signed with the session secret of their user, which is
+-- replaced to end all of the sessions of the user when the account is
+-- disabled, renamed or deleted or its password changes
+ALTER TABLE users
+ADD COLUMN session_secret varchar(32) NOT NULL DEFAULT '';
+
+UPDATE users SET session_secret = lower(hex(randomblob(16)));
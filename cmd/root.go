@@ -1,10 +1,19 @@
 package cmd
 
 import (
+	"log"
+	"os"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/oxtyped/gpodder2go/pkg/config"
 )
 
-var database string
+var (
+	database   string
+	configFile string
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "gpodder2go",
@@ -14,6 +23,43 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&database, "database", "d", "g2g.db", "filename of sqlite3 database to use")
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "YAML or TOML config file with the options of the commands, see gpodder2go config print")
+	cobra.OnInitialize(initConfig)
+}
+
+// initConfig layers the environment variables and the config file under the
+// flags of the command that is run
+func initConfig() {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	if err != nil {
+		return
+	}
+
+	_, err = applyConfig(cmd.Flags())
+	if err != nil {
+		log.Fatalf("could not load config: %#v", err)
+	}
+}
+
+// applyConfig sets the flags of fs that were not set on the command line from
+// the G2G_* environment variables and the config file, and returns where the
+// value of every flag comes from
+func applyConfig(fs *pflag.FlagSet) (map[string]string, error) {
+	path := configFile
+	if path == "" {
+		path = os.Getenv(config.EnvName("config"))
+	}
+
+	values := map[string]string{}
+	if path != "" {
+		var err error
+		values, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config.Apply(fs, values, os.LookupEnv)
 }
 
 func Execute() error {
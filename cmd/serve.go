@@ -1,16 +1,29 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/oxtyped/gpodder2go/pkg/activitypub"
 	"github.com/oxtyped/gpodder2go/pkg/apis"
+	"github.com/oxtyped/gpodder2go/pkg/config"
 	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/feeds"
+	"github.com/oxtyped/gpodder2go/pkg/logging"
+	"github.com/oxtyped/gpodder2go/pkg/metrics"
+	"github.com/oxtyped/gpodder2go/pkg/server"
 	"github.com/oxtyped/gpodder2go/pkg/store"
 
 	"github.com/spf13/cobra"
@@ -19,13 +32,76 @@ import (
 )
 
 var (
-	addr   string
-	noAuth bool
+	addr              string
+	noAuth            bool
+	verifierSecretKey string
+	sessionTTL        time.Duration
+
+	cacheBackend string
+	cacheTTL     time.Duration
+
+	timeouts server.Timeouts
+
+	listen          string
+	socketMode      string
+	tlsCert         string
+	tlsKey          string
+	tlsRedirectAddr string
+
+	metricsAddr string
+
+	logFormat   string
+	logLevel    string
+	logPayloads bool
+
+	autoRegister        bool
+	autoRegisterType    string
+	autoRegisterCaption string
+
+	positionPolicy string
+
+	feedRefreshInterval time.Duration
+
+	federationHost              string
+	federationRecommendInterval time.Duration
+	federationPeers             []string
+	federationMinSubscribers    int
+	federationToplistTTL        time.Duration
+	federationAllowHTTP         bool
 )
 
 func init() {
 	serveCmd.Flags().StringVarP(&addr, "addr", "b", "localhost:3005", "ip:port for server to be binded to")
 	serveCmd.Flags().BoolVarP(&noAuth, "no-auth", "", false, "disable authentication")
+	serveCmd.Flags().StringVarP(&verifierSecretKey, "verifier-secret-key", "", "", "secret key that signs the session cookies, VERIFIER_SECRET_KEY is used when it is not set")
+	config.MarkSecret(serveCmd.Flags(), "verifier-secret-key")
+	serveCmd.Flags().DurationVarP(&sessionTTL, "session-ttl", "", 2*time.Minute, "lifetime of the session cookies that clients get on login")
+	serveCmd.Flags().StringVarP(&listen, "listen", "", "", "address to serve at, host:port or unix:///path/to/socket, instead of --addr")
+	serveCmd.Flags().StringVarP(&socketMode, "socket-mode", "", "0660", "permissions of the unix socket of --listen")
+	serveCmd.Flags().StringVarP(&tlsCert, "tls-cert", "", "", "certificate file to serve HTTPS with, reloaded when it changes")
+	serveCmd.Flags().StringVarP(&tlsKey, "tls-key", "", "", "key file of the certificate of --tls-cert")
+	serveCmd.Flags().StringVarP(&tlsRedirectAddr, "tls-redirect-addr", "", "", "ip:port to redirect plain HTTP to HTTPS from (e.g. 0.0.0.0:80), empty to disable")
+	serveCmd.Flags().StringVarP(&metricsAddr, "metrics-addr", "", "", "admin address to serve the Prometheus metrics at /metrics, host:port or unix:///path/to/socket, empty to disable")
+	serveCmd.Flags().StringVarP(&logFormat, "log-format", "", logging.FormatText, "format of the logs: text or json")
+	serveCmd.Flags().StringVarP(&logLevel, "log-level", "", "info", "minimum level of the logs: debug, info, warn or error")
+	serveCmd.Flags().BoolVarP(&logPayloads, "log-payloads", "", false, "log the subscriptions and episode actions of requests and responses at the debug level, keep disabled in production")
+	serveCmd.Flags().DurationVarP(&timeouts.Read, "read-timeout", "", time.Minute, "maximum duration to read requests, including their body, 0 for no timeout")
+	serveCmd.Flags().DurationVarP(&timeouts.Write, "write-timeout", "", time.Minute, "maximum duration to handle requests and write their responses, 0 for no timeout")
+	serveCmd.Flags().DurationVarP(&timeouts.Idle, "idle-timeout", "", 2*time.Minute, "maximum duration to keep idle connections open, 0 for the read timeout")
+	serveCmd.Flags().DurationVarP(&timeouts.Shutdown, "shutdown-timeout", "", 30*time.Second, "how long the requests in flight have to complete on SIGTERM or SIGINT before they are cut off, 0 to wait for them")
+	serveCmd.Flags().StringVarP(&cacheBackend, "cache", "", "memory", "cache backend of the sessions and the directory: memory, memcached://host:port[,host:port] or redis://[:password@]host:port[/db]")
+	serveCmd.Flags().DurationVarP(&cacheTTL, "cache-ttl", "", 5*time.Minute, "how long the toplists, tags and podcast data of the directory are cached")
+	serveCmd.Flags().BoolVarP(&autoRegister, "auto-register-devices", "", true, "register unknown devices on their first subscription or episode action upload")
+	serveCmd.Flags().StringVarP(&autoRegisterType, "auto-register-type", "", "other", "type of auto registered devices (desktop, laptop, mobile, server or other)")
+	serveCmd.Flags().StringVarP(&autoRegisterCaption, "auto-register-caption", "", "", "caption of auto registered devices")
+	serveCmd.Flags().DurationVarP(&feedRefreshInterval, "feed-refresh-interval", "", 6*time.Hour, "interval to refresh the podcast metadata of the directory from the feeds, 0 to disable")
+	serveCmd.Flags().StringVarP(&positionPolicy, "position-policy", "", data.PositionPolicyNewest, "default policy to pick the position to resume episodes at when devices disagree (newest or furthest)")
+	serveCmd.Flags().StringVarP(&federationHost, "federation-host", "", "", "public base url of the instance (e.g. https://g2g.example.com) to federate over ActivityPub at, empty to disable")
+	serveCmd.Flags().DurationVarP(&federationRecommendInterval, "federation-recommend-interval", "", 7*24*time.Hour, "interval to publish the toplist of the instance to its followers, 0 to disable")
+	serveCmd.Flags().StringSliceVarP(&federationPeers, "federation-peers", "", nil, "hosts of the peer instances whose toplists are merged into the federated toplist once followed")
+	serveCmd.Flags().IntVarP(&federationMinSubscribers, "federation-min-subscribers", "", 3, "number of subscribers that podcasts need to be published in the toplist of the instance")
+	serveCmd.Flags().DurationVarP(&federationToplistTTL, "federation-toplist-ttl", "", 14*24*time.Hour, "how long the toplists received from peers count in the federated toplist")
+	serveCmd.Flags().BoolVarP(&federationAllowHTTP, "federation-allow-http", "", false, "fetch remote actors and deliver activities to them over plain HTTP as well as HTTPS")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -33,38 +109,185 @@ var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start gpodder2go server",
 	Run: func(cmd *cobra.Command, args []string) {
-		verifierSecretKey := os.Getenv("VERIFIER_SECRET_KEY")
+		if verifierSecretKey == "" {
+			verifierSecretKey = os.Getenv("VERIFIER_SECRET_KEY")
+		}
 
 		if verifierSecretKey == "" {
 			fmt.Println("VERIFIER_SECRET_KEY is missing")
 			return
 		}
 
+		switch autoRegisterType {
+		case "desktop", "laptop", "mobile", "server", "other":
+		default:
+			fmt.Printf("invalid --auto-register-type %q\n", autoRegisterType)
+			return
+		}
+
+		switch positionPolicy {
+		case data.PositionPolicyNewest, data.PositionPolicyFurthest:
+		default:
+			fmt.Printf("invalid --position-policy %q\n", positionPolicy)
+			return
+		}
+
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			fmt.Printf("invalid --socket-mode %q\n", socketMode)
+			return
+		}
+
+		if (tlsCert == "") != (tlsKey == "") {
+			fmt.Println("--tls-cert and --tls-key are both required to serve HTTPS")
+			return
+		}
+		if tlsRedirectAddr != "" && tlsCert == "" {
+			fmt.Println("--tls-redirect-addr requires --tls-cert and --tls-key")
+			return
+		}
+
+		level, err := logging.ParseLevel(logLevel)
+		if err != nil {
+			fmt.Printf("invalid --log-level %q\n", logLevel)
+			return
+		}
+		logger, err := logging.New(os.Stderr, logging.Options{Format: logFormat, Level: level, Payloads: logPayloads})
+		if err != nil {
+			fmt.Printf("invalid --log-format %q\n", logFormat)
+			return
+		}
+		// the std log of the dependencies goes through it as well
+		slog.SetDefault(logger)
+
+		// stop on deploys and ^C, after draining the requests in flight
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+
+		var m *metrics.Metrics
+		if metricsAddr != "" {
+			m = metrics.New()
+		}
+
 		r := chi.NewRouter()
+		if m != nil {
+			r.Use(m.Middleware)
+		}
 		r.Use(middleware.RequestID)
 		r.Use(middleware.RealIP)
-		r.Use(middleware.Logger)
+		r.Use(logging.Middleware(logger))
 		r.Use(middleware.Recoverer)
 
-		store := store.NewCacheStore()
+		store, err := store.New(cacheBackend)
+		if err != nil {
+			log.Fatalf("could not create cache: %#v", err)
+		}
+		if err := store.Ping(); err != nil {
+			log.Fatalf("could not reach cache %s: %s", cacheBackend, err)
+		}
 
 		// take in db flag and parse it
-		dataInterface := data.NewSQLite(database)
+		var dataInterface *data.SQLite
+		if m != nil {
+			dataInterface = data.NewObservedSQLite(database, m.ObserveQuery)
+			store = m.Store(store)
+		} else {
+			dataInterface = data.NewSQLite(database)
+		}
 		deviceAPI := apis.DeviceAPI{Store: store, Data: dataInterface}
-		subscriptionAPI := apis.SubscriptionAPI{Data: dataInterface}
-		episodeAPI := apis.EpisodeAPI{Data: dataInterface}
+		registration := apis.DeviceRegistration{
+			Enabled: autoRegister,
+			Type:    autoRegisterType,
+			Caption: autoRegisterCaption,
+		}
+		subscriptionAPI := apis.SubscriptionAPI{Store: store, Data: dataInterface, Registration: registration}
+		episodeAPI := apis.EpisodeAPI{Store: store, Data: dataInterface, Registration: registration, PositionPolicy: positionPolicy}
 		userAPI := apis.NewUserAPI(dataInterface, verifierSecretKey)
+		userAPI.SessionTTL = sessionTTL
+		userAPI.Sessions = store
 		syncAPI := apis.NewSyncAPI(dataInterface, verifierSecretKey)
+		nextcloudAPI := apis.NewNextcloudAPI(dataInterface, &subscriptionAPI, &episodeAPI)
+		directoryAPI := apis.NewDirectoryAPI(dataInterface)
+		settingsAPI := apis.NewSettingsAPI(dataInterface)
+		settingsAPI.Store = store
+		version, err := schemaVersion()
+		if err != nil {
+			log.Fatalf("could not read the embedded migrations: %#v", err)
+		}
+		healthAPI := apis.NewHealthAPI(dataInterface, store, version)
+		directoryAPI.FederatedToplistTTL = federationToplistTTL
+		directoryAPI.Store = store
+		directoryAPI.CacheTTL = cacheTTL
+		if m != nil {
+			subscriptionAPI.Observer = m
+			episodeAPI.Observer = m
+			userAPI.Observer = m
+		}
+
+		if feedRefreshInterval > 0 {
+			refresher := &feeds.Refresher{
+				Data:     dataInterface,
+				Fetcher:  feeds.NewFetcher(30 * time.Second),
+				Interval: feedRefreshInterval,
+			}
+			if m != nil {
+				refresher.Observe = m.ObserveRefresh
+			}
+			go refresher.Run(ctx)
+		}
+
+		// closed once the connections are drained, in order
+		closers := []io.Closer{store, dataInterface}
+
+		if federationHost != "" {
+			federation := activitypub.NewFederation(dataInterface, federationHost)
+			federation.Peers = federationPeers
+			federation.MinSubscribers = federationMinSubscribers
+			federation.AllowHTTP = federationAllowHTTP
+			subscriptionAPI.Publisher = federation
+
+			// the recommendations stop being published and the activities
+			// in flight are delivered before the database is closed
+			closers = append([]io.Closer{federation}, closers...)
+
+			if federationRecommendInterval > 0 {
+				go federation.Run(ctx, federationRecommendInterval)
+			}
+
+			// federation, public as remote servers authenticate with HTTP
+			// signatures
+			r.Get("/.well-known/webfinger", federation.HandleWebFinger)
+			r.Mount("/ap", federation.Router())
+		}
+
+		// health, public for container healthchecks and load balancers
+		r.Get("/healthz", healthAPI.HandleHealthz)
+		r.Get("/readyz", healthAPI.HandleReadyz)
 
 		// TODO: Add the authentication middlewares for the various places
 
 		// auth
 		r.Group(func(r chi.Router) {
 			r.Post("/api/2/auth/{username}/login.json", userAPI.HandleLogin)
+			r.Post("/api/2/auth/{username}/logout.json", userAPI.HandleLogout)
 		})
 
+		// directory, public as it only exposes the podcasts and their
+		// subscriber counts
 		r.Group(func(r chi.Router) {
-			r.Use(m2.Verifier(verifierSecretKey, noAuth))
+			r.Get("/toplist/{count}.{format}", directoryAPI.HandleToplist)
+			r.Get("/federated/toplist/{count}.{format}", directoryAPI.HandleFederatedToplist)
+			r.Get("/search.{format}", directoryAPI.HandleSearch)
+			r.Get("/api/2/tags/{count}.json", directoryAPI.HandleTopTags)
+			r.Get("/api/2/tag/{tag}/{count}.json", directoryAPI.HandleTagPodcasts)
+			r.Get("/api/2/data/podcast.json", directoryAPI.HandlePodcastData)
+		})
+
+		// nextcloud gpoddersync compatibility
+		r.Mount("/index.php/apps/gpoddersync", nextcloudAPI.Router(noAuth))
+
+		r.Group(func(r chi.Router) {
+			r.Use(m2.VerifySessions(verifierSecretKey, noAuth, store, dataInterface.RetrieveSessionSecret))
 			r.Post("/api/internal/users", userAPI.HandleUserCreate)
 
 			// device
@@ -87,15 +310,73 @@ var serveCmd = &cobra.Command{
 			r.Get("/api/2/episodes/{username}.{format}", episodeAPI.HandleEpisodeAction)
 			r.Post("/api/2/episodes/{username}.{format}", episodeAPI.HandleUploadEpisodeAction)
 
+			// settings
+			r.Get("/api/2/settings/{username}/{scope}.json", settingsAPI.HandleGetSettings)
+			r.Post("/api/2/settings/{username}/{scope}.json", settingsAPI.HandleUpdateSettings)
+
+			// suggestions
+			r.Get("/suggestions/{count}.{format}", directoryAPI.HandleSuggestions)
+
 			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(200)
 			})
 		})
 
-		log.Printf("💻 Starting server at %s", addr)
-		err := http.ListenAndServe(addr, r)
+		if listen == "" {
+			listen = addr
+		}
+		l, err := server.Listen(listen, os.FileMode(mode))
+		if err != nil {
+			log.Fatalf("could not listen: %s", err)
+		}
+
+		srv := server.New(r, timeouts, closers...)
+		if tlsCert != "" {
+			reloader, err := server.NewCertReloader(tlsCert, tlsKey)
+			if err != nil {
+				log.Fatalf("could not load certificate: %s", err)
+			}
+			srv.HTTP.TLSConfig = reloader.TLSConfig()
+
+			if tlsRedirectAddr != "" {
+				redirect, err := server.Listen(tlsRedirectAddr, os.FileMode(mode))
+				if err != nil {
+					log.Fatalf("could not listen: %s", err)
+				}
+
+				slog.Info("↪️ Redirecting HTTP to HTTPS", "addr", tlsRedirectAddr)
+				go func() {
+					err := server.New(server.RedirectHandler(listen), timeouts).Serve(ctx, redirect)
+					if err != nil {
+						slog.Error("error redirecting HTTP to HTTPS", "error", err)
+					}
+				}()
+			}
+		}
+
+		if m != nil {
+			admin, err := server.Listen(metricsAddr, os.FileMode(mode))
+			if err != nil {
+				log.Fatalf("could not listen: %s", err)
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", m.Handler())
+
+			slog.Info("📈 Serving metrics", "addr", metricsAddr)
+			go func() {
+				err := server.New(mux, timeouts).Serve(ctx, admin)
+				if err != nil {
+					slog.Error("error serving metrics", "error", err)
+				}
+			}()
+		}
+
+		slog.Info("💻 Starting server", "addr", listen)
+		err = srv.Serve(ctx, l)
 		if err != nil {
 			log.Fatal(err)
 		}
+		slog.Info("👋 Server stopped")
 	},
 }
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strings"
+
+	"github.com/oxtyped/go-opml/opml"
+	"github.com/spf13/cobra"
+	"k8s.io/utils/strings/slices"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/sanitize"
+)
+
+func init() {
+	rootCmd.AddCommand(subscriptionsCmd)
+	subscriptionsCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, either table or json")
+}
+
+var subscriptionsCmd = &cobra.Command{
+	Use:               "subscriptions",
+	Short:             "Manage the subscriptions of users",
+	PersistentPreRunE: checkOutput,
+}
+
+// syncedDeviceIds returns the ids of all the devices that a change on
+// deviceName has to be recorded on, which is the device itself or all the
+// devices in its sync group
+func syncedDeviceIds(dataInterface data.DataInterface, username string, deviceName string) ([]int, error) {
+	deviceId, err := dataInterface.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceIds, err := dataInterface.GetDevicesInSyncGroupFromDeviceId(deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if deviceIds == nil {
+		deviceIds = []int{deviceId}
+	}
+
+	return deviceIds, nil
+}
+
+// parseSubscriptions reads podcast urls from either an OPML document or a
+// plain text list with one url per line, in which empty lines and lines
+// starting with # are skipped
+func parseSubscriptions(b []byte, format string) ([]string, error) {
+	if format == "" {
+		format = "txt"
+		if bytes.Contains(b, []byte("<opml")) {
+			format = "opml"
+		}
+	}
+
+	urls := []string{}
+
+	if format == "opml" {
+		doc, err := opml.NewOPML(b)
+		if err != nil {
+			return nil, err
+		}
+
+		var walk func(outlines []opml.Outline)
+		walk = func(outlines []opml.Outline) {
+			for _, o := range outlines {
+				if o.XMLURL != "" {
+					urls = append(urls, o.XMLURL)
+				}
+				walk(o.Outlines)
+			}
+		}
+		walk(doc.Outlines())
+
+		return urls, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
+
+// sanitizeSubscriptions sanitizes the podcast urls, skipping the rejected and
+// duplicated ones
+func sanitizeSubscriptions(urls []string) []string {
+	sanitized := []string{}
+	for _, v := range urls {
+		u, err := sanitize.URL(v)
+		if err != nil {
+			log.Printf("skipping %q: %s", v, err)
+			continue
+		}
+
+		if !slices.Contains(sanitized, u) {
+			sanitized = append(sanitized, u)
+		}
+	}
+
+	return sanitized
+}
+
+// formatSubscriptions writes podcast urls as either an OPML document or a
+// plain text list with one url per line
+func formatSubscriptions(urls []string, format string, title string) (string, error) {
+	if format == "opml" {
+		doc := opml.NewOPMLFromBlank(title)
+		doc.Version = "2.0"
+		for _, v := range urls {
+			doc.Body.Outlines = append(doc.Body.Outlines, opml.Outline{Type: "rss", Text: v, XMLURL: v})
+		}
+
+		xml, err := doc.XML()
+		if err != nil {
+			return "", err
+		}
+
+		return xml + "\n", nil
+	}
+
+	if len(urls) == 0 {
+		return "", nil
+	}
+
+	return strings.Join(urls, "\n") + "\n", nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	subscriptionsCmd.AddCommand(subscriptionsAddCmd)
+	subscriptionsCmd.AddCommand(subscriptionsRemoveCmd)
+}
+
+var subscriptionsAddCmd = &cobra.Command{
+	Use:   "add [username] [device] [url...]",
+	Short: "Subscribe a device and the devices synced with it to podcasts",
+	Args:  cobra.MinimumNArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		changeSubscriptions(args[0], args[1], args[2:], "SUBSCRIBE")
+	},
+}
+
+var subscriptionsRemoveCmd = &cobra.Command{
+	Use:   "remove [username] [device] [url...]",
+	Short: "Unsubscribe a device and the devices synced with it from podcasts",
+	Args:  cobra.MinimumNArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		changeSubscriptions(args[0], args[1], args[2:], "UNSUBSCRIBE")
+	},
+}
+
+// changeSubscriptions records action for each of the podcast urls on
+// deviceName and the devices in its sync group, skipping the devices that are
+// already subscribed or unsubscribed
+func changeSubscriptions(username string, deviceName string, urls []string, action string) {
+	urls = sanitizeSubscriptions(urls)
+
+	dataInterface := data.NewSQLite(database)
+
+	deviceIds, err := syncedDeviceIds(dataInterface, username, deviceName)
+	if err != nil {
+		log.Fatalf("could not find device %s: %#v", deviceName, err)
+	}
+
+	ts := data.CustomTimestamp{}
+	ts.Time = time.Now()
+
+	subs := []data.Subscription{}
+	for _, v := range urls {
+		subs = append(subs, data.Subscription{
+			User:      username,
+			Devices:   deviceIds,
+			Podcast:   v,
+			Action:    action,
+			Timestamp: ts,
+		})
+	}
+
+	err = dataInterface.AddSubscriptionHistories(subs)
+	if err != nil {
+		log.Fatalf("could not record %s: %#v", action, err)
+	}
+
+	log.Printf("📻 Recorded %d %s on %d device(s)", len(urls), action, len(deviceIds))
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var exportFormat, exportFile string
+
+func init() {
+	subscriptionsCmd.AddCommand(subscriptionsExportCmd)
+	subscriptionsExportCmd.Flags().StringVarP(&exportFormat, "format", "f", "opml", "export format, either opml or txt")
+	subscriptionsExportCmd.Flags().StringVarP(&exportFile, "file", "", "", "file to write to instead of stdout")
+}
+
+var subscriptionsExportCmd = &cobra.Command{
+	Use:   "export [username] [device]",
+	Short: "Export the current subscriptions of a user or one of its devices",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if exportFormat != "opml" && exportFormat != "txt" {
+			log.Fatalf("unknown export format %q, expecting opml or txt", exportFormat)
+		}
+
+		urls, err := currentSubscriptions(data.NewSQLite(database), args)
+		if err != nil {
+			log.Fatalf("could not retrieve subscriptions: %#v", err)
+		}
+
+		out, err := formatSubscriptions(urls, exportFormat, fmt.Sprintf("%s subscriptions", args[0]))
+		if err != nil {
+			log.Fatalf("could not format subscriptions: %#v", err)
+		}
+
+		if exportFile == "" {
+			fmt.Print(out)
+			return
+		}
+
+		err = os.WriteFile(exportFile, []byte(out), 0o644)
+		if err != nil {
+			log.Fatalf("could not write %s: %#v", exportFile, err)
+		}
+
+		log.Printf("📤 Exported %d subscriptions to %s", len(urls), exportFile)
+	},
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var historySince int64
+
+func init() {
+	subscriptionsCmd.AddCommand(subscriptionsHistoryCmd)
+	subscriptionsHistoryCmd.Flags().Int64VarP(&historySince, "since", "s", 0, "only show changes after this unix timestamp")
+}
+
+var subscriptionsHistoryCmd = &cobra.Command{
+	Use:   "history [username] [device]",
+	Short: "Show the subscription changes recorded on a device",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceName := args[0], args[1]
+
+		dataInterface := data.NewSQLite(database)
+
+		subs, err := dataInterface.RetrieveSubscriptionHistory(username, deviceName, time.Unix(historySince, 0))
+		if err != nil {
+			log.Fatalf("could not retrieve subscription history: %#v", err)
+		}
+
+		if output == "json" {
+			if err := printJSON(subs); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIMESTAMP\tACTION\tPODCAST")
+		for _, v := range subs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", v.Timestamp.Format(time.RFC3339), v.Action, v.Podcast)
+		}
+		tw.Flush()
+	},
+}
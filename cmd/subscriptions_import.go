@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/utils/strings/slices"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var (
+	importFormat  string
+	importFile    string
+	importReplace bool
+)
+
+func init() {
+	subscriptionsCmd.AddCommand(subscriptionsImportCmd)
+	subscriptionsImportCmd.Flags().StringVarP(&importFormat, "format", "f", "", "import format, either opml or txt (detected when not given)")
+	subscriptionsImportCmd.Flags().StringVarP(&importFile, "file", "", "-", "file to read from, - for stdin")
+	subscriptionsImportCmd.Flags().BoolVarP(&importReplace, "replace", "", false, "also unsubscribe from podcasts that are not in the file")
+}
+
+var subscriptionsImportCmd = &cobra.Command{
+	Use:   "import [username] [device]",
+	Short: "Subscribe a device to the podcasts of an OPML or txt file",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceName := args[0], args[1]
+
+		if importFormat != "" && importFormat != "opml" && importFormat != "txt" {
+			log.Fatalf("unknown import format %q, expecting opml or txt", importFormat)
+		}
+
+		var (
+			b   []byte
+			err error
+		)
+		if importFile == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(importFile)
+		}
+		if err != nil {
+			log.Fatalf("could not read %s: %#v", importFile, err)
+		}
+
+		urls, err := parseSubscriptions(b, importFormat)
+		if err != nil {
+			log.Fatalf("could not parse %s: %#v", importFile, err)
+		}
+		urls = sanitizeSubscriptions(urls)
+
+		dataInterface := data.NewSQLite(database)
+
+		deviceIds, err := syncedDeviceIds(dataInterface, username, deviceName)
+		if err != nil {
+			log.Fatalf("could not find device %s: %#v", deviceName, err)
+		}
+
+		subscribed, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, deviceName)
+		if err != nil {
+			log.Fatalf("could not retrieve subscriptions: %#v", err)
+		}
+
+		ts := data.CustomTimestamp{}
+		ts.Time = time.Now()
+
+		// the devices of the sync group that already are in the state of
+		// the action are skipped by AddSubscriptionHistories
+		subs := []data.Subscription{}
+		record := func(podcast string, action string) {
+			subs = append(subs, data.Subscription{
+				User:      username,
+				Devices:   deviceIds,
+				Podcast:   podcast,
+				Action:    action,
+				Timestamp: ts,
+			})
+		}
+
+		added, removed := 0, 0
+		for _, v := range urls {
+			if !slices.Contains(subscribed, v) {
+				record(v, "SUBSCRIBE")
+				subscribed = append(subscribed, v)
+				added++
+			}
+		}
+
+		if importReplace {
+			for _, v := range subscribed {
+				if !slices.Contains(urls, v) {
+					record(v, "UNSUBSCRIBE")
+					removed++
+				}
+			}
+		}
+
+		err = dataInterface.AddSubscriptionHistories(subs)
+		if err != nil {
+			log.Fatalf("could not import %s: %#v", importFile, err)
+		}
+
+		log.Printf("📥 Imported %s: %d subscribed, %d unsubscribed", importFile, added, removed)
+	},
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	subscriptionsCmd.AddCommand(subscriptionsListCmd)
+}
+
+var subscriptionsListCmd = &cobra.Command{
+	Use:   "list [username] [device]",
+	Short: "List the current subscriptions of a user or one of its devices",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		urls, err := currentSubscriptions(data.NewSQLite(database), args)
+		if err != nil {
+			log.Fatalf("could not retrieve subscriptions: %#v", err)
+		}
+
+		if output == "json" {
+			if err := printJSON(urls); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		for _, v := range urls {
+			fmt.Println(v)
+		}
+	},
+}
+
+// currentSubscriptions returns the sorted podcast urls that are subscribed to
+// on the device given in args, or on any of the user's devices when there is
+// none
+func currentSubscriptions(dataInterface data.DataInterface, args []string) ([]string, error) {
+	username := args[0]
+
+	var (
+		urls []string
+		err  error
+	)
+
+	if len(args) > 1 {
+		urls, err = dataInterface.RetrieveDeviceSubscriptionsSlice(username, args[1])
+	} else {
+		urls, err = dataInterface.RetrieveAllDeviceSubscriptionsSlice(username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, v := range urls {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+
+	return unique, nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSubscriptions(t *testing.T) {
+	opml := `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head><title>subscriptions</title></head>
+  <body>
+    <outline text="a" type="rss" xmlUrl="https://example.com/a.xml"/>
+    <outline text="folder">
+      <outline text="b" type="rss" xmlUrl="https://example.com/b.xml"/>
+    </outline>
+  </body>
+</opml>`
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		format   string
+		expected []string
+	}{
+		{"opml", opml, "opml", []string{"https://example.com/a.xml", "https://example.com/b.xml"}},
+		{"detected opml", opml, "", []string{"https://example.com/a.xml", "https://example.com/b.xml"}},
+		{"txt", "# subscriptions\nhttps://example.com/a.xml\n\n  https://example.com/b.xml  \n", "txt", []string{"https://example.com/a.xml", "https://example.com/b.xml"}},
+		{"detected txt", "https://example.com/a.xml\n", "", []string{"https://example.com/a.xml"}},
+		{"empty", "", "", []string{}},
+	} {
+		urls, err := parseSubscriptions([]byte(tc.input), tc.format)
+		if err != nil {
+			t.Errorf("%s: error parsing subscriptions: %#v", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(urls, tc.expected) {
+			t.Errorf("%s: expecting %#v but got %#v", tc.name, tc.expected, urls)
+		}
+	}
+
+	_, err := parseSubscriptions([]byte("<opml><body>"), "opml")
+	if err == nil {
+		t.Errorf("expecting an invalid OPML document to be rejected")
+	}
+}
+
+// TestFormatSubscriptions tests that the exported subscriptions are read back
+// as they were by import
+func TestFormatSubscriptions(t *testing.T) {
+	urls := []string{"https://example.com/a.xml", "https://example.com/b.xml?id=1&type=audio"}
+
+	for _, format := range []string{"opml", "txt"} {
+		s, err := formatSubscriptions(urls, format, "subscriptions")
+		if err != nil {
+			t.Fatalf("%s: error formatting subscriptions: %#v", format, err)
+		}
+
+		if !strings.HasSuffix(s, "\n") {
+			t.Errorf("%s: expecting a trailing newline but got %q", format, s)
+		}
+		if format == "opml" && !strings.Contains(s, `<title>subscriptions</title>`) {
+			t.Errorf("%s: expecting the title in the document but got %s", format, s)
+		}
+
+		parsed, err := parseSubscriptions([]byte(s), "")
+		if err != nil {
+			t.Fatalf("%s: error parsing subscriptions: %#v", format, err)
+		}
+
+		if !reflect.DeepEqual(parsed, urls) {
+			t.Errorf("%s: expecting %#v to be read back but got %#v", format, urls, parsed)
+		}
+	}
+
+	s, err := formatSubscriptions(nil, "txt", "subscriptions")
+	if err != nil || s != "" {
+		t.Errorf("expecting no subscriptions to be an empty list but got %q %v", s, err)
+	}
+}
@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, either table or json")
+}
+
+var syncCmd = &cobra.Command{
+	Use:               "sync",
+	Short:             "Manage the device sync groups of users",
+	PersistentPreRunE: checkOutput,
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+var syncMerge bool
+
+func init() {
+	syncCmd.AddCommand(syncLinkCmd)
+	syncLinkCmd.Flags().BoolVarP(&syncMerge, "merge", "m", false, "merge the subscriptions of the devices without asking for confirmation")
+}
+
+var syncLinkCmd = &cobra.Command{
+	Use:   "link [username] [device] [device...]",
+	Short: "Link devices into a sync group",
+	Long:  "Link devices into a sync group so that subscription changes on any of them are applied to all of them. The devices can optionally be subscribed to each other's podcasts so that they start out with the same subscriptions.",
+	Args:  cobra.MinimumNArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceNames := args[0], args[1:]
+
+		dataInterface := data.NewSQLite(database)
+
+		if syncMerge || confirm("Merge the subscriptions of the devices so that they converge?") {
+			err := dataInterface.LinkSyncGroup(deviceNames, username)
+			if err != nil {
+				log.Fatalf("could not link devices: %#v", err)
+			}
+
+			log.Printf("🔗 Devices %v linked and their subscriptions merged!", deviceNames)
+			return
+		}
+
+		err := dataInterface.AddSyncGroup(deviceNames, username)
+		if err != nil {
+			log.Fatalf("could not link devices: %#v", err)
+		}
+
+		log.Printf("🔗 Devices %v linked!", deviceNames)
+	},
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	syncCmd.AddCommand(syncListCmd)
+}
+
+type syncListOutput struct {
+	Synchronized   [][]string `json:"synchronized"`
+	NotSynchronize []string   `json:"not-synchronize"`
+}
+
+var syncListCmd = &cobra.Command{
+	Use:   "list [username]",
+	Short: "List the sync groups of a user and the devices that are not synced",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		dataInterface := data.NewSQLite(database)
+
+		ids, err := dataInterface.GetDeviceSyncGroupIds(username)
+		if err != nil {
+			log.Fatalf("could not retrieve sync groups: %#v", err)
+		}
+
+		list := syncListOutput{Synchronized: [][]string{}}
+		for _, id := range ids {
+			names, err := dataInterface.GetDeviceNameFromDeviceSyncGroupId(id)
+			if err != nil {
+				log.Fatalf("could not retrieve devices of sync group %d: %#v", id, err)
+			}
+			list.Synchronized = append(list.Synchronized, names)
+		}
+
+		list.NotSynchronize, err = dataInterface.GetNotSyncedDevices(username)
+		if err != nil {
+			log.Fatalf("could not retrieve devices that are not synced: %#v", err)
+		}
+		if list.NotSynchronize == nil {
+			list.NotSynchronize = []string{}
+		}
+
+		if output == "json" {
+			if err := printJSON(list); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "GROUP\tDEVICES")
+		for idx, names := range list.Synchronized {
+			fmt.Fprintf(tw, "%d\t%s\n", ids[idx], strings.Join(names, ", "))
+		}
+		if len(list.NotSynchronize) > 0 {
+			fmt.Fprintf(tw, "-\t%s\n", strings.Join(list.NotSynchronize, ", "))
+		}
+		tw.Flush()
+	},
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	syncCmd.AddCommand(syncStatusCmd)
+}
+
+var syncStatusCmd = &cobra.Command{
+	Use:   "status [username]",
+	Short: "Show the status of the sync groups of a user and the devices that are out of date",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+
+		dataInterface := data.NewSQLite(database)
+
+		ids, err := dataInterface.GetDeviceSyncGroupIds(username)
+		if err != nil {
+			log.Fatalf("could not retrieve sync groups: %#v", err)
+		}
+
+		statuses := []data.SyncGroupStatus{}
+		for _, id := range ids {
+			status, err := dataInterface.GetSyncGroupStatus(id)
+			if err != nil {
+				log.Fatalf("could not retrieve status of sync group %d: %#v", id, err)
+			}
+			statuses = append(statuses, status)
+		}
+
+		if output == "json" {
+			if err := printJSON(statuses); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "GROUP\tSTATUS\tLAST SYNC\tDEVICES")
+		for _, v := range statuses {
+			lastSync := "never"
+			if v.LastSync != nil {
+				lastSync = v.LastSync.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", v.Id, v.Status, lastSync, strings.Join(v.Devices, ", "))
+		}
+		tw.Flush()
+
+		for _, v := range statuses {
+			for _, device := range v.OutOfDate {
+				fmt.Printf("\n%s in group %d is missing:\n", device.Name, v.Id)
+				for _, podcast := range device.Missing {
+					fmt.Printf("  %s\n", podcast)
+				}
+			}
+		}
+	},
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// run runs the command line args with answer as the input and returns what it
+// printed
+func run(t *testing.T, answer string, args ...string) string {
+	t.Helper()
+
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+	}()
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inW.WriteString(answer)
+	inW.Close()
+	os.Stdin = inR
+
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = outW
+
+	printed := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(outR)
+		printed <- b
+	}()
+
+	// flags keep their values between runs
+	output, syncMerge = "table", false
+
+	rootCmd.SetArgs(args)
+	err = rootCmd.Execute()
+	outW.Close()
+	b := <-printed
+	if err != nil {
+		t.Fatalf("error running %v: %#v", args, err)
+	}
+
+	return string(b)
+}
+
+// syncList returns the sync groups and the devices that are not synced as
+// listed by sync list, sorted
+func syncList(t *testing.T, db string, username string) syncListOutput {
+	t.Helper()
+
+	list := syncListOutput{}
+	err := json.Unmarshal([]byte(run(t, "", "sync", "list", username, "--database", db, "--output", "json")), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, names := range list.Synchronized {
+		sort.Strings(names)
+	}
+	sort.Strings(list.NotSynchronize)
+	return list
+}
+
+// TestSync tests that devices are linked by sync link, merging their
+// subscriptions only when asked to, listed by sync list and unlinked by sync
+// unlink
+func TestSync(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "g2g.db")
+	run(t, "", "init", "--database", db)
+
+	dataInterface := data.NewSQLite(db)
+	err := dataInterface.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []string{"phone", "laptop", "tablet"} {
+		deviceId, err := dataInterface.AddDevice("username", device, "", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dataInterface.AddSubscriptionHistory(data.Subscription{User: "username", Devices: []int{deviceId}, Podcast: "https://example.com/" + device + ".xml", Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriptions := func(device string) []string {
+		subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice("username", device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(subs)
+		return subs
+	}
+
+	if list := syncList(t, db, "username"); len(list.Synchronized) != 0 || !reflect.DeepEqual(list.NotSynchronize, []string{"laptop", "phone", "tablet"}) {
+		t.Errorf("expecting no sync groups but got %#v", list)
+	}
+
+	// the subscriptions are only merged when confirmed
+	run(t, "n\n", "sync", "link", "username", "phone", "laptop", "--database", db)
+
+	if list := syncList(t, db, "username"); !reflect.DeepEqual(list.Synchronized, [][]string{{"laptop", "phone"}}) || !reflect.DeepEqual(list.NotSynchronize, []string{"tablet"}) {
+		t.Errorf("expecting phone and laptop to be linked but got %#v", list)
+	}
+	if subs := subscriptions("laptop"); !reflect.DeepEqual(subs, []string{"https://example.com/laptop.xml"}) {
+		t.Errorf("expecting the subscriptions of laptop to be kept but got %#v", subs)
+	}
+
+	run(t, "y\n", "sync", "link", "username", "phone", "tablet", "--database", db)
+
+	if list := syncList(t, db, "username"); !reflect.DeepEqual(list.Synchronized, [][]string{{"laptop", "phone", "tablet"}}) || len(list.NotSynchronize) != 0 {
+		t.Errorf("expecting tablet to join the sync group but got %#v", list)
+	}
+	expected := []string{"https://example.com/laptop.xml", "https://example.com/phone.xml", "https://example.com/tablet.xml"}
+	for _, device := range []string{"phone", "laptop", "tablet"} {
+		if subs := subscriptions(device); !reflect.DeepEqual(subs, expected) {
+			t.Errorf("expecting %s to be subscribed to the podcasts of the sync group but got %#v", device, subs)
+		}
+	}
+
+	run(t, "", "sync", "unlink", "username", "laptop", "--database", db)
+
+	if list := syncList(t, db, "username"); !reflect.DeepEqual(list.Synchronized, [][]string{{"phone", "tablet"}}) || !reflect.DeepEqual(list.NotSynchronize, []string{"laptop"}) {
+		t.Errorf("expecting laptop to be unlinked but got %#v", list)
+	}
+}
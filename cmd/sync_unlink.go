@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+func init() {
+	syncCmd.AddCommand(syncUnlinkCmd)
+}
+
+var syncUnlinkCmd = &cobra.Command{
+	Use:   "unlink [username] [device...]",
+	Short: "Remove devices from their sync group",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username, deviceNames := args[0], args[1:]
+
+		dataInterface := data.NewSQLite(database)
+
+		for _, deviceName := range deviceNames {
+			if _, err := dataInterface.GetDeviceIdFromName(deviceName, username); err != nil {
+				log.Fatalf("could not find device %s: %#v", deviceName, err)
+			}
+
+			err := dataInterface.StopDeviceSync(deviceName, username)
+			if err != nil {
+				log.Fatalf("could not unlink device %s: %#v", deviceName, err)
+			}
+		}
+
+		log.Printf("✂️ Devices %v unlinked!", deviceNames)
+	},
+}
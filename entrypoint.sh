@@ -1,16 +1,39 @@
 #!/bin/sh
-if [ ! -f "/data/g2g.db" ]; then
-    echo "No database found, intializing gpodder2go ..."
-    /gpodder2go init
-    echo "... database initialized"
+# the healthcheck of the Dockerfile runs the entrypoint as well, to reach the
+# server with the options that it was started with
+if [ "$1" != healthcheck ]; then
+    if [ ! -f "/data/g2g.db" ]; then
+        echo "No database found, intializing gpodder2go ..."
+        /gpodder2go init
+        echo "... database initialized"
+    else
+        # apply the migrations of newer releases
+        /gpodder2go init
+    fi
+    if [ -z "$G2G_VERIFIER_SECRET_KEY" ] && [ ! -f "/data/VERIFIER_SECRET_KEY" ]; then
+        echo "VERIFIER_SECRET_KEY not found, intializing VERIFIER_SECRET_KEY ..."
+        cat /dev/urandom  | head -c 30 | base64 > /data/VERIFIER_SECRET_KEY
+        echo "... VERIFIER_SECRET_KEY initialized"
+    fi
 fi
-if [ ! -f "/data/VERIFIER_SECRET_KEY" ]; then
-    echo "VERIFIER_SECRET_KEY not found, intializing VERIFIER_SECRET_KEY ..."
-    cat /dev/urandom  | head -c 30 | base64 > /data/VERIFIER_SECRET_KEY
-    echo "... VERIFIER_SECRET_KEY initialized"
+
+# every option of serve can be set with a G2G_* environment variable or in the
+# config file at G2G_CONFIG, ADDR, NO_AUTH and /data/VERIFIER_SECRET_KEY are
+# kept for older setups and only used for the options that neither sets
+source_of() {
+    /gpodder2go config print | awk -v name="$1" '$1 == name { print $NF }'
+}
+if [ "$(source_of verifier-secret-key)" = default ] && [ -f "/data/VERIFIER_SECRET_KEY" ]; then
+    export G2G_VERIFIER_SECRET_KEY="$(cat /data/VERIFIER_SECRET_KEY)"
 fi
-if [ "$NO_AUTH" == true ]; then
-    VERIFIER_SECRET_KEY="$(cat /data/VERIFIER_SECRET_KEY)" /gpodder2go serve --addr "${ADDR:-0.0.0.0:3005}" --no-auth
-else
-    VERIFIER_SECRET_KEY="$(cat /data/VERIFIER_SECRET_KEY)" /gpodder2go serve --addr "${ADDR:-0.0.0.0:3005}"
+if [ "$(source_of addr)" = default ]; then
+    export G2G_ADDR="${ADDR:-0.0.0.0:3005}"
 fi
+if [ "$NO_AUTH" = true ] && [ "$(source_of no-auth)" = default ]; then
+    export G2G_NO_AUTH=true
+fi
+
+if [ "$1" = healthcheck ]; then
+    exec /gpodder2go healthcheck
+fi
+exec /gpodder2go serve
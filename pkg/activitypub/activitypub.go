@@ -0,0 +1,591 @@
+package activitypub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"k8s.io/utils/strings/slices"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+const (
+	ContentType = "application/activity+json"
+
+	// Public is the audience of the activities that anyone may see
+	Public = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+// maxToplistCount caps the number of podcasts that are published in, and kept
+// from, the toplists that peers exchange
+const maxToplistCount = 100
+
+// maxBodySize caps the size of the activities and actor documents that are
+// read from remote servers
+const maxBodySize = 1 << 20
+
+// ErrClosed is returned when publishing once the federation is closing
+var ErrClosed = errors.New("error publishing: the federation is closed")
+
+var jsonLDContext = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+type Actor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	Id                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name,omitempty"`
+	Summary           string      `json:"summary,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	Followers         string      `json:"followers,omitempty"`
+	PublicKey         PublicKey   `json:"publicKey"`
+}
+
+type PublicKey struct {
+	Id           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Activity struct {
+	Context   interface{}     `json:"@context,omitempty"`
+	Id        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Object    json.RawMessage `json:"object"`
+	Target    string          `json:"target,omitempty"`
+	To        []string        `json:"to,omitempty"`
+	Cc        []string        `json:"cc,omitempty"`
+	Published time.Time       `json:"published"`
+}
+
+// ObjectId returns the id of the object of the activity, which is either the
+// object itself or its id property
+func (a Activity) ObjectId() string {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		return id
+	}
+
+	var object struct {
+		Id string `json:"id"`
+	}
+	json.Unmarshal(a.Object, &object)
+	return object.Id
+}
+
+type Collection struct {
+	Context      interface{}       `json:"@context,omitempty"`
+	Id           string            `json:"id,omitempty"`
+	Type         string            `json:"type"`
+	Name         string            `json:"name,omitempty"`
+	TotalItems   int               `json:"totalItems"`
+	OrderedItems []json.RawMessage `json:"orderedItems,omitempty"`
+}
+
+// Link is how podcasts are referenced in activities, by the url of their feed
+type Link struct {
+	Type      string `json:"type"`
+	Href      string `json:"href"`
+	MediaType string `json:"mediaType,omitempty"`
+	Name      string `json:"name,omitempty"`
+
+	// Subscribers is the number of users of the instance subscribed to the
+	// podcast, only set in the toplist of an instance
+	Subscribers int `json:"subscribers,omitempty"`
+}
+
+// Federation makes the instance, and the users that opted in, ActivityPub
+// actors that publish podcast activity to the remote servers following them.
+// Local actors are referred to by their path under /ap, either
+// data.FederationInstanceActor or data.UserActor.
+type Federation struct {
+	Data   data.DataInterface
+	Host   string // Public base URL of the instance, such as https://g2g.example.com
+	Client *http.Client
+
+	// AllowHTTP lets remote actors be fetched and delivered to over plain
+	// HTTP, rather than only over HTTPS
+	AllowHTTP bool
+
+	// Peers are the hosts of the instances whose toplists are kept for the
+	// federated toplist, see PublishRecommendations
+	Peers []string
+
+	// MinSubscribers is the number of subscribers that podcasts need to be
+	// published in the toplist, so that the subscriptions of a user cannot be
+	// told apart from it
+	MinSubscribers int
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+
+	// deliveries tracks the activities that are being published and runs
+	// the Run loops, neither is added to once closed is set, see Close
+	deliveries sync.WaitGroup
+	runs       sync.WaitGroup
+	closeMu    sync.Mutex
+	closed     bool
+	stop       chan struct{}
+}
+
+func NewFederation(data data.DataInterface, host string) *Federation {
+	return &Federation{
+		Data:           data,
+		Host:           strings.TrimSuffix(host, "/"),
+		Client:         newClient(),
+		MinSubscribers: 1,
+		keys:           map[string]*rsa.PrivateKey{},
+		stop:           make(chan struct{}),
+	}
+}
+
+// Router returns the routes of the local actors, to be mounted at /ap
+func (f *Federation) Router() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/instance", f.HandleActor)
+	r.Get("/instance/outbox", f.HandleOutbox)
+	r.Get("/instance/followers", f.HandleFollowers)
+	r.Post("/instance/inbox", f.HandleInbox)
+
+	r.Get("/users/{username}", f.HandleActor)
+	r.Get("/users/{username}/outbox", f.HandleOutbox)
+	r.Get("/users/{username}/followers", f.HandleFollowers)
+	r.Post("/users/{username}/inbox", f.HandleInbox)
+
+	return r
+}
+
+// ActorId returns the ActivityPub id of a local actor
+func (f *Federation) ActorId(actor string) string {
+	return f.Host + "/ap/" + actor
+}
+
+// API Endpoint: GET /.well-known/webfinger?resource=acct:{name}@{host}
+// The instance actor is acct:{host}@{host}, as it is on Mastodon.
+func (f *Federation) HandleWebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+
+	name, domain, ok := strings.Cut(strings.TrimPrefix(resource, "acct:"), "@")
+	if !ok || domain != f.domain() {
+		w.WriteHeader(404)
+		return
+	}
+
+	actor := data.FederationInstanceActor
+	if name != f.domain() {
+		federated, err := f.Data.IsUserFederated(name)
+		if err != nil && err != sql.ErrNoRows {
+			slog.ErrorContext(r.Context(), "error checking if user is federated", "username", name, "error", err)
+			w.WriteHeader(500)
+			return
+		}
+		if !federated {
+			w.WriteHeader(404)
+			return
+		}
+		actor = data.UserActor(name)
+	}
+
+	output := map[string]interface{}{
+		"subject": resource,
+		"links": []map[string]string{
+			{"rel": "self", "type": ContentType, "href": f.ActorId(actor)},
+		},
+	}
+
+	b, err := json.Marshal(output)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error marshalling webfinger", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// API Endpoint: GET /ap/instance and /ap/users/{username}
+func (f *Federation) HandleActor(w http.ResponseWriter, r *http.Request) {
+	actor, ok := f.localActor(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := f.key(actor)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting key", "actor", actor, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	publicKeyPem, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error encoding public key", "actor", actor, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	id := f.ActorId(actor)
+	doc := Actor{
+		Context:           jsonLDContext,
+		Id:                id,
+		Type:              "Application",
+		PreferredUsername: f.domain(),
+		Name:              "gpodder2go " + f.domain(),
+		Summary:           "Podcasts that the users of this gpodder2go instance listen to",
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		PublicKey: PublicKey{
+			Id:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: publicKeyPem,
+		},
+	}
+
+	if username := chi.URLParam(r, "username"); username != "" {
+		doc.Type = "Person"
+		doc.PreferredUsername = username
+		doc.Name = username
+		doc.Summary = "Podcasts that " + username + " subscribes to"
+	}
+
+	writeActivityJSON(w, r, doc)
+}
+
+// API Endpoint: GET /ap/instance/outbox and /ap/users/{username}/outbox
+func (f *Federation) HandleOutbox(w http.ResponseWriter, r *http.Request) {
+	actor, ok := f.localActor(w, r)
+	if !ok {
+		return
+	}
+
+	activities, err := f.Data.RetrieveFederationActivities(actor, data.FederationOutbox, 20)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving outbox", "actor", actor, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	collection := Collection{
+		Context: jsonLDContext,
+		Id:      f.ActorId(actor) + "/outbox",
+		Type:    "OrderedCollection",
+	}
+	for _, a := range activities {
+		// subscriptions that were made private since they were published
+		// are no longer served
+		if username := chi.URLParam(r, "username"); username != "" && a.Type == "Add" {
+			public, err := f.isPublic(username, a)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error checking privacy of activity", "actor", actor, "activity", a.Id, "error", err)
+				w.WriteHeader(500)
+				return
+			}
+			if !public {
+				continue
+			}
+		}
+
+		collection.OrderedItems = append(collection.OrderedItems, json.RawMessage(a.Payload))
+	}
+	collection.TotalItems = len(collection.OrderedItems)
+
+	writeActivityJSON(w, r, collection)
+}
+
+// API Endpoint: GET /ap/instance/followers and /ap/users/{username}/followers
+// Only the number of followers is shown.
+func (f *Federation) HandleFollowers(w http.ResponseWriter, r *http.Request) {
+	actor, ok := f.localActor(w, r)
+	if !ok {
+		return
+	}
+
+	followers, err := f.Data.RetrieveFederationFollowers(actor)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving followers", "actor", actor, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeActivityJSON(w, r, Collection{
+		Context:    jsonLDContext,
+		Id:         f.ActorId(actor) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: len(followers),
+	})
+}
+
+// API Endpoint: POST /ap/instance/inbox and /ap/users/{username}/inbox
+func (f *Federation) HandleInbox(w http.ResponseWriter, r *http.Request) {
+	actor, ok := f.localActor(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		slog.WarnContext(r.Context(), "error reading activity", "error", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	var activity Activity
+	err = json.Unmarshal(body, &activity)
+	if err != nil || activity.Actor == "" {
+		slog.WarnContext(r.Context(), "error unmarshalling activity", "error", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	// the activity has to be signed by the key of its actor
+	var sender *Actor
+	_, err = verifyRequest(r, body, func(keyId string) (*rsa.PublicKey, error) {
+		sender, err = f.FetchActor(keyId)
+		if err != nil {
+			return nil, err
+		}
+		if sender.Id != activity.Actor || sender.PublicKey.Id != keyId {
+			return nil, errors.Errorf("key %s does not belong to %s", keyId, activity.Actor)
+		}
+		return decodePublicKey(sender.PublicKey.PublicKeyPem)
+	})
+	if err != nil {
+		slog.WarnContext(r.Context(), "error verifying activity", "activity", activity.Id, "actor", activity.Actor, "error", err)
+		w.WriteHeader(401)
+		return
+	}
+
+	err = f.receive(r.Context(), actor, activity, sender, body)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error receiving activity", "activity", activity.Id, "actor", activity.Actor, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(202)
+}
+
+// receive handles an activity that was sent to a local actor
+func (f *Federation) receive(ctx context.Context, actor string, activity Activity, sender *Actor, payload []byte) error {
+	switch activity.Type {
+	case "Follow":
+		if activity.ObjectId() != f.ActorId(actor) {
+			return nil
+		}
+
+		err := f.Data.AddFederationFollower(actor, data.FederationActor{Id: sender.Id, Inbox: sender.Inbox})
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "🤝 Followed", "follower", sender.Id, "actor", actor)
+
+		_, err = f.publish(actor, "Accept", json.RawMessage(payload), "", []data.FederationActor{{Id: sender.Id, Inbox: sender.Inbox}})
+		return err
+	case "Undo":
+		var follow Activity
+		if json.Unmarshal(activity.Object, &follow) == nil && follow.Type == "Follow" && follow.Actor == sender.Id {
+			return f.Data.DeleteFederationFollower(actor, sender.Id)
+		}
+		return nil
+	case "Accept":
+		err := f.Data.AcceptFederationFollowing(actor, sender.Id)
+		if err == sql.ErrNoRows || errors.Cause(err) == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	// anything else is only kept from the actors that are followed
+	following, err := f.Data.RetrieveFederationFollowing(actor)
+	if err != nil {
+		return err
+	}
+	for _, a := range following {
+		if a.Id != sender.Id || !a.Accepted {
+			continue
+		}
+
+		if activity.Type == "Create" && actor == data.FederationInstanceActor && f.isPeer(sender.Id) {
+			err := f.receiveToplist(ctx, sender.Id, activity.Object)
+			if err != nil {
+				return err
+			}
+		}
+
+		return f.Data.AddFederationActivity(actor, data.FederationInbox, data.FederationActivity{
+			Id:        activity.Id,
+			Type:      activity.Type,
+			Actor:     sender.Id,
+			Payload:   string(payload),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// receiveToplist caches the toplist that a peer published with
+// PublishRecommendations for the federated toplist
+func (f *Federation) receiveToplist(ctx context.Context, peer string, object json.RawMessage) error {
+	var collection Collection
+	if json.Unmarshal(object, &collection) != nil || collection.Type != "OrderedCollection" {
+		return nil
+	}
+
+	podcasts := []data.Podcast{}
+	for _, item := range collection.OrderedItems {
+		if len(podcasts) == maxToplistCount {
+			break
+		}
+
+		var link Link
+		if json.Unmarshal(item, &link) != nil || link.Type != "Link" || link.Subscribers < 1 {
+			continue
+		}
+		if !strings.HasPrefix(link.Href, "http://") && !strings.HasPrefix(link.Href, "https://") {
+			continue
+		}
+
+		podcasts = append(podcasts, data.Podcast{URL: link.Href, Title: link.Name, Subscribers: link.Subscribers})
+	}
+
+	if len(podcasts) == 0 {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "📊 Received the toplist", "peer", peer)
+	return f.Data.ReplaceFederatedToplist(peer, podcasts, time.Now())
+}
+
+// isPeer returns whether the actor is on an instance of the peer allowlist
+func (f *Federation) isPeer(actorId string) bool {
+	u, err := url.Parse(actorId)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(f.Peers, u.Host)
+}
+
+// localActor returns the local actor of the request, writing a 404 when it is
+// a user that has not opted in to federation
+func (f *Federation) localActor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		return data.FederationInstanceActor, true
+	}
+
+	federated, err := f.Data.IsUserFederated(username)
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(r.Context(), "error checking if user is federated", "username", username, "error", err)
+		w.WriteHeader(500)
+		return "", false
+	}
+	if !federated {
+		w.WriteHeader(404)
+		return "", false
+	}
+
+	return data.UserActor(username), true
+}
+
+// isPublic returns whether the podcast that a user published with an Add
+// activity is still public
+func (f *Federation) isPublic(username string, a data.FederationActivity) (bool, error) {
+	var activity struct {
+		Object Link `json:"object"`
+	}
+	err := json.Unmarshal([]byte(a.Payload), &activity)
+	if err != nil {
+		return false, errors.Wrap(err, "error decoding activity")
+	}
+
+	privacy, err := f.Data.RetrieveSubscriptionPrivacy(username, activity.Object.Href)
+	if err != nil {
+		return false, err
+	}
+
+	return privacy == data.PrivacyPublic, nil
+}
+
+// key returns the private key of a local actor, generating it on first use
+func (f *Federation) key(actor string) (*rsa.PrivateKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key, ok := f.keys[actor]; ok {
+		return key, nil
+	}
+
+	pem, err := f.Data.RetrieveFederationKey(actor)
+	if err == sql.ErrNoRows {
+		// the key that is kept is re-read, in case another process added one
+		pem, err = f.generateKey(actor)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving key")
+	}
+
+	key, err := decodePrivateKey(pem)
+	if err != nil {
+		return nil, err
+	}
+
+	f.keys[actor] = key
+	return key, nil
+}
+
+func (f *Federation) generateKey(actor string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating key")
+	}
+
+	err = f.Data.AddFederationKey(actor, encodePrivateKey(key))
+	if err != nil {
+		return "", errors.Wrap(err, "error adding key")
+	}
+
+	return f.Data.RetrieveFederationKey(actor)
+}
+
+// domain returns the host of the instance that acct: handles refer to
+func (f *Federation) domain() string {
+	u, err := url.Parse(f.Host)
+	if err != nil {
+		return f.Host
+	}
+
+	return u.Host
+}
+
+func writeActivityJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error marshalling activity", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(200)
+	w.Write(b)
+}
@@ -0,0 +1,505 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// memoryData keeps the federation data of a test instance in memory
+type memoryData struct {
+	data.DataInterface
+
+	mu         sync.Mutex
+	federated  map[string]bool
+	keys       map[string]string
+	followers  map[string][]data.FederationActor
+	following  map[string][]data.FederationActor
+	activities map[string][]data.FederationActivity
+	toplist    []data.Podcast
+	toplists   map[string][]data.Podcast
+	privacy    map[string]string
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{
+		federated:  map[string]bool{},
+		keys:       map[string]string{},
+		followers:  map[string][]data.FederationActor{},
+		following:  map[string][]data.FederationActor{},
+		activities: map[string][]data.FederationActivity{},
+		toplists:   map[string][]data.Podcast{},
+		privacy:    map[string]string{},
+	}
+}
+
+func (m *memoryData) IsUserFederated(username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.federated[username], nil
+}
+
+func (m *memoryData) RetrieveFederationKey(actor string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.keys[actor]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (m *memoryData) AddFederationKey(actor string, privateKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[actor]; !ok {
+		m.keys[actor] = privateKey
+	}
+	return nil
+}
+
+func (m *memoryData) AddFederationFollower(actor string, follower data.FederationActor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	follower.Accepted = true
+	m.followers[actor] = append(m.followers[actor], follower)
+	return nil
+}
+
+func (m *memoryData) DeleteFederationFollower(actor string, follower string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	followers := []data.FederationActor{}
+	for _, f := range m.followers[actor] {
+		if f.Id != follower {
+			followers = append(followers, f)
+		}
+	}
+	m.followers[actor] = followers
+	return nil
+}
+
+func (m *memoryData) RetrieveFederationFollowers(actor string) ([]data.FederationActor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]data.FederationActor{}, m.followers[actor]...), nil
+}
+
+func (m *memoryData) AddFederationFollowing(actor string, following data.FederationActor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.following[actor] = append(m.following[actor], following)
+	return nil
+}
+
+func (m *memoryData) AcceptFederationFollowing(actor string, following string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for idx, f := range m.following[actor] {
+		if f.Id == following {
+			m.following[actor][idx].Accepted = true
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryData) RetrieveFederationFollowing(actor string) ([]data.FederationActor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]data.FederationActor{}, m.following[actor]...), nil
+}
+
+func (m *memoryData) AddFederationActivity(actor string, box string, activity data.FederationActivity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activities[actor+"/"+box] = append([]data.FederationActivity{activity}, m.activities[actor+"/"+box]...)
+	return nil
+}
+
+func (m *memoryData) RetrieveFederationActivities(actor string, box string, count int) ([]data.FederationActivity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	activities := m.activities[actor+"/"+box]
+	if len(activities) > count {
+		activities = activities[:count]
+	}
+	return append([]data.FederationActivity{}, activities...), nil
+}
+
+func (m *memoryData) RetrievePublicToplist(count int) ([]data.Podcast, error) {
+	return m.toplist, nil
+}
+
+func (m *memoryData) RetrieveSubscriptionPrivacy(username string, podcast string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if privacy, ok := m.privacy[username+" "+podcast]; ok {
+		return privacy, nil
+	}
+	return data.PrivacyPublic, nil
+}
+
+func (m *memoryData) ReplaceFederatedToplist(peer string, podcasts []data.Podcast, receivedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toplists[peer] = podcasts
+	return nil
+}
+
+// newInstance starts a test server federating with the data of m
+func newInstance(t *testing.T, m *memoryData) *Federation {
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	f := NewFederation(m, ts.URL)
+	// the test servers are on the loopback over plain HTTP
+	f.AllowHTTP = true
+	f.Client = &http.Client{Timeout: 10 * time.Second}
+	t.Cleanup(f.Wait)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/webfinger", f.HandleWebFinger)
+	mux.Handle("/ap/", http.StripPrefix("/ap", f.Router()))
+	handler = mux
+
+	return f
+}
+
+// wait waits for the activities that the instances deliver, in order, such as
+// a follow and then the accept that it is answered with
+func wait(instances ...*Federation) {
+	for _, f := range instances {
+		f.Wait()
+	}
+}
+
+func TestFederation(t *testing.T) {
+	a := newMemoryData()
+	b := newMemoryData()
+	b.federated["alice"] = true
+	b.toplist = []data.Podcast{{URL: "https://example.com/feed.xml", Title: "Example", Subscribers: 3}}
+
+	fa := newInstance(t, a)
+	fb := newInstance(t, b)
+
+	id, err := fa.Follow(data.FederationInstanceActor, fb.ActorId(data.FederationInstanceActor))
+	if err != nil {
+		t.Fatalf("expecting instance to be followed but got %#v", err)
+	}
+	wait(fa, fb)
+	if id != fb.ActorId(data.FederationInstanceActor) {
+		t.Errorf("expecting %s to be followed but got %s", fb.ActorId(data.FederationInstanceActor), id)
+	}
+
+	followers, _ := b.RetrieveFederationFollowers(data.FederationInstanceActor)
+	if len(followers) != 1 || followers[0].Id != fa.ActorId(data.FederationInstanceActor) {
+		t.Fatalf("expecting the instance to be followed by the other but got %#v", followers)
+	}
+
+	following, _ := a.RetrieveFederationFollowing(data.FederationInstanceActor)
+	if len(following) != 1 || !following[0].Accepted {
+		t.Fatalf("expecting the follow to be accepted but got %#v", following)
+	}
+
+	err = fb.PublishRecommendations(10)
+	if err != nil {
+		t.Fatalf("expecting recommendations to be published but got %#v", err)
+	}
+	wait(fb)
+
+	inbox, _ := a.RetrieveFederationActivities(data.FederationInstanceActor, data.FederationInbox, 10)
+	if len(inbox) != 1 || inbox[0].Type != "Create" || !strings.Contains(inbox[0].Payload, "https://example.com/feed.xml") {
+		t.Fatalf("expecting the recommendations to be received but got %#v", inbox)
+	}
+
+	// subscriptions of users are published to their own followers only
+	err = fb.PublishSubscriptions("alice", []string{"https://example.com/other.xml"})
+	if err != nil {
+		t.Fatalf("expecting subscriptions to be published but got %#v", err)
+	}
+
+	// podcasts that are not public are not published
+	b.privacy["alice https://example.com/secret.xml"] = data.PrivacyPrivate
+	b.privacy["alice https://example.com/local.xml"] = data.PrivacyInstance
+	err = fb.PublishSubscriptions("alice", []string{"https://example.com/secret.xml", "https://example.com/local.xml"})
+	if err != nil {
+		t.Fatalf("expecting nothing to be published but got %#v", err)
+	}
+	wait(fb)
+
+	outbox, _ := b.RetrieveFederationActivities(data.UserActor("alice"), data.FederationOutbox, 10)
+	if len(outbox) != 1 || outbox[0].Type != "Add" || !strings.Contains(outbox[0].Payload, "other.xml") {
+		t.Errorf("expecting the subscription in the outbox of alice but got %#v", outbox)
+	}
+
+	// the subscription is no longer served once it is not public anymore
+	for _, privacy := range []string{data.PrivacyPublic, data.PrivacyInstance, data.PrivacyPrivate} {
+		b.mu.Lock()
+		b.privacy["alice https://example.com/other.xml"] = privacy
+		b.mu.Unlock()
+
+		resp, err := http.Get(fb.ActorId(data.UserActor("alice")) + "/outbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection := Collection{}
+		err = json.NewDecoder(resp.Body).Decode(&collection)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 0
+		if privacy == data.PrivacyPublic {
+			expected = 1
+		}
+		if collection.TotalItems != expected || len(collection.OrderedItems) != expected {
+			t.Errorf("expecting %d activities in the outbox of alice when %s but got %#v", expected, privacy, collection)
+		}
+	}
+
+	inbox, _ = a.RetrieveFederationActivities(data.FederationInstanceActor, data.FederationInbox, 10)
+	if len(inbox) != 1 {
+		t.Errorf("expecting the subscriptions of alice not to be received by the instance but got %#v", inbox)
+	}
+
+	err = fb.PublishSubscriptions("bob", []string{"https://example.com/other.xml"})
+	if err != nil {
+		t.Fatalf("expecting nothing to be published for bob but got %#v", err)
+	}
+	if outbox, _ := b.RetrieveFederationActivities(data.UserActor("bob"), data.FederationOutbox, 10); len(outbox) != 0 {
+		t.Errorf("expecting nothing to be published for users that did not opt in but got %#v", outbox)
+	}
+}
+
+func TestToplistExchange(t *testing.T) {
+	a := newMemoryData()
+	b := newMemoryData()
+	c := newMemoryData()
+	b.toplist = []data.Podcast{{URL: "https://example.com/popular.xml", Title: "Popular", Subscribers: 3}, {URL: "https://example.com/niche.xml", Title: "Niche", Subscribers: 1}}
+	c.toplist = []data.Podcast{{URL: "https://example.com/spam.xml", Subscribers: 1000}}
+
+	fa := newInstance(t, a)
+	fb := newInstance(t, b)
+	fc := newInstance(t, c)
+	fb.MinSubscribers = 2
+	fa.Peers = []string{fb.domain()}
+
+	for _, f := range []*Federation{fb, fc} {
+		_, err := fa.Follow(data.FederationInstanceActor, f.ActorId(data.FederationInstanceActor))
+		if err != nil {
+			t.Fatalf("expecting instance to be followed but got %#v", err)
+		}
+		wait(fa, f)
+
+		err = f.PublishRecommendations(10)
+		if err != nil {
+			t.Fatalf("expecting recommendations to be published but got %#v", err)
+		}
+		wait(f)
+	}
+
+	// podcasts with too few subscribers are left out of the toplist
+	toplist := a.toplists[fb.ActorId(data.FederationInstanceActor)]
+	if len(toplist) != 1 || toplist[0].URL != "https://example.com/popular.xml" || toplist[0].Subscribers != 3 || toplist[0].Title != "Popular" {
+		t.Errorf("expecting the popular podcast of the peer to be kept but got %#v", toplist)
+	}
+
+	outbox, _ := b.RetrieveFederationActivities(data.FederationInstanceActor, data.FederationOutbox, 10)
+	for _, activity := range outbox {
+		if strings.Contains(activity.Payload, "niche.xml") {
+			t.Errorf("expecting podcasts with too few subscribers not to be published but got %s", activity.Payload)
+		}
+	}
+
+	// the toplists of instances that are not peers are not kept
+	if toplist, ok := a.toplists[fc.ActorId(data.FederationInstanceActor)]; ok {
+		t.Errorf("expecting the toplist of an instance that is not a peer not to be kept but got %#v", toplist)
+	}
+}
+
+func TestHandleActor(t *testing.T) {
+	m := newMemoryData()
+	m.federated["alice"] = true
+	f := newInstance(t, m)
+
+	for path, expected := range map[string]int{
+		"/ap/instance":          200,
+		"/ap/users/alice":       200,
+		"/ap/users/alice/inbox": 405,
+		"/ap/users/bob":         404,
+		"/ap/users/bob/outbox":  404,
+	} {
+		resp, err := http.Get(f.Host + path)
+		if err != nil {
+			t.Fatalf("expecting %s to respond but got %#v", path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			t.Errorf("expecting %s to respond with %d but got %d", path, expected, resp.StatusCode)
+		}
+	}
+
+	for resource, expected := range map[string]int{
+		"acct:" + f.domain() + "@" + f.domain(): 200,
+		"acct:alice@" + f.domain():              200,
+		"acct:bob@" + f.domain():                404,
+		"acct:alice@example.com":                404,
+	} {
+		resp, err := http.Get(f.Host + "/.well-known/webfinger?resource=" + resource)
+		if err != nil {
+			t.Fatalf("expecting webfinger to respond but got %#v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			t.Errorf("expecting webfinger of %s to respond with %d but got %d", resource, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandleInboxRejectsUnsigned(t *testing.T) {
+	m := newMemoryData()
+	f := newInstance(t, m)
+
+	body, _ := json.Marshal(Activity{Id: "https://example.com/1", Type: "Follow", Actor: "https://example.com/actor", Object: json.RawMessage(`"` + f.ActorId(data.FederationInstanceActor) + `"`)})
+	resp, err := http.Post(f.ActorId(data.FederationInstanceActor)+"/inbox", ContentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("expecting inbox to respond but got %#v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 401 {
+		t.Errorf("expecting unsigned activities to be rejected but got %d", resp.StatusCode)
+	}
+	if followers, _ := m.RetrieveFederationFollowers(data.FederationInstanceActor); len(followers) != 0 {
+		t.Errorf("expecting no followers but got %#v", followers)
+	}
+}
+
+// TestHandleInboxRejectsInternalKeyId tests that the key of a signature is
+// not fetched from urls that are not https or that are internal, so that
+// remote servers cannot make the instance request its own network
+func TestHandleInboxRejectsInternalKeyId(t *testing.T) {
+	var requested atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Add(1)
+	}))
+	defer internal.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFederation(newMemoryData(), "https://g2g.example.com")
+	for _, allowHTTP := range []bool{false, true} {
+		f.AllowHTTP = allowHTTP
+
+		actor := internal.URL + "/actor"
+		body, _ := json.Marshal(Activity{Id: internal.URL + "/1", Type: "Follow", Actor: actor, Object: json.RawMessage(`"` + f.ActorId(data.FederationInstanceActor) + `"`)})
+		r := httptest.NewRequest(http.MethodPost, "/instance/inbox", bytes.NewReader(body))
+		err = signRequest(r, body, actor+"#main-key", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		f.Router().ServeHTTP(w, r)
+		if w.Code != 401 {
+			t.Errorf("expecting the key id %s to be rejected with http allowed %t but got %d", actor, allowHTTP, w.Code)
+		}
+	}
+
+	if n := requested.Load(); n != 0 {
+		t.Errorf("expecting no request to be made but got %d", n)
+	}
+}
+
+// TestClose tests that closing stops publishing the recommendations and
+// refuses to publish anything else
+func TestClose(t *testing.T) {
+	m := newMemoryData()
+	m.toplist = []data.Podcast{{URL: "https://example.com/feed.xml", Title: "Example", Subscribers: 3}}
+	f := NewFederation(m, "https://g2g.example.com")
+
+	stopped := make(chan struct{})
+	go func() {
+		f.Run(context.Background(), time.Hour)
+		close(stopped)
+	}()
+
+	err := f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expecting Run to be stopped once closed")
+	}
+
+	err = f.PublishRecommendations(10)
+	if err != ErrClosed {
+		t.Errorf("expecting publishing to be refused once closed but got %#v", err)
+	}
+	if outbox, _ := m.RetrieveFederationActivities(data.FederationInstanceActor, data.FederationOutbox, 10); len(outbox) != 0 {
+		t.Errorf("expecting nothing to be stored once closed but got %#v", outbox)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"type":"Follow"}`)
+	r := httptest.NewRequest(http.MethodPost, "https://example.com/ap/instance/inbox", bytes.NewReader(body))
+
+	err = signRequest(r, body, "https://remote.example/ap/instance#main-key", key)
+	if err != nil {
+		t.Fatalf("expecting request to be signed but got %#v", err)
+	}
+
+	publicKey := func(keyId string) (*rsa.PublicKey, error) {
+		return &key.PublicKey, nil
+	}
+
+	keyId, err := verifyRequest(r, body, publicKey)
+	if err != nil {
+		t.Fatalf("expecting signature to be verified but got %#v", err)
+	}
+	if keyId != "https://remote.example/ap/instance#main-key" {
+		t.Errorf("expecting the key id of the signature but got %s", keyId)
+	}
+
+	_, err = verifyRequest(r, []byte(`{"type":"Undo"}`), publicKey)
+	if err == nil {
+		t.Error("expecting a tampered body to be rejected")
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = verifyRequest(r, body, func(keyId string) (*rsa.PublicKey, error) {
+		return &other.PublicKey, nil
+	})
+	if err == nil {
+		t.Error("expecting a signature of another key to be rejected")
+	}
+}
@@ -0,0 +1,61 @@
+package activitypub
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newClient returns the client that remote servers are requested with. The
+// urls that it requests come from remote servers, such as the key ids of the
+// signatures of inbox requests, so it only connects to public addresses,
+// which covers the redirects it follows and the addresses hosts resolve to.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: dialPublic}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialed instead of the remote servers
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// dialPublic is the net.Dialer Control that refuses to connect to loopback,
+// private, link-local and unspecified addresses
+func dialPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return errors.Errorf("refusing to connect to %s, which is not a public address", host)
+	}
+
+	return nil
+}
+
+// checkRemote returns an error unless u is the url of a remote server that
+// can be requested, over HTTPS or over HTTP when AllowHTTP is set
+func (f *Federation) checkRemote(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing %s", u)
+	}
+
+	switch {
+	case parsed.Host == "":
+	case parsed.Scheme == "https":
+		return nil
+	case parsed.Scheme == "http" && f.AllowHTTP:
+		return nil
+	}
+
+	return errors.Errorf("refusing to request %s, which is not an https url", u)
+}
@@ -0,0 +1,396 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// PublishSubscriptions announces to the followers of a user that they
+// subscribed to podcasts, as Add activities of links to the feeds. Nothing is
+// published for users that have not opted in to federation, nor for the
+// podcasts that the user did not make public, see data.SettingPrivacy.
+func (f *Federation) PublishSubscriptions(username string, podcasts []string) error {
+	federated, err := f.Data.IsUserFederated(username)
+	if err != nil || !federated {
+		return err
+	}
+
+	actor := data.UserActor(username)
+	followers, err := f.Data.RetrieveFederationFollowers(actor)
+	if err != nil {
+		return err
+	}
+
+	for _, podcast := range podcasts {
+		privacy, err := f.Data.RetrieveSubscriptionPrivacy(username, podcast)
+		if err != nil {
+			return err
+		}
+		if privacy != data.PrivacyPublic {
+			continue
+		}
+
+		object, err := json.Marshal(Link{Type: "Link", Href: podcast, MediaType: "application/rss+xml"})
+		if err != nil {
+			return err
+		}
+
+		_, err = f.publish(actor, "Add", object, f.ActorId(actor)+"/subscriptions", followers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishRecommendations announces the toplist of the instance to its
+// followers, as a Create activity of a collection of links to the feeds with
+// their numbers of subscribers. Only the public subscriptions are counted,
+// only the podcasts with at least MinSubscribers subscribers are published,
+// and no user is named.
+func (f *Federation) PublishRecommendations(count int) error {
+	toplist, err := f.Data.RetrievePublicToplist(count)
+	if err != nil {
+		return err
+	}
+
+	podcasts := []data.Podcast{}
+	for _, p := range toplist {
+		if p.Subscribers >= f.MinSubscribers {
+			podcasts = append(podcasts, p)
+		}
+	}
+	if len(podcasts) == 0 {
+		return nil
+	}
+
+	collection := Collection{
+		Type:       "OrderedCollection",
+		Name:       "Recommended podcasts",
+		TotalItems: len(podcasts),
+	}
+	for _, p := range podcasts {
+		item, err := json.Marshal(Link{Type: "Link", Href: p.URL, MediaType: "application/rss+xml", Name: p.Title, Subscribers: p.Subscribers})
+		if err != nil {
+			return err
+		}
+		collection.OrderedItems = append(collection.OrderedItems, item)
+	}
+
+	object, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+
+	followers, err := f.Data.RetrieveFederationFollowers(data.FederationInstanceActor)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.publish(data.FederationInstanceActor, "Create", object, "", followers)
+	return err
+}
+
+// Run publishes the recommendations of the instance every interval until ctx
+// is done or the federation is closed
+func (f *Federation) Run(ctx context.Context, interval time.Duration) {
+	f.closeMu.Lock()
+	if f.closed {
+		f.closeMu.Unlock()
+		return
+	}
+	f.runs.Add(1)
+	f.closeMu.Unlock()
+	defer f.runs.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := f.PublishRecommendations(maxToplistCount)
+		if err != nil {
+			slog.Error("error publishing recommendations", "error", err)
+		}
+	}
+}
+
+// Follow makes a local actor follow a remote actor, given either its id or
+// its name@host handle. The remote actor is followed once it accepts.
+func (f *Federation) Follow(actor string, remote string) (string, error) {
+	id, err := f.Resolve(remote)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := f.FetchActor(id)
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Data.AddFederationFollowing(actor, data.FederationActor{Id: a.Id, Inbox: a.Inbox})
+	if err != nil {
+		return "", err
+	}
+
+	object, err := json.Marshal(a.Id)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.publish(actor, "Follow", object, "", []data.FederationActor{{Id: a.Id, Inbox: a.Inbox}})
+	if err != nil {
+		return "", err
+	}
+
+	return a.Id, nil
+}
+
+// Resolve returns the id of a remote actor from its name@host handle through
+// WebFinger. Anything else is taken to already be an id.
+func (f *Federation) Resolve(handle string) (string, error) {
+	handle = strings.TrimPrefix(handle, "@")
+	if strings.HasPrefix(handle, "http://") || strings.HasPrefix(handle, "https://") {
+		return handle, nil
+	}
+
+	_, host, ok := strings.Cut(handle, "@")
+	if !ok || host == "" {
+		return "", errors.Errorf("expecting an actor id or a name@host handle but got %s", handle)
+	}
+
+	u := url.URL{Scheme: "https", Host: host, Path: "/.well-known/webfinger", RawQuery: url.Values{"resource": {"acct:" + handle}}.Encode()}
+	resp, err := f.Client.Get(u.String())
+	if err != nil {
+		return "", errors.Wrap(err, "error looking up handle")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.Errorf("error looking up handle %s: %s", handle, resp.Status)
+	}
+
+	var jrd struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&jrd)
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding webfinger")
+	}
+
+	for _, l := range jrd.Links {
+		if l.Rel == "self" && (l.Type == ContentType || strings.Contains(l.Type, "activitystreams")) {
+			return l.Href, nil
+		}
+	}
+
+	return "", errors.Errorf("no actor found for %s", handle)
+}
+
+// FetchActor fetches a remote actor, or the owner of a key given its id,
+// signing the request as the instance actor for servers that require it
+func (f *Federation) FetchActor(id string) (*Actor, error) {
+	id, _, _ = strings.Cut(id, "#")
+
+	err := f.checkRemote(id)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, id, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Accept", ContentType)
+
+	err = f.sign(req, nil, data.FederationInstanceActor)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching actor")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Errorf("error fetching actor %s: %s", id, resp.Status)
+	}
+
+	var actor Actor
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&actor)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding actor")
+	}
+	if actor.Id != id || actor.Inbox == "" {
+		return nil, errors.Errorf("invalid actor fetched from %s", id)
+	}
+
+	return &actor, nil
+}
+
+// publish stores an activity of a local actor in its outbox and delivers it
+// to the inboxes of recipients in the background, see Wait. Failed deliveries
+// are logged and not retried. ErrClosed is returned once the federation is
+// closing.
+func (f *Federation) publish(actor string, activityType string, object json.RawMessage, target string, recipients []data.FederationActor) (Activity, error) {
+	// the activity is stored and delivered before Close returns, or not at
+	// all
+	f.closeMu.Lock()
+	if f.closed {
+		f.closeMu.Unlock()
+		return Activity{}, ErrClosed
+	}
+	f.deliveries.Add(1)
+	f.closeMu.Unlock()
+
+	activity, payload, err := f.store(actor, activityType, object, target)
+	if err != nil || len(recipients) == 0 {
+		f.deliveries.Done()
+		return activity, err
+	}
+
+	// slow remote servers do not hold up the requests that publish, such as
+	// the uploads of subscriptions or the follows that are accepted
+	go func() {
+		defer f.deliveries.Done()
+
+		for _, r := range recipients {
+			err := f.deliver(actor, r.Inbox, payload)
+			if err != nil {
+				slog.Warn("error delivering activity", "activity", activity.Id, "inbox", r.Inbox, "error", err)
+			}
+		}
+	}()
+
+	return activity, nil
+}
+
+// store stores an activity of a local actor in its outbox and returns it
+// along with its payload
+func (f *Federation) store(actor string, activityType string, object json.RawMessage, target string) (Activity, []byte, error) {
+	id := f.ActorId(actor)
+
+	activity := Activity{
+		Context:   jsonLDContext,
+		Id:        id + "/activities/" + randomId(),
+		Type:      activityType,
+		Actor:     id,
+		Object:    object,
+		Target:    target,
+		To:        []string{Public},
+		Cc:        []string{id + "/followers"},
+		Published: time.Now().UTC().Truncate(time.Second),
+	}
+
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return activity, nil, err
+	}
+
+	err = f.Data.AddFederationActivity(actor, data.FederationOutbox, data.FederationActivity{
+		Id:        activity.Id,
+		Type:      activity.Type,
+		Actor:     activity.Actor,
+		Payload:   string(payload),
+		CreatedAt: activity.Published,
+	})
+	if err != nil {
+		return activity, nil, err
+	}
+
+	return activity, payload, nil
+}
+
+// Wait waits for the activities that are being delivered
+func (f *Federation) Wait() {
+	f.deliveries.Wait()
+}
+
+// Close stops the Run loops and refuses to publish anything else, then waits
+// for the activities that are being delivered, so that nothing is written to
+// the database once it is closed
+func (f *Federation) Close() error {
+	f.closeMu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.stop)
+	}
+	f.closeMu.Unlock()
+
+	f.runs.Wait()
+	f.deliveries.Wait()
+	return nil
+}
+
+// deliver posts a signed activity to the inbox of a remote actor
+func (f *Federation) deliver(actor string, inbox string, payload []byte) error {
+	err := f.checkRemote(inbox)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", ContentType)
+
+	err = f.sign(req, payload, actor)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error posting activity")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("inbox responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (f *Federation) sign(req *http.Request, body []byte, actor string) error {
+	key, err := f.key(actor)
+	if err != nil {
+		return err
+	}
+
+	return signRequest(req, body, f.ActorId(actor)+"#main-key", key)
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
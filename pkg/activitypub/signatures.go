@@ -0,0 +1,193 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/utils/strings/slices"
+)
+
+// maxClockSkew is how far the Date of a signed request may be from now
+const maxClockSkew = time.Hour
+
+// signRequest signs r with the HTTP Signatures draft that the fediverse uses
+// https://datatracker.ietf.org/doc/html/draft-cavage-http-signatures-12
+// A body is covered by the signature through its Digest header.
+func signRequest(r *http.Request, body []byte, keyId string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", digest(body))
+		headers = append(headers, "digest")
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return errors.Wrap(err, "error signing request")
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`, keyId, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+
+	return nil
+}
+
+// verifyRequest verifies the signature of r made with the key of keyId that
+// publicKey returns, and returns keyId. The signature has to cover the
+// request target, host and date, and the digest of the body when there is
+// one.
+func verifyRequest(r *http.Request, body []byte, publicKey func(keyId string) (*rsa.PublicKey, error)) (string, error) {
+	params, err := parseSignature(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	required := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		required = append(required, "digest")
+	}
+	for _, h := range required {
+		if !slices.Contains(headers, h) {
+			return "", errors.Errorf("signature does not cover %s", h)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing date")
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", errors.Errorf("date %s is too far from now", date)
+	}
+
+	if body != nil && r.Header.Get("Digest") != digest(body) {
+		return "", errors.New("digest does not match the body")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding signature")
+	}
+
+	key, err := publicKey(params["keyId"])
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting key %s", params["keyId"])
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return "", errors.Wrap(err, "error verifying signature")
+	}
+
+	return params["keyId"], nil
+}
+
+// parseSignature parses the key="value" pairs of a Signature header
+func parseSignature(header string) (map[string]string, error) {
+	params := map[string]string{}
+
+	for _, param := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		params[k] = strings.Trim(v, `"`)
+	}
+
+	for _, k := range []string{"keyId", "headers", "signature"} {
+		if params[k] == "" {
+			return nil, errors.Errorf("signature is missing %s", k)
+		}
+	}
+
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "rsa-sha256" && algorithm != "hs2019" {
+		return nil, errors.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+
+	return params, nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := []string{}
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			// servers keep the target as it was received, before any
+			// prefix is stripped by the router
+			target := r.RequestURI
+			if target == "" {
+				target = r.URL.RequestURI()
+			}
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), target))
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines = append(lines, "host: "+host)
+		default:
+			lines = append(lines, h+": "+r.Header.Get(h))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func encodePrivateKey(key *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func decodePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})), nil
+}
+
+func decodePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
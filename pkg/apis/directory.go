@@ -0,0 +1,337 @@
+package apis
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oxtyped/go-opml/opml"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// maxDirectoryCount caps the number of podcasts or tags that a directory
+// request can ask for
+const maxDirectoryCount = 100
+
+// DirectoryAPI serves the Directory API from the podcasts that the users of
+// the instance are subscribed to, so that it can offer discovery without
+// gpodder.net.
+// https://gpoddernet.readthedocs.io/en/latest/api/reference/directory.html
+type DirectoryAPI struct {
+	Data data.DataInterface
+
+	// FederatedToplistTTL is how long the toplists received from peer
+	// instances count in the federated toplist
+	FederatedToplistTTL time.Duration
+
+	// Store caches the toplists, tags and podcast data for CacheTTL, as they
+	// are aggregated over every subscription. Nothing is cached when it is
+	// nil.
+	Store    store.Store
+	CacheTTL time.Duration
+}
+
+func NewDirectoryAPI(data data.DataInterface) *DirectoryAPI {
+	return &DirectoryAPI{
+		Data:                data,
+		FederatedToplistTTL: 14 * 24 * time.Hour,
+		CacheTTL:            5 * time.Minute,
+	}
+}
+
+// API Endpoint: GET /toplist/{count}.{format}
+func (d *DirectoryAPI) HandleToplist(w http.ResponseWriter, r *http.Request) {
+	count, ok := directoryCount(w, r)
+	if !ok {
+		return
+	}
+
+	podcasts, err := cached(r.Context(), d, fmt.Sprintf("toplist_%d", count), func() ([]data.Podcast, error) {
+		return d.Data.RetrieveToplist(count)
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving toplist", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writePodcasts(w, r, podcasts, chi.URLParam(r, "format"), "gpodder2go toplist")
+}
+
+// API Endpoint: GET /federated/toplist/{count}.{format}
+// The toplist of the instance merged with the toplists that peer instances
+// published over ActivityPub.
+func (d *DirectoryAPI) HandleFederatedToplist(w http.ResponseWriter, r *http.Request) {
+	count, ok := directoryCount(w, r)
+	if !ok {
+		return
+	}
+
+	podcasts, err := cached(r.Context(), d, fmt.Sprintf("federated_toplist_%d", count), func() ([]data.Podcast, error) {
+		return d.Data.RetrieveFederatedToplist(count, time.Now().Add(-d.FederatedToplistTTL))
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving federated toplist", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writePodcasts(w, r, podcasts, chi.URLParam(r, "format"), "gpodder2go federated toplist")
+}
+
+// API Endpoint: GET /search.{format}?q={query}
+func (d *DirectoryAPI) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		slog.WarnContext(r.Context(), "error with q query params - expecting it not to be empty")
+		w.WriteHeader(400)
+		return
+	}
+
+	podcasts, err := d.Data.SearchPodcasts(query, maxDirectoryCount)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error searching podcasts", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writePodcasts(w, r, podcasts, chi.URLParam(r, "format"), "gpodder2go search results")
+}
+
+// API Endpoint: GET /api/2/tags/{count}.json
+func (d *DirectoryAPI) HandleTopTags(w http.ResponseWriter, r *http.Request) {
+	count, ok := directoryCount(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := cached(r.Context(), d, fmt.Sprintf("tags_%d", count), func() ([]data.Tag, error) {
+		return d.Data.RetrieveTopTags(count)
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving top tags", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeJSON(w, r, tags)
+}
+
+// API Endpoint: GET /api/2/tag/{tag}/{count}.json
+func (d *DirectoryAPI) HandleTagPodcasts(w http.ResponseWriter, r *http.Request) {
+	count, ok := directoryCount(w, r)
+	if !ok {
+		return
+	}
+
+	tag := chi.URLParam(r, "tag")
+	podcasts, err := cached(r.Context(), d, fmt.Sprintf("tag_%s_%d", cacheKey(tag), count), func() ([]data.Podcast, error) {
+		return d.Data.RetrieveTagPodcasts(tag, count)
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving podcasts of tag", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeJSON(w, r, podcasts)
+}
+
+// API Endpoint: GET /api/2/data/podcast.json?url={url}
+func (d *DirectoryAPI) HandlePodcastData(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		slog.WarnContext(r.Context(), "error with url query params - expecting it not to be empty")
+		w.WriteHeader(400)
+		return
+	}
+
+	// look the podcast up the way it was stored
+	sanitized, _ := sanitizeURLs(r.Context(), []string{url})
+	if len(sanitized) == 0 {
+		w.WriteHeader(404)
+		return
+	}
+
+	podcast, err := cached(r.Context(), d, "podcast_"+cacheKey(sanitized[0]), func() (data.Podcast, error) {
+		return d.Data.RetrievePodcast(sanitized[0])
+	})
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving podcast", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeJSON(w, r, podcast)
+}
+
+// API Endpoint: GET /suggestions/{count}.{format}
+func (d *DirectoryAPI) HandleSuggestions(w http.ResponseWriter, r *http.Request) {
+	username := m2.Username(r.Context())
+	if username == "" {
+		slog.WarnContext(r.Context(), "error getting suggestions as the user is unknown")
+		w.WriteHeader(401)
+		return
+	}
+
+	count, ok := directoryCount(w, r)
+	if !ok {
+		return
+	}
+
+	podcasts, err := d.Data.RetrieveSuggestions(username, count)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving suggestions", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writePodcasts(w, r, podcasts, chi.URLParam(r, "format"), "gpodder2go suggestions")
+}
+
+// directoryCount parses the count URL param, writing a 400 when it is not a
+// positive number
+func directoryCount(w http.ResponseWriter, r *http.Request) (int, bool) {
+	count, err := strconv.Atoi(chi.URLParam(r, "count"))
+	if err != nil || count < 1 {
+		slog.WarnContext(r.Context(), "error parsing count - expecting a positive number", "count", chi.URLParam(r, "count"))
+		w.WriteHeader(400)
+		return 0, false
+	}
+
+	if count > maxDirectoryCount {
+		count = maxDirectoryCount
+	}
+
+	return count, true
+}
+
+// writePodcasts writes podcasts as either JSON, an OPML document or a plain
+// text list of urls
+func writePodcasts(w http.ResponseWriter, r *http.Request, podcasts []data.Podcast, format string, title string) {
+	switch format {
+	case "json":
+		writeJSON(w, r, podcasts)
+	case "opml":
+		doc := opml.NewOPMLFromBlank(title)
+		doc.Version = "2.0"
+		for _, p := range podcasts {
+			text := p.Title
+			if text == "" {
+				text = p.URL
+			}
+			doc.Body.Outlines = append(doc.Body.Outlines, opml.Outline{Type: "rss", Text: text, Title: p.Title, XMLURL: p.URL, HTMLURL: p.Website, Description: p.Description})
+		}
+
+		xml, err := doc.XML()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error marshalling podcasts into OPML", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/x-opml")
+		w.WriteHeader(200)
+		w.Write([]byte(xml))
+	case "txt":
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		for _, p := range podcasts {
+			w.Write([]byte(p.URL + "\n"))
+		}
+	default:
+		slog.WarnContext(r.Context(), "error writing podcasts as format is expecting json, opml or txt", "format", format)
+		w.WriteHeader(400)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error marshalling output", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// directoryGenerationKey is the key of the generation of the cached
+// directory, which the keys of the cached values include so that they are
+// all dropped at once by InvalidateDirectory
+const directoryGenerationKey = "directory_generation"
+
+// InvalidateDirectory drops the directory cached in s, such as once the
+// privacy of subscriptions changes so that the podcasts that were made private
+// are not listed until the cache expires
+func InvalidateDirectory(s store.Store) error {
+	return s.Set(directoryGenerationKey, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// cached returns the value cached at key in the store of the directory, or
+// retrieves and caches it. The database is used when the store fails, so that
+// a cache outage does not take the directory down.
+func cached[T any](ctx context.Context, d *DirectoryAPI, key string, retrieve func() (T, error)) (T, error) {
+	if d.Store == nil {
+		return retrieve()
+	}
+
+	generation, err := d.Store.Get(directoryGenerationKey)
+	if err != nil && err != store.ErrNotFound {
+		slog.WarnContext(ctx, "error retrieving from cache", "key", directoryGenerationKey, "error", err)
+		return retrieve()
+	}
+	if generation != "" {
+		key = generation + "_" + key
+	}
+
+	key = "directory_" + key
+	var value T
+	s, err := d.Store.Get(key)
+	if err == nil && json.Unmarshal([]byte(s), &value) == nil {
+		return value, nil
+	}
+	if err != nil && err != store.ErrNotFound {
+		slog.WarnContext(ctx, "error retrieving from cache", "key", key, "error", err)
+	}
+
+	value, err = retrieve()
+	if err != nil {
+		return value, err
+	}
+
+	b, err := json.Marshal(value)
+	if err == nil {
+		err = d.Store.SetWithTTL(key, string(b), d.CacheTTL)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "error caching", "key", key, "error", err)
+	}
+
+	return value, nil
+}
+
+// cacheKey hashes the values that cannot be used in keys as is, such as urls
+// with spaces that memcached rejects
+func cacheKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,210 @@
+package apis
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// TestDirectory tests the directory endpoints against the subscriptions of
+// the instance
+func TestDirectory(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	err := dataInterface.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceId, err := dataInterface.AddDevice("username", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dataInterface.AddSubscriptionHistory(data.Subscription{User: "username", Devices: []int{deviceId}, Podcast: "https://example.com/feed.rss", Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dataInterface.UpdatePodcast(data.Podcast{URL: "https://example.com/feed.rss", Title: "Example", Tags: []data.Tag{{Title: "Technology", Tag: "technology"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directoryAPI := NewDirectoryAPI(dataInterface)
+	directoryAPI.Store = store.NewCacheStore()
+
+	m := chi.NewRouter()
+	m.Get("/toplist/{count}.{format}", directoryAPI.HandleToplist)
+	m.Get("/federated/toplist/{count}.{format}", directoryAPI.HandleFederatedToplist)
+	m.Get("/search.{format}", directoryAPI.HandleSearch)
+	m.Get("/api/2/tags/{count}.json", directoryAPI.HandleTopTags)
+	m.Get("/api/2/tag/{tag}/{count}.json", directoryAPI.HandleTagPodcasts)
+	m.Get("/api/2/data/podcast.json", directoryAPI.HandlePodcastData)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	for _, path := range []string{"/toplist/10.json", "/federated/toplist/10.json", "/search.json?q=exam", "/api/2/tag/technology/10.json"} {
+		status, body := get(path)
+		if status != http.StatusOK {
+			t.Fatalf("expecting %s to be ok but got: %#v", path, status)
+		}
+
+		podcasts := []data.Podcast{}
+		err = json.Unmarshal([]byte(body), &podcasts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(podcasts) != 1 || podcasts[0].Title != "Example" || podcasts[0].Subscribers != 1 {
+			t.Errorf("expecting %s to return the podcast but got %#v", path, podcasts)
+		}
+	}
+
+	status, body := get("/toplist/10.txt")
+	if status != http.StatusOK || body != "https://example.com/feed.rss\n" {
+		t.Errorf("expecting toplist as a list of urls but got: %#v %q", status, body)
+	}
+
+	status, body = get("/api/2/tags/10.json")
+	if status != http.StatusOK || body != `[{"title":"Technology","tag":"technology","usage":1}]` {
+		t.Errorf("expecting the tags but got: %#v %s", status, body)
+	}
+
+	status, _ = get("/api/2/data/podcast.json?url=" + url.QueryEscape("HTTPS://example.com/feed.rss"))
+	if status != http.StatusOK {
+		t.Errorf("expecting podcast data to be found but got: %#v", status)
+	}
+
+	for path, expected := range map[string]int{
+		"/toplist/zero.json": http.StatusBadRequest,
+		"/toplist/10.xml":    http.StatusBadRequest,
+		"/search.json":       http.StatusBadRequest,
+		"/api/2/data/podcast.json?url=" + url.QueryEscape("https://example.com/unknown.rss"): http.StatusNotFound,
+	} {
+		if status, _ := get(path); status != expected {
+			t.Errorf("expecting %s to return %d but got: %#v", path, expected, status)
+		}
+	}
+
+	// the toplist is cached until it expires
+	err = dataInterface.AddSubscriptionHistory(data.Subscription{User: "username", Devices: []int{deviceId}, Podcast: "https://example.com/other.rss", Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, body = get("/toplist/10.txt")
+	if body != "https://example.com/feed.rss\n" {
+		t.Errorf("expecting the cached toplist but got %q", body)
+	}
+
+	err = directoryAPI.Store.Delete("directory_toplist_10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body = get("/toplist/10.txt")
+	if body != "https://example.com/feed.rss\nhttps://example.com/other.rss\n" && body != "https://example.com/other.rss\nhttps://example.com/feed.rss\n" {
+		t.Errorf("expecting the toplist to be retrieved again once expired but got %q", body)
+	}
+}
+
+// TestHandleSuggestions tests that suggestions are given to the authenticated
+// user
+func TestHandleSuggestions(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	for username, podcasts := range map[string][]string{
+		"alice": {"https://example.com/a.rss"},
+		"bob":   {"https://example.com/a.rss", "https://example.com/b.rss"},
+	} {
+		err := dataInterface.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deviceId, err := dataInterface.AddDevice(username, "phone", "", "mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, podcast := range podcasts {
+			err = dataInterface.AddSubscriptionHistory(data.Subscription{User: username, Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = dataInterface.SetUserSuggestions(username, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	directoryAPI := NewDirectoryAPI(dataInterface)
+
+	m := chi.NewRouter()
+	m.Use(m2.Verifier("secret", true))
+	m.Get("/suggestions/{count}.{format}", directoryAPI.HandleSuggestions)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/suggestions/10.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(b) != "https://example.com/b.rss\n" {
+		t.Errorf("expecting b to be suggested but got: %#v %q", resp.StatusCode, b)
+	}
+
+	resp, err = http.Get(ts.URL + "/suggestions/10.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expecting suggestions to need a user but got: %#v", resp.StatusCode)
+	}
+}
@@ -1,17 +1,17 @@
 package apis
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/augurysys/timestamp"
@@ -19,6 +19,9 @@ import (
 	"k8s.io/utils/strings/slices"
 
 	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/logging"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/sanitize"
 )
 
 type Pair struct {
@@ -48,6 +51,44 @@ func (p PairArray) String() string {
 	return astring
 }
 
+// sanitizeURLs returns the sanitized form of urls without the rejected and
+// duplicated ones, and the update_urls pairs of those that were rewritten. A
+// rejected url is rewritten to "" which tells the client to remove it.
+func sanitizeURLs(ctx context.Context, urls []string) ([]string, []Pair) {
+	sanitized := []string{}
+	pairs := []Pair{}
+
+	for _, v := range urls {
+		u, err := sanitize.URL(v)
+		if u != v {
+			pairs = append(pairs, Pair{v, u})
+		}
+		if err != nil {
+			slog.InfoContext(ctx, "rejecting url", "url", v, "error", err)
+			continue
+		}
+
+		if !slices.Contains(sanitized, u) {
+			sanitized = append(sanitized, u)
+		}
+	}
+
+	return sanitized, pairs
+}
+
+// deviceId returns the database id of deviceName, registering the device when
+// it does not exist yet and registration is enabled
+func (d DeviceRegistration) deviceId(ctx context.Context, db data.DataInterface, username string, deviceName string, reason string) (int, error) {
+	deviceId, err := db.GetDeviceIdFromName(deviceName, username)
+	if err != sql.ErrNoRows || !d.Enabled {
+		return deviceId, err
+	}
+
+	slog.InfoContext(ctx, "registering unknown device", "device", deviceName, "username", username, "reason", reason)
+
+	return db.RegisterDevice(username, deviceName, d.Caption, d.Type, reason)
+}
+
 // HandleLogin uses Basic Auth to check on a user's credentials and return a
 // cookie session that will be used for subsequent calls
 func (u *UserAPI) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -58,25 +99,68 @@ func (u *UserAPI) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(401)
 		return
 	}
-	expire := time.Now().Add(2 * time.Minute)
+	expire := time.Now().Add(u.SessionTTL)
 
 	if !db.CheckUserPassword(username, password) {
 		w.WriteHeader(401)
 		return
 	}
 
-	mac := hmac.New(sha256.New, []byte(u.verifierSecretKey))
-	mac.Write([]byte(username))
-	sig := mac.Sum(nil)
+	secret, err := db.RetrieveSessionSecret(username)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving session secret", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	sig := m2.SessionSignature(u.verifierSecretKey, username, secret)
 
 	preEncoded := fmt.Sprintf("%s.%s", sig, username)
 
 	hash := base64.StdEncoding.EncodeToString([]byte(preEncoded))
 
+	if u.Sessions != nil {
+		err = u.Sessions.SetWithTTL(m2.SessionKey(hash), username, u.SessionTTL)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error storing session", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+
 	cookie := http.Cookie{Name: "sessionid", Value: hash, Path: "/", SameSite: http.SameSiteLaxMode, Expires: expire}
 
 	http.SetCookie(w, &cookie)
 	w.WriteHeader(200)
+
+	if u.Observer != nil {
+		u.Observer.LoggedIn(username, expire)
+	}
+}
+
+// HandleLogout ends the session of the session cookie, which is then rejected
+// even before it expires when sessions are kept in a store
+func (u *UserAPI) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	ck, err := r.Cookie("sessionid")
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if u.Sessions != nil {
+		err = u.Sessions.Delete(m2.SessionKey(ck.Value))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error deleting session", "error", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "sessionid", Value: "", Path: "/", SameSite: http.SameSiteLaxMode, MaxAge: -1})
+	w.WriteHeader(200)
+
+	if u.Observer != nil {
+		u.Observer.LoggedOut(chi.URLParam(r, "username"))
+	}
 }
 
 // HandleUserCreate takes in a username and password AND must only be able to be
@@ -85,7 +169,7 @@ func (u *UserAPI) HandleUserCreate(w http.ResponseWriter, r *http.Request) {
 	// Takes in a form data of username and password
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("error parsing form: %#v", err)
+		slog.WarnContext(r.Context(), "error parsing form", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -96,7 +180,7 @@ func (u *UserAPI) HandleUserCreate(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 	err = u.Data.AddUser(username, password, email, name)
 	if err != nil {
-		log.Printf("error adding user: %#v", err)
+		slog.WarnContext(r.Context(), "error adding user", "error", err)
 		w.WriteHeader(400)
 		w.Write([]byte(err.Error()))
 		return
@@ -113,13 +197,13 @@ func (d *DeviceAPI) HandleUpdateDevice(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
 	deviceName := chi.URLParam(r, "deviceid")
 
-	log.Printf("username is %s, deviceName is %s", username, deviceName)
+	slog.DebugContext(r.Context(), "updating device", "username", username, "device", deviceName)
 
 	ddr := &DeviceDataRequest{}
 
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error reading body from payload: %#v", err)
+		slog.WarnContext(r.Context(), "error reading body from payload", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -128,16 +212,16 @@ func (d *DeviceAPI) HandleUpdateDevice(w http.ResponseWriter, r *http.Request) {
 
 	err = json.Unmarshal(payload, ddr)
 	if err != nil {
-		log.Printf("error decoding json payload: %#v", err)
+		slog.WarnContext(r.Context(), "error decoding json payload", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 
-	log.Printf("DDR is %#v and %#v %#v", ddr, username, deviceName)
+	slog.DebugContext(r.Context(), "device data request", logging.PayloadKey, ddr)
 
 	_, err = d.Data.UpdateOrCreateDevice(username, deviceName, ddr.Caption, ddr.Type)
 	if err != nil {
-		log.Printf("error adding device: %#v", err)
+		slog.WarnContext(r.Context(), "error adding device", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -158,7 +242,7 @@ func (d *DeviceAPI) HandleGetDevices(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
 	devices, err := d.Data.RetrieveDevices(username)
 	if err != nil {
-		log.Printf("error retrieving devices: %#v", err)
+		slog.WarnContext(r.Context(), "error retrieving devices", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -166,7 +250,7 @@ func (d *DeviceAPI) HandleGetDevices(w http.ResponseWriter, r *http.Request) {
 	for _, v := range devices {
 		subs, err := d.Data.RetrieveSubscriptionHistory(username, v.Name, time.Time{})
 		if err != nil {
-			log.Printf("error retrieving subscription history: %#v", err)
+			slog.ErrorContext(r.Context(), "error retrieving subscription history", "error", err)
 			continue
 		}
 
@@ -191,7 +275,7 @@ func (d *DeviceAPI) HandleGetDevices(w http.ResponseWriter, r *http.Request) {
 
 		devicesOutput, err = json.Marshal(deviceSlice)
 		if err != nil {
-			log.Printf("error marshalling devices: %#v", err)
+			slog.WarnContext(r.Context(), "error marshalling devices", "error", err)
 			w.WriteHeader(400)
 			return
 		}
@@ -221,14 +305,14 @@ func (s *SubscriptionAPI) HandleGetDeviceSubscriptionChange(w http.ResponseWrite
 
 	since := r.URL.Query().Get("since")
 	if since == "" {
-		log.Println("error with since query params - expecting it not to be empty but got \"\"")
+		slog.WarnContext(r.Context(), "error with since query params - expecting it not to be empty")
 		w.WriteHeader(400)
 		return
 
 	}
 
 	if format != "json" {
-		log.Printf("error uploading device subscription changes as format is expecting JSON but got %#v", format)
+		slog.WarnContext(r.Context(), "error uploading device subscription changes as format is expecting JSON", "format", format)
 		w.WriteHeader(400)
 		return
 	}
@@ -240,24 +324,17 @@ func (s *SubscriptionAPI) HandleGetDeviceSubscriptionChange(w http.ResponseWrite
 	}
 
 	db := s.Data
-	var tm time.Time
-
-	if since == "0" {
-		tm = time.Unix(0, 0)
-	} else {
-		i, err := strconv.ParseInt(since, 10, 64)
-		if err != nil {
-			log.Printf("error parsing strconv: %#v", err)
-			w.WriteHeader(400)
-			return
-		}
 
-		tm = time.Unix(i, 0)
+	tm, err := data.ParseSince(since)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error parsing since", "since", since, "error", err)
+		w.WriteHeader(400)
+		return
 	}
 
 	subs, err := db.RetrieveSubscriptionHistory(username, deviceId, tm)
 	if err != nil {
-		log.Printf("error retrieving subscription history: %#v", err)
+		slog.ErrorContext(r.Context(), "error retrieving subscription history", "error", err)
 
 		w.WriteHeader(400)
 		return
@@ -270,7 +347,7 @@ func (s *SubscriptionAPI) HandleGetDeviceSubscriptionChange(w http.ResponseWrite
 
 	outputPayload, err := json.Marshal(subscriptionChanges)
 	if err != nil {
-		log.Printf("error marshalling subscription changes into JSON string: %#v", err)
+		slog.WarnContext(r.Context(), "error marshalling subscription changes into JSON string", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -291,14 +368,14 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscriptionChange(w http.ResponseWr
 	format := chi.URLParam(r, "format")
 
 	if format != "json" {
-		log.Printf("error uploading device subscription changes as format is expecting JSON but got %#v", format)
+		slog.WarnContext(r.Context(), "error uploading device subscription changes as format is expecting JSON", "format", format)
 		w.WriteHeader(400)
 		return
 	}
 
-	deviceId, err := s.Data.GetDeviceIdFromName(deviceIdStr, username)
+	deviceId, err := s.Registration.deviceId(r.Context(), s.Data, username, deviceIdStr, "subscription changes upload")
 	if err != nil {
-		log.Printf("error parsing device id: %s", err)
+		slog.ErrorContext(r.Context(), "error parsing device id", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -306,13 +383,26 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscriptionChange(w http.ResponseWr
 	err = json.NewDecoder(r.Body).Decode(&subscriptionChanges)
 	if err != nil {
 
-		log.Printf("error decoding json payload: %#v", err)
+		slog.WarnContext(r.Context(), "error decoding json payload", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 
-	addSlice := subscriptionChanges.Add
-	removeSlice := subscriptionChanges.Remove
+	pairz := []Pair{}
+
+	addSlice, addPairs := sanitizeURLs(r.Context(), subscriptionChanges.Add)
+	removeSlice, removePairs := sanitizeURLs(r.Context(), subscriptionChanges.Remove)
+	pairz = append(pairz, addPairs...)
+	pairz = append(pairz, removePairs...)
+
+	// the spec does not allow a podcast to be both added and removed
+	for _, v := range addSlice {
+		if slices.Contains(removeSlice, v) {
+			slog.WarnContext(r.Context(), "error uploading device subscription changes as a podcast is both added and removed", "url", v)
+			w.WriteHeader(400)
+			return
+		}
+	}
 
 	ts := data.CustomTimestamp{}
 	ts.Time = time.Now()
@@ -321,7 +411,7 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscriptionChange(w http.ResponseWr
 
 	syncDevices, err := db.GetDevicesInSyncGroupFromDeviceId(deviceId)
 	if err != nil {
-		log.Printf("error trying to retrieve devices in sync_group: %s", err)
+		slog.ErrorContext(r.Context(), "error trying to retrieve devices in sync_group", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -330,36 +420,35 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscriptionChange(w http.ResponseWr
 		syncDevices = []int{deviceId}
 	}
 
-	pairz := []Pair{}
+	subs := []data.Subscription{}
 	for _, v := range addSlice {
-		sub := data.Subscription{
+		subs = append(subs, data.Subscription{
 			User:      username,
 			Devices:   syncDevices,
 			Podcast:   v,
 			Timestamp: ts,
 			Action:    "SUBSCRIBE",
-		}
-		pair := Pair{v, v}
-		pairz = append(pairz, pair)
-		err := db.AddSubscriptionHistory(sub)
-		if err != nil {
-			log.Printf("error adding subscription: %#v", err)
-		}
+		})
 	}
 
 	for _, v := range removeSlice {
-		sub := data.Subscription{
+		subs = append(subs, data.Subscription{
 			User:      username,
 			Devices:   syncDevices,
 			Podcast:   v,
 			Timestamp: ts,
 			Action:    "UNSUBSCRIBE",
-		}
-		pair := Pair{v, v}
-		pairz = append(pairz, pair)
-		db.AddSubscriptionHistory(sub)
+		})
 	}
 
+	err = db.AddSubscriptionHistories(subs)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error adding subscriptions", "error", err)
+	}
+
+	s.publish(r.Context(), username, addSlice)
+	s.uploaded(username)
+
 	pp := PairArray{pairz}
 
 	subscriptionChangeOutput := &SubscriptionChangeOutput{
@@ -369,7 +458,7 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscriptionChange(w http.ResponseWr
 
 	outputBytes, err := json.Marshal(subscriptionChangeOutput)
 	if err != nil {
-		log.Printf("error marshalling output: %#v", err)
+		slog.WarnContext(r.Context(), "error marshalling output", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -412,9 +501,9 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 
 	username := chi.URLParam(r, "username")
 	deviceIdStr := chi.URLParam(r, "deviceid")
-	deviceId, err := s.Data.GetDeviceIdFromName(deviceIdStr, username)
+	deviceId, err := s.Registration.deviceId(r.Context(), s.Data, username, deviceIdStr, "subscriptions upload")
 	if err != nil {
-		log.Printf("error parsing device id: %s", err)
+		slog.ErrorContext(r.Context(), "error parsing device id", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -425,28 +514,29 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 
 	switch r.Method {
 	case "POST":
-		log.Println("Receive a POST")
+		slog.DebugContext(r.Context(), "receive a POST")
 	case "PUT":
 		// Upload entire subscriptions
 
 		// TODO: need to handle all the different formats, json, xml, text etc
 
-		log.Println("Receive a PUT")
-		log.Printf("Saving subscription...")
+		slog.DebugContext(r.Context(), "receive a PUT, saving subscriptions")
 
 		b, _ := io.ReadAll(r.Body)
 
 		var arr []string
 		err := json.Unmarshal(b, &arr)
 		if err != nil {
-			log.Printf("error unmarshalling payload to json: %s", err)
+			slog.WarnContext(r.Context(), "error unmarshalling payload to json", "error", err)
 			w.WriteHeader(400)
 			return
 		}
 
+		arr, _ = sanitizeURLs(r.Context(), arr)
+
 		f, err := os.Create(fmt.Sprintf("%s-%d.%s", username, deviceId, format))
 		if err != nil {
-			log.Printf("error saving file: %#v", err)
+			slog.WarnContext(r.Context(), "error saving file", "error", err)
 			w.WriteHeader(400)
 			return
 		}
@@ -458,20 +548,19 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 
 		subscribedPodcasts, err := s.Data.RetrieveDeviceSubscriptionsSlice(username, deviceIdStr)
 		if err != nil {
-			log.Printf("error getting subscriptions: %#v", err)
+			slog.ErrorContext(r.Context(), "error getting subscriptions", "error", err)
 			w.WriteHeader(500)
 			return
 		}
 
-		log.Printf("Current subscription on device on server count: %d", len(subscribedPodcasts))
-		log.Printf("Subscription on local machine count: %d", len(arr))
+		slog.DebugContext(r.Context(), "comparing subscriptions", "server", len(subscribedPodcasts), "device", len(arr))
 
 		// there should be some room to optimize these 2 loops, will need to find a
 		// better way
 		for _, v := range arr {
 			// if local subscription is not in subscribed podcast, add it in.
 			if !slices.Contains(subscribedPodcasts, v) {
-				log.Printf("To Be Added: %s\n", v)
+				slog.DebugContext(r.Context(), "to be added", logging.PayloadKey, v)
 				toBeAdded = append(toBeAdded, v)
 			}
 		}
@@ -480,7 +569,7 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 
 			// if subscribed podcasts is not in the local subscriptions, remove it
 			if !slices.Contains(arr, v) {
-				log.Printf("To Be Removed: %s\n", v)
+				slog.DebugContext(r.Context(), "to be removed", logging.PayloadKey, v)
 				toBeRemoved = append(toBeRemoved, v)
 
 			}
@@ -488,27 +577,33 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 		}
 
 		// https://github.com/gpodder/mygpo/blob/80c41dc0c9a58dc0e85f6ef56662cdfd0d6e3b16/mygpo/api/simple.py#L213
+		subs := []data.Subscription{}
 		for _, v := range toBeAdded {
-			sub := data.Subscription{
+			subs = append(subs, data.Subscription{
 				User:      username,
 				Devices:   []int{deviceId},
 				Podcast:   v,
 				Action:    "SUBSCRIBE",
 				Timestamp: ts,
-			}
-			s.Data.AddSubscriptionHistory(sub)
+			})
 		}
 		for _, v := range toBeRemoved {
-			sub := data.Subscription{
+			subs = append(subs, data.Subscription{
 				User:      username,
 				Devices:   []int{deviceId},
 				Podcast:   v,
 				Action:    "UNSUBSCRIBE",
 				Timestamp: ts,
-			}
-			s.Data.AddSubscriptionHistory(sub)
+			})
+		}
+		err = s.Data.AddSubscriptionHistories(subs)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error adding subscriptions", "error", err)
 		}
 
+		s.publish(r.Context(), username, toBeAdded)
+		s.uploaded(username)
+
 		w.WriteHeader(200)
 		return
 	default:
@@ -518,27 +613,85 @@ func (s *SubscriptionAPI) HandleUploadDeviceSubscription(w http.ResponseWriter,
 	}
 }
 
+// publish announces the podcasts that a user subscribed to, failing to do so
+// does not fail the upload
+func (s *SubscriptionAPI) publish(ctx context.Context, username string, podcasts []string) {
+	if s.Publisher == nil || len(podcasts) == 0 {
+		return
+	}
+
+	err := s.Publisher.PublishSubscriptions(username, podcasts)
+	if err != nil {
+		slog.ErrorContext(ctx, "error publishing subscriptions", "error", err)
+	}
+}
+
+// uploaded tells the Observer that a user uploaded subscriptions
+func (s *SubscriptionAPI) uploaded(username string) {
+	if s.Observer != nil {
+		s.Observer.Uploaded(username, UploadSubscriptions)
+	}
+}
+
 // EpisodeAPI
 
+// API Endpoint: GET /api/2/episodes/{username}.json
 func (e *EpisodeAPI) HandleEpisodeAction(w http.ResponseWriter, r *http.Request) {
 	// username
 	// format - defaulting to "json" as per spec
-	// username := chi.URLParam(r, "username")
+	username := chi.URLParam(r, "username")
+	if authenticated := m2.Username(r.Context()); authenticated != "" && authenticated != username {
+		slog.WarnContext(r.Context(), "error accessing episode actions of another user", "username", username)
+		w.WriteHeader(401)
+		return
+	}
+	ts := time.Now()
 
-	// body:
+	// query:
 	// podcast (string) optional
 	// device (string) optional
 	// since (int) optional also, if no actions, then release all
 	// aggregated (bool)
+	query := r.URL.Query()
+
+	since := time.Unix(0, 0)
+	if query.Get("since") != "" {
+		var err error
+		since, err = data.ParseSince(query.Get("since"))
+		if err != nil {
+			slog.WarnContext(r.Context(), "error parsing since", "since", query.Get("since"), "error", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	aggregated := query.Get("aggregated") == "true"
+
+	policy, err := e.Data.GetUserPositionPolicy(username)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error getting position policy", "username", username, "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	if policy == "" {
+		policy = e.PositionPolicy
+	}
+
+	actions, err := e.Data.RetrieveEpisodeActionHistory(username, query.Get("podcast"), query.Get("device"), since, aggregated, policy)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving episode action history", "error", err)
+		w.WriteHeader(500)
+		return
+	}
 
 	episodeActionOutput := &EpisodeActionOutput{
-		Actions:   []data.EpisodeAction{},
-		Timestamp: timestamp.Now(),
+		Actions:   actions,
+		Timestamp: timestamp.Time(ts),
 	}
 
 	episodeActionOutputBytes, err := json.Marshal(episodeActionOutput)
 	if err != nil {
-		log.Printf("error marshalling episodes actions output: %#v", err)
+		slog.WarnContext(r.Context(), "error marshalling episodes actions output", "error", err)
 		w.WriteHeader(400)
 		return
 	}
@@ -561,20 +714,73 @@ func (e *EpisodeAPI) HandleUploadEpisodeAction(w http.ResponseWriter, r *http.Re
 
 	err := json.Unmarshal(b, &arr)
 	if err != nil {
-		log.Printf("error unmarshalling: %#v", err)
+		slog.WarnContext(r.Context(), "error unmarshalling", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 
-	for _, data := range arr {
-		err := e.Data.AddEpisodeActionHistory(username, data)
+	// validate every item before storing any of them so that a client can fix
+	// all of its errors at once and retry the whole upload
+	actionErrors := []EpisodeActionError{}
+	for i := range arr {
+		action := &arr[i]
+
+		podcast, podcastPairs := sanitizeURLs(r.Context(), []string{action.Podcast})
+		episode, episodePairs := sanitizeURLs(r.Context(), []string{action.Episode})
+		pairz = append(pairz, podcastPairs...)
+		pairz = append(pairz, episodePairs...)
+
+		if len(podcast) == 0 || len(episode) == 0 {
+			actionErrors = append(actionErrors, EpisodeActionError{Index: i, Message: fmt.Sprintf("podcast (%s) or episode (%s) is not a valid url", action.Podcast, action.Episode)})
+			continue
+		}
+		action.Podcast, action.Episode = podcast[0], episode[0]
+
+		err := validateEpisodeAction(action, ts)
 		if err != nil {
-			log.Printf("error adding episode action into history: %#v", err)
+			actionErrors = append(actionErrors, EpisodeActionError{Index: i, Message: err.Error()})
+			continue
 		}
-		pair := Pair{
-			data.Episode, data.Episode,
+
+		// clients reference the device by its name, resolve it into the
+		// database id when the ids are not provided
+		if len(action.Devices) == 0 && action.Device != "" {
+			deviceId, err := e.Registration.deviceId(r.Context(), e.Data, username, action.Device, "episode actions upload")
+			if err == sql.ErrNoRows {
+				actionErrors = append(actionErrors, EpisodeActionError{Index: i, Message: fmt.Sprintf("device (%s) does not exist", action.Device)})
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error getting device id from name", "device", action.Device, "error", err)
+				w.WriteHeader(500)
+				return
+			}
+			action.Devices = []int{deviceId}
+		}
+	}
+
+	if len(actionErrors) > 0 {
+		slog.InfoContext(r.Context(), "rejecting episode actions upload", "items", len(arr), "errors", len(actionErrors))
+		outputBytes, err := json.Marshal(&EpisodeActionErrors{Errors: actionErrors})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error marshalling output", "error", err)
+			w.WriteHeader(500)
+			return
 		}
-		pairz = append(pairz, pair)
+		w.WriteHeader(400)
+		w.Write(outputBytes)
+		return
+	}
+
+	err = e.Data.AddEpisodeActionHistories(username, arr)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error adding episode actions into history", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if e.Observer != nil {
+		e.Observer.Uploaded(username, UploadEpisodeActions)
 	}
 
 	// format
@@ -587,15 +793,63 @@ func (e *EpisodeAPI) HandleUploadEpisodeAction(w http.ResponseWriter, r *http.Re
 
 	outputBytes, err := json.Marshal(subscriptionChangeOutput)
 	if err != nil {
-		log.Printf("error marshalling output: %#v", err)
+		slog.WarnContext(r.Context(), "error marshalling output", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 	w.WriteHeader(200)
-	log.Printf("outputbytes is %#v", string(outputBytes))
+	slog.DebugContext(r.Context(), "episode actions upload response", logging.PayloadKey, string(outputBytes))
 	w.Write(outputBytes)
 }
 
+// validateEpisodeAction checks an uploaded episode action against the spec
+// https://gpoddernet.readthedocs.io/en/latest/api/reference/events.html
+// while fixing up the quirks of known clients: upper case actions, and
+// position, started and total set to 0 or -1 for actions other than play.
+// Actions without a timestamp happened at now.
+func validateEpisodeAction(action *data.EpisodeAction, now time.Time) error {
+	action.Action = strings.ToLower(strings.TrimSpace(action.Action))
+
+	fields := []struct {
+		name  string
+		value **int
+	}{
+		{"position", &action.Position},
+		{"started", &action.Started},
+		{"total", &action.Total},
+	}
+
+	switch action.Action {
+	case data.EpisodeActionPlay:
+		if action.Position == nil {
+			return fmt.Errorf("play action requires a position")
+		}
+		for _, field := range fields {
+			if *field.value != nil && **field.value < 0 {
+				return fmt.Errorf("%s (%d) must not be negative", field.name, **field.value)
+			}
+		}
+	case data.EpisodeActionDownload, data.EpisodeActionDelete, data.EpisodeActionNew:
+		for _, field := range fields {
+			if *field.value == nil {
+				continue
+			}
+			if **field.value != 0 && **field.value != -1 {
+				return fmt.Errorf("%s is only allowed for play actions", field.name)
+			}
+			*field.value = nil
+		}
+	default:
+		return fmt.Errorf("unknown action (%s)", action.Action)
+	}
+
+	if action.Timestamp.IsZero() {
+		action.Timestamp = data.CustomTimestamp{Time: now.UTC()}
+	}
+
+	return nil
+}
+
 // GET /api/2/sync-devices/{username}.json
 func (s *SyncAPI) HandleGetSync(w http.ResponseWriter, r *http.Request) {
 
@@ -607,13 +861,13 @@ func (s *SyncAPI) HandleGetSync(w http.ResponseWriter, r *http.Request) {
 
 	syncIds, err := db.GetDeviceSyncGroupIds(username)
 	if err != nil {
-		log.Printf("error getting sync devices for username (%s): %s", username, err)
+		slog.ErrorContext(r.Context(), "error getting sync devices", "username", username, "error", err)
 		w.WriteHeader(500)
 		return
 	}
 	notsyncDevices, err := db.GetNotSyncedDevices(username)
 	if err != nil {
-		log.Printf("error getting not_synced devices for username (%s): %s", username, err)
+		slog.ErrorContext(r.Context(), "error getting not_synced devices", "username", username, "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -623,15 +877,23 @@ func (s *SyncAPI) HandleGetSync(w http.ResponseWriter, r *http.Request) {
 	for _, id := range syncIds {
 		sync, err := db.GetDeviceNameFromDeviceSyncGroupId(id)
 		if err != nil {
-			log.Printf("error retrieving devices from sync group_id: (%d): %s", id, err)
+			slog.ErrorContext(r.Context(), "error retrieving devices from sync group", "group_id", id, "error", err)
 		}
 
 		syncStatus.Synchronized = append(syncStatus.Synchronized, sync)
+
+		groupStatus, err := db.GetSyncGroupStatus(id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error retrieving status of sync group", "group_id", id, "error", err)
+			continue
+		}
+
+		syncStatus.SyncStatus = append(syncStatus.SyncStatus, groupStatus)
 	}
 
 	jsonBytes, err := json.Marshal(syncStatus)
 	if err != nil {
-		log.Printf("error marshalling sync status: %#v", err)
+		slog.ErrorContext(r.Context(), "error marshalling sync status", "error", err)
 		w.WriteHeader(500)
 	}
 
@@ -649,26 +911,29 @@ func (s *SyncAPI) HandlePostSync(w http.ResponseWriter, r *http.Request) {
 
 	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error reading request body: %#v", err)
+		slog.WarnContext(r.Context(), "error reading request body", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 
 	err = json.Unmarshal(respBody, &syncReq)
 	if err != nil {
-		log.Printf("error unmarshalling sync device request: %#v", err)
+		slog.WarnContext(r.Context(), "error unmarshalling sync device request", "error", err)
 		w.WriteHeader(400)
 		return
 	}
 
 	for _, syncgroups := range syncReq.Synchronize {
-		err := s.Data.AddSyncGroup(syncgroups, username)
+		if len(syncgroups) == 0 {
+			continue
+		}
+
+		err := s.Data.LinkSyncGroup(syncgroups, username)
 		if err != nil {
-			log.Printf("errors adding sync group: %#v", err)
+			slog.ErrorContext(r.Context(), "errors adding sync group", "error", err)
 			w.WriteHeader(500)
 			return
 		}
-
 	}
 
 	for _, device := range syncReq.StopSynchronize {
@@ -680,7 +945,7 @@ func (s *SyncAPI) HandlePostSync(w http.ResponseWriter, r *http.Request) {
 	// get all the device_sync group_id belonging to user
 	ids, err := s.Data.GetDeviceSyncGroupIds(username)
 	if err != nil {
-		log.Printf("error getting devices sync groups id from username: %#v", err)
+		slog.ErrorContext(r.Context(), "error getting devices sync groups id from username", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -688,7 +953,7 @@ func (s *SyncAPI) HandlePostSync(w http.ResponseWriter, r *http.Request) {
 	for _, deviceSyncGroupId := range ids {
 		devices, err := s.Data.GetDeviceNameFromDeviceSyncGroupId(deviceSyncGroupId)
 		if err != nil {
-			log.Printf("error getting device names from device sync id: %#v", err)
+			slog.ErrorContext(r.Context(), "error getting device names from device sync id", "error", err)
 			w.WriteHeader(500)
 			return
 		}
@@ -699,7 +964,7 @@ func (s *SyncAPI) HandlePostSync(w http.ResponseWriter, r *http.Request) {
 
 	notSyncedDevices, err := s.Data.GetNotSyncedDevices(username)
 	if err != nil {
-		log.Printf("error getting devices that are not synced: %#v", err)
+		slog.ErrorContext(r.Context(), "error getting devices that are not synced", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -708,7 +973,7 @@ func (s *SyncAPI) HandlePostSync(w http.ResponseWriter, r *http.Request) {
 
 	respBytes, err := json.Marshal(syncResp)
 	if err != nil {
-		log.Printf("error marshalling json for sync response: %#v", err)
+		slog.ErrorContext(r.Context(), "error marshalling json for sync response", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -16,6 +16,8 @@ import (
 	"github.com/augurysys/timestamp"
 	"github.com/go-chi/chi/v5"
 	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/store"
 )
 
 func cleanup(t *testing.T, db *sql.DB) {
@@ -41,7 +43,19 @@ func cleanup(t *testing.T, db *sql.DB) {
 	if err != nil {
 		t.Error(err)
 	}
-	_, err = db.Exec("DELETE FROM device_sync_group_devices")
+	_, err = db.Exec("DELETE FROM audit_events")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Exec("DELETE FROM podcast_tags")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Exec("DELETE FROM podcasts")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Exec("DELETE FROM settings")
 	if err != nil {
 		t.Error(err)
 	}
@@ -204,3 +218,537 @@ func TestHandlePostSync(t *testing.T) {
 	}
 
 }
+
+// TestHandlePostSyncConverges tests that devices which are linked together are
+// subscribed to each other's podcasts
+func TestHandlePostSyncConverges(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	username := "username"
+
+	cleanup(t, db)
+
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, podcast := range []string{"https://podcast1.com", "https://podcast2.com"} {
+		deviceId, err := dataInterface.AddDevice(username, fmt.Sprintf("device%d", idx+1), "", "laptop")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dataInterface.AddSubscriptionHistory(data.Subscription{
+			User:      username,
+			Devices:   []int{deviceId},
+			Podcast:   podcast,
+			Action:    "SUBSCRIBE",
+			Timestamp: data.CustomTimestamp{Time: time.Unix(100, 0)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syncAPI := NewSyncAPI(dataInterface, "itsatest")
+	subscriptionAPI := SubscriptionAPI{Data: dataInterface}
+
+	m := chi.NewRouter()
+	m.Post("/api/2/sync-devices/{username}.json", syncAPI.HandlePostSync)
+	m.Get("/api/2/subscriptions/{username}/{deviceid}.{format}", subscriptionAPI.HandleGetDeviceSubscriptionChange)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	body, err := json.Marshal(&SyncDeviceRequest{Synchronize: [][]string{{"device1", "device2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(ts.URL+"/api/2/sync-devices/username.json", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting handler to be ok but instead got: %#v", status)
+	}
+
+	for _, device := range []string{"device1", "device2"} {
+		resp, err := http.Get(ts.URL + "/api/2/subscriptions/username/" + device + ".json?since=100")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changes := &SubscriptionChanges{}
+		err = json.NewDecoder(resp.Body).Decode(changes)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(changes.Add) != 1 {
+			t.Errorf("expecting %s to be subscribed to the podcast of the other device but got %#v", device, changes.Add)
+		}
+	}
+
+	for _, device := range []string{"device1", "device2"} {
+		subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(subs) != 2 {
+			t.Errorf("expecting %s to have the merged subscriptions but got %#v", device, subs)
+		}
+	}
+}
+
+// TestHandleUploadRegistersDevice tests that uploading subscriptions for a
+// device that was never created registers it when registration is enabled
+func TestHandleUploadRegistersDevice(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	username := "username"
+
+	cleanup(t, db)
+
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		subscriptionAPI := SubscriptionAPI{
+			Data:         dataInterface,
+			Registration: DeviceRegistration{Enabled: enabled, Type: "desktop", Caption: "auto"},
+		}
+
+		m := chi.NewRouter()
+		m.Put("/subscriptions/{username}/{deviceid}.{format}", subscriptionAPI.HandleUploadDeviceSubscription)
+		ts := httptest.NewServer(m)
+
+		req, err := http.NewRequest("PUT", ts.URL+"/subscriptions/username/gpodder.json", bytes.NewBufferString(`["https://rubbishurl.com"]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enabled && resp.StatusCode != http.StatusOK {
+			t.Errorf("expecting upload to be ok with registration enabled but got: %#v", resp.StatusCode)
+		}
+		if !enabled && resp.StatusCode == http.StatusOK {
+			t.Error("expecting upload to fail with registration disabled")
+		}
+	}
+
+	device, err := dataInterface.RetrieveDevice(username, "gpodder")
+	if err != nil {
+		t.Fatalf("expecting device to be registered: %#v", err)
+	}
+
+	if device.Type != "desktop" || device.Caption != "auto" {
+		t.Errorf("expecting device to be registered with the configured type and caption but got %#v", device)
+	}
+
+	events, err := dataInterface.RetrieveAuditEvents(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Action != data.AuditDeviceRegistered || events[0].Device != "gpodder" {
+		t.Errorf("expecting registration to be in the audit trail but got %#v", events)
+	}
+}
+
+// TestHandleUpdateSubscriptionUpdateUrls tests that uploaded urls are sanitized
+// and the rewrites are reported back in update_urls
+func TestHandleUpdateSubscriptionUpdateUrls(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	username := "username"
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dataInterface.AddDevice(username, "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionAPI := SubscriptionAPI{Data: dataInterface}
+	m := chi.NewRouter()
+	m.Post("/api/2/subscriptions/{username}/{deviceid}.{format}", subscriptionAPI.HandleUploadDeviceSubscriptionChange)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	body := `{"add": [" HTTPS://Example.com/feed.xml?utm_source=share", "https://example.com/other.xml", "ftp://example.com/feed.xml"], "remove": []}`
+	resp, err := http.Post(ts.URL+"/api/2/subscriptions/username/device1.json", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting handler to be ok but instead got: %#v", status)
+	}
+
+	output := struct {
+		UpdateUrls [][]string `json:"update_urls"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{" HTTPS://Example.com/feed.xml?utm_source=share", "https://example.com/feed.xml"},
+		{"ftp://example.com/feed.xml", ""},
+	}
+	if !reflect.DeepEqual(output.UpdateUrls, expected) {
+		t.Errorf("expecting update_urls to be %#v but got %#v", expected, output.UpdateUrls)
+	}
+
+	subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, "device1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 2 {
+		t.Errorf("expecting only the sanitized urls to be subscribed to but got %#v", subs)
+	}
+
+	body = `{"add": ["https://example.com/feed.xml"], "remove": ["https://EXAMPLE.com/feed.xml"]}`
+	resp, err = http.Post(ts.URL+"/api/2/subscriptions/username/device1.json", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := resp.StatusCode; status != http.StatusBadRequest {
+		t.Errorf("expecting a podcast that is both added and removed to be rejected but got: %#v", status)
+	}
+
+	// a podcast that is added again is not counted twice, so that a single
+	// remove unsubscribes from it
+	for _, body := range []string{
+		`{"add": ["https://EXAMPLE.com/feed.xml"], "remove": []}`,
+		`{"add": [], "remove": ["https://example.com/feed.xml"]}`,
+	} {
+		resp, err = http.Post(ts.URL+"/api/2/subscriptions/username/device1.json", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := resp.StatusCode; status != http.StatusOK {
+			t.Fatalf("expecting handler to be ok but instead got: %#v", status)
+		}
+	}
+
+	subs, err = dataInterface.RetrieveDeviceSubscriptionsSlice(username, "device1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(subs, []string{"https://example.com/other.xml"}) {
+		t.Errorf("expecting the podcast that was added twice to be removed but got %#v", subs)
+	}
+}
+
+// TestHandleUploadEpisodeActionValidates tests that an upload with invalid
+// episode actions is rejected as a whole with an error for each invalid item
+func TestHandleUploadEpisodeActionValidates(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	username := "username"
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodeAPI := EpisodeAPI{Data: dataInterface}
+
+	m := chi.NewRouter()
+	m.Post("/episodes/{username}.{format}", episodeAPI.HandleUploadEpisodeAction)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	upload := func(body string) (int, string) {
+		resp, err := http.Post(ts.URL+"/episodes/username.json", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	countActions := func() int {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM episode_actions").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	status, body := upload(`[
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "download"},
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "play"},
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "download", "position": 10},
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "stream"}
+	]`)
+
+	if status != http.StatusBadRequest {
+		t.Fatalf("expecting invalid upload to be rejected but got: %#v", status)
+	}
+
+	output := EpisodeActionErrors{}
+	err = json.Unmarshal([]byte(body), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes := []int{}
+	for _, e := range output.Errors {
+		indexes = append(indexes, e.Index)
+	}
+	if !reflect.DeepEqual(indexes, []int{1, 2, 3}) {
+		t.Errorf("expecting errors for items 1, 2 and 3 but got %#v", output.Errors)
+	}
+
+	if count := countActions(); count != 0 {
+		t.Errorf("expecting no episode action to be stored but got %d", count)
+	}
+
+	// upper case actions and zeroed fields on non play actions are quirks of
+	// known clients
+	status, body = upload(`[
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "DOWNLOAD", "position": -1, "started": -1, "total": -1},
+		{"podcast": "http://example.com/feed.rss", "episode": "http://example.com/1.mp3", "action": "play", "started": 0, "position": 120, "total": 3600, "timestamp": "2009-12-12T09:00:00"}
+	]`)
+
+	if status != http.StatusOK {
+		t.Fatalf("expecting upload to be ok but got: %#v %s", status, body)
+	}
+
+	if count := countActions(); count != 2 {
+		t.Errorf("expecting 2 episode actions to be stored but got %d", count)
+	}
+
+	var position sql.NullInt64
+	err = db.QueryRow("SELECT position FROM episode_actions WHERE action = 'download'").Scan(&position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position.Valid {
+		t.Errorf("expecting position of the download action to be dropped but got %#v", position)
+	}
+}
+
+// TestSessions tests that the sessions kept in the store are accepted until
+// they expire or the user logs out
+func TestSessions(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	err := dataInterface.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := store.NewCacheStore()
+	userAPI := NewUserAPI(dataInterface, "secret")
+	userAPI.Sessions = sessions
+	userAPI.SessionTTL = time.Hour
+	deviceAPI := DeviceAPI{Store: sessions, Data: dataInterface}
+
+	m := chi.NewRouter()
+	m.Post("/api/2/auth/{username}/login.json", userAPI.HandleLogin)
+	m.Post("/api/2/auth/{username}/logout.json", userAPI.HandleLogout)
+	m.Group(func(r chi.Router) {
+		r.Use(m2.VerifySessions("secret", false, sessions, dataInterface.RetrieveSessionSecret))
+		r.Get("/api/2/devices/{username}.json", deviceAPI.HandleGetDevices)
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	do := func(method string, path string, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("username", "pass")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("POST", "/api/2/auth/username/login.json", nil)
+	if resp.StatusCode != 200 || len(resp.Cookies()) != 1 {
+		t.Fatalf("expecting a session cookie on login but got %d, %#v", resp.StatusCode, resp.Cookies())
+	}
+	cookie := resp.Cookies()[0]
+
+	if status := do("GET", "/api/2/devices/username.json", cookie).StatusCode; status != 200 {
+		t.Errorf("expecting the session to be accepted but got %d", status)
+	}
+
+	err = sessions.Delete(m2.SessionKey(cookie.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := do("GET", "/api/2/devices/username.json", cookie).StatusCode; status != 401 {
+		t.Errorf("expecting an expired session to be rejected but got %d", status)
+	}
+
+	resp = do("POST", "/api/2/auth/username/login.json", nil)
+	cookie = resp.Cookies()[0]
+	if status := do("POST", "/api/2/auth/username/logout.json", cookie).StatusCode; status != 200 {
+		t.Errorf("expecting logout to be ok but got %d", status)
+	}
+	if status := do("GET", "/api/2/devices/username.json", cookie).StatusCode; status != 401 {
+		t.Errorf("expecting a logged out session to be rejected but got %d", status)
+	}
+
+	// the sessions of an account end when it is disabled, its password
+	// changes, or it is renamed or deleted
+	for _, change := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"disabled", func() error { return dataInterface.SetUserDisabled("username", true) }},
+		{"password changed", func() error { return dataInterface.UpdateUserPassword("username", "pass") }},
+		{"renamed", func() error {
+			err := dataInterface.RenameUser("username", "other")
+			if err != nil {
+				return err
+			}
+			return dataInterface.AddUser("username", "pass", "renamed@test.com", "name")
+		}},
+		{"deleted", func() error {
+			err := dataInterface.DeleteUser("username")
+			if err != nil {
+				return err
+			}
+			return dataInterface.AddUser("username", "pass", "deleted@test.com", "name")
+		}},
+	} {
+		resp = do("POST", "/api/2/auth/username/login.json", nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s: expecting login to be ok but got %d", change.name, resp.StatusCode)
+		}
+		cookie = resp.Cookies()[0]
+
+		err := change.fn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := do("GET", "/api/2/devices/username.json", cookie).StatusCode; status != 401 {
+			t.Errorf("%s: expecting the session to be rejected but got %d", change.name, status)
+		}
+
+		err = dataInterface.SetUserDisabled("username", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := do("GET", "/api/2/devices/username.json", cookie).StatusCode; status != 401 {
+			t.Errorf("%s: expecting the session to stay rejected once the account is enabled but got %d", change.name, status)
+		}
+	}
+}
+
+// TestHandleEpisodeActionOfAnotherUser tests that the episode actions of a
+// user can only be read by the user
+func TestHandleEpisodeActionOfAnotherUser(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	for _, username := range []string{"alice", "bob"} {
+		err := dataInterface.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deviceId, err := dataInterface.AddDevice("bob", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dataInterface.AddEpisodeActionHistory("bob", data.EpisodeAction{Podcast: "https://example.com/feed.xml", Episode: "https://example.com/episode.mp3", Devices: []int{deviceId}, Action: "play", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := store.NewCacheStore()
+	userAPI := NewUserAPI(dataInterface, "secret")
+	userAPI.Sessions = sessions
+	userAPI.SessionTTL = time.Hour
+	episodeAPI := EpisodeAPI{Store: sessions, Data: dataInterface}
+
+	m := chi.NewRouter()
+	m.Post("/api/2/auth/{username}/login.json", userAPI.HandleLogin)
+	m.Group(func(r chi.Router) {
+		r.Use(m2.VerifySessions("secret", false, sessions, dataInterface.RetrieveSessionSecret))
+		r.Get("/api/2/episodes/{username}.{format}", episodeAPI.HandleEpisodeAction)
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	do := func(method string, path string, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("alice", "pass")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("POST", "/api/2/auth/alice/login.json", nil)
+	if resp.StatusCode != 200 || len(resp.Cookies()) != 1 {
+		t.Fatalf("expecting a session cookie on login but got %d, %#v", resp.StatusCode, resp.Cookies())
+	}
+	cookie := resp.Cookies()[0]
+
+	if status := do("GET", "/api/2/episodes/alice.json", cookie).StatusCode; status != 200 {
+		t.Errorf("expecting the episode actions of the user to be readable but got %d", status)
+	}
+	if status := do("GET", "/api/2/episodes/bob.json", cookie).StatusCode; status != 401 {
+		t.Errorf("expecting the episode actions of another user to be rejected but got %d", status)
+	}
+}
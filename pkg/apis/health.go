@@ -0,0 +1,97 @@
+package apis
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// Statuses of the health checks
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// HealthAPI serves the liveness and readiness of the server, unauthenticated
+// so that container healthchecks and load balancers can reach them
+type HealthAPI struct {
+	Data  data.DataInterface
+	Store store.Store
+
+	// SchemaVersion is the version of the last migration that the server
+	// embeds, which the database is expected to be at
+	SchemaVersion uint
+}
+
+func NewHealthAPI(data data.DataInterface, store store.Store, schemaVersion uint) *HealthAPI {
+	return &HealthAPI{
+		Data:          data,
+		Store:         store,
+		SchemaVersion: schemaVersion,
+	}
+}
+
+// API Endpoint: GET /healthz
+// The server is alive as long as it answers.
+func (h *HealthAPI) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, &Health{Status: HealthOK})
+}
+
+// API Endpoint: GET /readyz
+// The server is ready when the database is reachable and migrated to the
+// schema of the server, and the cache is reachable. A 503 is returned with
+// the checks that failed otherwise, whose errors are logged.
+func (h *HealthAPI) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	health := &Health{Status: HealthOK, Checks: map[string]HealthCheck{}}
+
+	check := func(name string, err error) {
+		if err != nil {
+			// the details stay in the logs as the endpoint is public
+			slog.WarnContext(r.Context(), "error checking readiness", "check", name, "error", err)
+			health.Status = HealthDegraded
+			health.Checks[name] = HealthCheck{Status: HealthDegraded}
+			return
+		}
+		health.Checks[name] = HealthCheck{Status: HealthOK}
+	}
+
+	check("database", h.Data.Ping())
+	check("schema", h.checkSchema())
+	check("cache", h.Store.Ping())
+
+	if health.Status == HealthOK {
+		writeJSON(w, r, health)
+		return
+	}
+
+	b, err := json.Marshal(health)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error marshalling output", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(503)
+	w.Write(b)
+}
+
+func (h *HealthAPI) checkSchema() error {
+	version, dirty, err := h.Data.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return fmt.Errorf("migration %d failed halfway, fix the database and run init", version)
+	}
+	if version != h.SchemaVersion {
+		return fmt.Errorf("expecting schema version %d but got %d, run init", h.SchemaVersion, version)
+	}
+
+	return nil
+}
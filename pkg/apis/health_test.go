@@ -0,0 +1,91 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// unreachableStore is a cache whose servers are down
+type unreachableStore struct {
+	store.Store
+}
+
+func (unreachableStore) Ping() error {
+	return errors.New("dial tcp 127.0.0.1:11211: connect: connection refused")
+}
+
+// TestHealth tests that the readiness reports the dependencies that are
+// degraded, without their errors, while the liveness does not depend on them
+func TestHealth(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	version, _, err := dataInterface.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		store    store.Store
+		version  uint
+		status   int
+		degraded []string
+	}{
+		{"ready", store.NewCacheStore(), version, 200, nil},
+		{"outdated schema", store.NewCacheStore(), version + 1, 503, []string{"schema"}},
+		{"cache down", unreachableStore{}, version, 503, []string{"cache"}},
+	} {
+		healthAPI := NewHealthAPI(dataInterface, tc.store, tc.version)
+
+		m := chi.NewRouter()
+		m.Get("/healthz", healthAPI.HandleHealthz)
+		m.Get("/readyz", healthAPI.HandleReadyz)
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != 200 || w.Body.String() != `{"status":"ok"}` {
+			t.Errorf("%s: expecting the server to be alive but got %d %s", tc.name, w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tc.status || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expecting readiness to be %d but got %d", tc.name, tc.status, w.Code)
+		}
+		// the endpoint is public, the errors of the checks are only logged
+		if strings.Contains(w.Body.String(), "127.0.0.1") || strings.Contains(w.Body.String(), "run init") {
+			t.Errorf("%s: expecting the errors of the checks not to be exposed but got %s", tc.name, w.Body.String())
+		}
+
+		health := Health{}
+		err := json.Unmarshal(w.Body.Bytes(), &health)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		degraded := map[string]bool{}
+		for _, name := range tc.degraded {
+			degraded[name] = true
+		}
+		for _, name := range []string{"database", "schema", "cache"} {
+			check, ok := health.Checks[name]
+			if !ok {
+				t.Errorf("%s: expecting %s to be checked but got %#v", tc.name, name, health)
+				continue
+			}
+			if degraded[name] != (check.Status == HealthDegraded) {
+				t.Errorf("%s: expecting %s to be degraded %t but got %#v", tc.name, name, degraded[name], check)
+			}
+		}
+		if (len(tc.degraded) > 0) != (health.Status == HealthDegraded) {
+			t.Errorf("%s: expecting the status to reflect the checks but got %s", tc.name, health.Status)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package apis
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+)
+
+// NextcloudDeviceName is the device that all the changes made through the
+// Nextcloud gpoddersync routes are recorded against, as the gpoddersync API
+// has no notion of devices
+const NextcloudDeviceName = "gpoddersync"
+
+// NextcloudAPI maps the routes of the Nextcloud gpoddersync app onto the
+// existing SubscriptionAPI and EpisodeAPI handlers so that clients configured
+// for Nextcloud sync can point at gpodder2go unchanged.
+// https://github.com/thrillfall/nextcloud-gpodder
+type NextcloudAPI struct {
+	Data            data.DataInterface
+	SubscriptionAPI *SubscriptionAPI
+	EpisodeAPI      *EpisodeAPI
+}
+
+func NewNextcloudAPI(data data.DataInterface, subscriptionAPI *SubscriptionAPI, episodeAPI *EpisodeAPI) *NextcloudAPI {
+	return &NextcloudAPI{
+		Data:            data,
+		SubscriptionAPI: subscriptionAPI,
+		EpisodeAPI:      episodeAPI,
+	}
+}
+
+// Router returns the compatibility routes, to be mounted at
+// /index.php/apps/gpoddersync. gpoddersync clients send their credentials with
+// Basic Auth on every request instead of logging in.
+func (n *NextcloudAPI) Router(noAuth bool) chi.Router {
+	r := chi.NewRouter()
+	r.Use(m2.BasicAuth(n.Data.CheckUserPassword, noAuth))
+
+	r.Get("/subscriptions", n.HandleGetSubscriptions)
+	r.Post("/subscription_change/create", n.HandleCreateSubscriptionChange)
+	r.Get("/episode_action", n.HandleGetEpisodeActions)
+	r.Post("/episode_action/create", n.HandleCreateEpisodeActions)
+
+	return r
+}
+
+// API Endpoint: GET /index.php/apps/gpoddersync/subscriptions
+func (n *NextcloudAPI) HandleGetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	r, err := n.prepareRequest(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error preparing gpoddersync request", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// gpoddersync treats a missing since as the beginning of time
+	if r.URL.Query().Get("since") == "" {
+		q := r.URL.Query()
+		q.Set("since", "0")
+		r.URL.RawQuery = q.Encode()
+	}
+
+	n.SubscriptionAPI.HandleGetDeviceSubscriptionChange(w, r)
+}
+
+// API Endpoint: POST /index.php/apps/gpoddersync/subscription_change/create
+func (n *NextcloudAPI) HandleCreateSubscriptionChange(w http.ResponseWriter, r *http.Request) {
+	r, err := n.prepareRequest(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error preparing gpoddersync request", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	n.SubscriptionAPI.HandleUploadDeviceSubscriptionChange(w, r)
+}
+
+// API Endpoint: GET /index.php/apps/gpoddersync/episode_action
+func (n *NextcloudAPI) HandleGetEpisodeActions(w http.ResponseWriter, r *http.Request) {
+	r, err := n.prepareRequest(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error preparing gpoddersync request", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	n.EpisodeAPI.HandleEpisodeAction(w, r)
+}
+
+// API Endpoint: POST /index.php/apps/gpoddersync/episode_action/create
+func (n *NextcloudAPI) HandleCreateEpisodeActions(w http.ResponseWriter, r *http.Request) {
+	r, err := n.prepareRequest(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error preparing gpoddersync request", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error reading request body", "error", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	// gpoddersync episode actions do not carry a device, record them against
+	// the gpoddersync device
+	var actions []map[string]interface{}
+	err = json.Unmarshal(b, &actions)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error unmarshalling", "error", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	for _, action := range actions {
+		if device, ok := action["device"].(string); !ok || device == "" {
+			action["device"] = NextcloudDeviceName
+		}
+	}
+
+	b, err = json.Marshal(actions)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error marshalling episode actions", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+
+	n.EpisodeAPI.HandleUploadEpisodeAction(w, r)
+}
+
+// prepareRequest makes sure that the gpoddersync device exists for the
+// authenticated user and sets up the URL params that the gpodder handlers
+// expect
+func (n *NextcloudAPI) prepareRequest(r *http.Request) (*http.Request, error) {
+	username := m2.Username(r.Context())
+
+	_, err := n.Data.GetDeviceIdFromName(NextcloudDeviceName, username)
+	if err == sql.ErrNoRows {
+		_, err = n.Data.RegisterDevice(username, NextcloudDeviceName, "Nextcloud gpoddersync", "other", "first gpoddersync request")
+	}
+	if err != nil {
+		return r, errors.Wrap(err, "error getting gpoddersync device")
+	}
+
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		rctx = chi.NewRouteContext()
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	}
+	rctx.URLParams.Add("username", username)
+	rctx.URLParams.Add("deviceid", NextcloudDeviceName)
+	rctx.URLParams.Add("format", "json")
+
+	return r, nil
+}
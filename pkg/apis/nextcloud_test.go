@@ -0,0 +1,197 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// TestNextcloudSubscriptions tests that subscriptions uploaded through the
+// gpoddersync routes are returned by them and recorded on the gpoddersync device
+func TestNextcloudSubscriptions(t *testing.T) {
+
+	subUrl := "https://rubbishurl.com"
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	username := "username"
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionAPI := SubscriptionAPI{Data: dataInterface}
+	episodeAPI := EpisodeAPI{Data: dataInterface}
+	nextcloudAPI := NewNextcloudAPI(dataInterface, &subscriptionAPI, &episodeAPI)
+
+	m := chi.NewRouter()
+	m.Mount("/index.php/apps/gpoddersync", nextcloudAPI.Router(false))
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	body, err := json.Marshal(map[string][]string{"add": {subUrl}, "remove": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", ts.URL+"/index.php/apps/gpoddersync/subscription_change/create", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("expecting unauthenticated request to be rejected but instead got: %#v", status)
+	}
+
+	req, err = http.NewRequest("POST", ts.URL+"/index.php/apps/gpoddersync/subscription_change/create", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, "pass")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting upload to be ok but instead got: %#v", status)
+	}
+
+	req, err = http.NewRequest("GET", ts.URL+"/index.php/apps/gpoddersync/subscriptions?since=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, "pass")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting retrieval to be ok but instead got: %#v", status)
+	}
+
+	changes := &SubscriptionChanges{}
+	err = json.NewDecoder(resp.Body).Decode(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes.Add) != 1 || changes.Add[0] != subUrl {
+		t.Fatalf("expecting %s to be added but got %#v", subUrl, changes.Add)
+	}
+
+	subs, err := dataInterface.RetrieveDeviceSubscriptionsSlice(username, NextcloudDeviceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 1 {
+		t.Fatalf("expecting subscription to be on the %s device but got %#v", NextcloudDeviceName, subs)
+	}
+}
+
+// TestNextcloudEpisodeActions tests that episode actions uploaded through the
+// gpoddersync routes, which carry no device, are recorded on the gpoddersync
+// device and read back by them
+func TestNextcloudEpisodeActions(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	username := "username"
+	err := dataInterface.AddUser(username, "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptionAPI := SubscriptionAPI{Data: dataInterface}
+	episodeAPI := EpisodeAPI{Data: dataInterface}
+	nextcloudAPI := NewNextcloudAPI(dataInterface, &subscriptionAPI, &episodeAPI)
+
+	m := chi.NewRouter()
+	m.Mount("/index.php/apps/gpoddersync", nextcloudAPI.Router(false))
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	// as sent by gpoddersync clients, with upper case actions and -1 for the
+	// positions of actions other than play
+	body := `[
+		{"podcast": "https://example.com/feed.xml", "episode": "https://example.com/1.mp3", "guid": "1", "action": "DOWNLOAD", "timestamp": "2023-01-01T10:00:00", "started": -1, "position": -1, "total": -1},
+		{"podcast": "https://example.com/feed.xml", "episode": "https://example.com/1.mp3", "guid": "1", "action": "PLAY", "timestamp": "2023-01-01T11:00:00", "started": 0, "position": 120, "total": 3600}
+	]`
+
+	req, err := http.NewRequest("POST", ts.URL+"/index.php/apps/gpoddersync/episode_action/create", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, "pass")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting upload to be ok but instead got: %#v", status)
+	}
+
+	req, err = http.NewRequest("GET", ts.URL+"/index.php/apps/gpoddersync/episode_action?since=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, "pass")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Fatalf("expecting retrieval to be ok but instead got: %#v", status)
+	}
+
+	output := &EpisodeActionOutput{}
+	err = json.NewDecoder(resp.Body).Decode(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(output.Actions) != 2 {
+		t.Fatalf("expecting the 2 uploaded actions but got %#v", output.Actions)
+	}
+
+	for _, action := range output.Actions {
+		if action.Device != NextcloudDeviceName || action.Podcast != "https://example.com/feed.xml" || action.Episode != "https://example.com/1.mp3" {
+			t.Errorf("expecting the action to be on the %s device but got %#v", NextcloudDeviceName, action)
+		}
+
+		switch action.Action {
+		case data.EpisodeActionPlay:
+			if action.Position == nil || *action.Position != 120 || action.Total == nil || *action.Total != 3600 {
+				t.Errorf("expecting the position of the play action to be kept but got %#v", action)
+			}
+		case data.EpisodeActionDownload:
+			if action.Position != nil {
+				t.Errorf("expecting no position for the download action but got %#v", action)
+			}
+		default:
+			t.Errorf("expecting a play or a download action but got %#v", action)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package apis
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"k8s.io/utils/strings/slices"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// SettingsAPI stores the settings that clients keep on the server, which is
+// also where users set the privacy of their subscriptions.
+// https://gpoddernet.readthedocs.io/en/latest/api/reference/settings.html
+type SettingsAPI struct {
+	Data data.DataInterface
+
+	// Store is the cache of the directory, which is invalidated when the
+	// privacy of subscriptions changes. Nothing is invalidated when it is
+	// nil.
+	Store store.Store
+}
+
+func NewSettingsAPI(data data.DataInterface) *SettingsAPI {
+	return &SettingsAPI{
+		Data: data,
+	}
+}
+
+// API Endpoint: GET /api/2/settings/{username}/{scope}.json
+func (s *SettingsAPI) HandleGetSettings(w http.ResponseWriter, r *http.Request) {
+	username, scope, target, ok := settingsTarget(w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := s.Data.RetrieveSettings(username, scope, target)
+	if errors.Cause(err) == sql.ErrNoRows {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error retrieving settings", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	writeJSON(w, r, settings)
+}
+
+// API Endpoint: POST /api/2/settings/{username}/{scope}.json
+func (s *SettingsAPI) HandleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	username, scope, target, ok := settingsTarget(w, r)
+	if !ok {
+		return
+	}
+
+	changes := SettingsChanges{}
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		slog.WarnContext(r.Context(), "error decoding json payload", "error", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	if v, ok := changes.Set[data.SettingPrivacy]; ok && (scope == data.SettingsScopeAccount || scope == data.SettingsScopePodcast) {
+		switch v {
+		case data.PrivacyPrivate, data.PrivacyInstance, data.PrivacyPublic:
+		default:
+			slog.WarnContext(r.Context(), "error updating settings as privacy is expecting private, instance or public", "privacy", v)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	settings, err := s.Data.UpdateSettings(username, scope, target, changes.Set, changes.Remove)
+	if errors.Cause(err) == sql.ErrNoRows {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error updating settings", "error", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// the directory only lists the podcasts that are public
+	_, privacySet := changes.Set[data.SettingPrivacy]
+	privacyChanged := privacySet || slices.Contains(changes.Remove, data.SettingPrivacy)
+	if privacyChanged && s.Store != nil && (scope == data.SettingsScopeAccount || scope == data.SettingsScopePodcast) {
+		err = InvalidateDirectory(s.Store)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error invalidating directory", "error", err)
+		}
+	}
+
+	writeJSON(w, r, settings)
+}
+
+// settingsTarget returns the username, scope and target of a settings
+// request, writing an error when the scope is unknown, a query param that the
+// scope needs is missing or the settings are of another user
+func settingsTarget(w http.ResponseWriter, r *http.Request) (string, string, string, bool) {
+	username := chi.URLParam(r, "username")
+	if authenticated := m2.Username(r.Context()); authenticated != "" && authenticated != username {
+		slog.WarnContext(r.Context(), "error accessing settings of another user", "username", username)
+		w.WriteHeader(401)
+		return "", "", "", false
+	}
+
+	query := r.URL.Query()
+	scope := chi.URLParam(r, "scope")
+
+	var required []string
+	switch scope {
+	case data.SettingsScopeAccount:
+	case data.SettingsScopeDevice:
+		required = []string{"device"}
+	case data.SettingsScopePodcast:
+		required = []string{"podcast"}
+	case data.SettingsScopeEpisode:
+		required = []string{"podcast", "episode"}
+	default:
+		slog.WarnContext(r.Context(), "error with scope expecting account, device, podcast or episode", "scope", scope)
+		w.WriteHeader(400)
+		return "", "", "", false
+	}
+
+	for _, param := range required {
+		if query.Get(param) == "" {
+			slog.WarnContext(r.Context(), "error with query params - expecting it not to be empty for the scope", "param", param, "scope", scope)
+			w.WriteHeader(400)
+			return "", "", "", false
+		}
+	}
+
+	podcast := query.Get("podcast")
+	if podcast != "" {
+		// podcasts are referred to the way that they are stored
+		sanitized, _ := sanitizeURLs(r.Context(), []string{podcast})
+		if len(sanitized) == 0 {
+			slog.WarnContext(r.Context(), "error with podcast query params - expecting a valid url", "podcast", podcast)
+			w.WriteHeader(400)
+			return "", "", "", false
+		}
+		podcast = sanitized[0]
+	}
+
+	return username, scope, data.SettingsTarget(scope, query.Get("device"), podcast, query.Get("episode")), true
+}
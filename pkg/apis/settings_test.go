@@ -0,0 +1,135 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oxtyped/gpodder2go/pkg/data"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+func TestSettings(t *testing.T) {
+
+	dataInterface := data.NewSQLite("testme.db")
+	db := dataInterface.GetDB()
+	cleanup(t, db)
+
+	for _, username := range []string{"alice", "bob"} {
+		err := dataInterface.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deviceId, err := dataInterface.AddDevice("alice", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dataInterface.AddSubscriptionHistory(data.Subscription{User: "alice", Devices: []int{deviceId}, Podcast: "https://example.com/feed.rss", Action: "SUBSCRIBE", Timestamp: data.CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory is cached in the store that the settings invalidate
+	cache := store.NewCacheStore()
+	settingsAPI := NewSettingsAPI(dataInterface)
+	settingsAPI.Store = cache
+	directoryAPI := NewDirectoryAPI(dataInterface)
+	directoryAPI.Store = cache
+
+	m := chi.NewRouter()
+	m.Use(m2.Verifier("secret", true))
+	m.Get("/api/2/settings/{username}/{scope}.json", settingsAPI.HandleGetSettings)
+	m.Post("/api/2/settings/{username}/{scope}.json", settingsAPI.HandleUpdateSettings)
+	m.Get("/toplist/{count}.{format}", directoryAPI.HandleToplist)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	do := func(method string, path string, as string, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(as, "")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := do("GET", "/toplist/10.txt", "bob", "")
+	if status != http.StatusOK || body != "https://example.com/feed.rss\n" {
+		t.Errorf("expecting the public subscription in the toplist but got %d: %q", status, body)
+	}
+
+	status, body = do("POST", "/api/2/settings/alice/podcast.json?podcast=https://example.com/feed.rss", "alice", `{"set": {"privacy": "private", "flattr": true}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expecting settings to be updated but got %d", status)
+	}
+
+	settings := map[string]interface{}{}
+	err = json.Unmarshal([]byte(body), &settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(settings, map[string]interface{}{"privacy": "private", "flattr": true}) {
+		t.Errorf("expecting the updated settings but got %#v", settings)
+	}
+
+	// the private subscription is not in the toplist anymore, even though
+	// the toplist was cached
+	status, body = do("GET", "/toplist/10.txt", "bob", "")
+	if status != http.StatusOK || body != "" {
+		t.Errorf("expecting an empty toplist but got %d: %q", status, body)
+	}
+
+	status, body = do("POST", "/api/2/settings/alice/podcast.json?podcast=https://example.com/feed.rss", "alice", `{"remove": ["privacy"]}`)
+	if status != http.StatusOK || body != `{"flattr":true}` {
+		t.Errorf("expecting privacy to be removed but got %d: %s", status, body)
+	}
+
+	status, body = do("GET", "/toplist/10.txt", "bob", "")
+	if status != http.StatusOK || body != "https://example.com/feed.rss\n" {
+		t.Errorf("expecting the public subscription in the toplist but got %d: %q", status, body)
+	}
+
+	status, body = do("GET", "/api/2/settings/alice/account.json", "alice", "")
+	if status != http.StatusOK || body != "{}" {
+		t.Errorf("expecting no account settings but got %d: %s", status, body)
+	}
+
+	for _, tt := range []struct {
+		method, path, as, body string
+		status                 int
+	}{
+		{"POST", "/api/2/settings/alice/account.json", "alice", `{"set": {"privacy": "secret"}}`, http.StatusBadRequest},
+		{"POST", "/api/2/settings/alice/account.json", "alice", `{"set": {`, http.StatusBadRequest},
+		{"GET", "/api/2/settings/alice/podcast.json", "alice", "", http.StatusBadRequest},
+		{"GET", "/api/2/settings/alice/episode.json?podcast=https://example.com/feed.rss", "alice", "", http.StatusBadRequest},
+		{"GET", "/api/2/settings/alice/server.json", "alice", "", http.StatusBadRequest},
+		{"GET", "/api/2/settings/alice/account.json", "bob", "", http.StatusUnauthorized},
+		{"POST", "/api/2/settings/alice/account.json", "bob", `{"set": {"privacy": "public"}}`, http.StatusUnauthorized},
+		{"GET", "/api/2/settings/nobody/account.json", "nobody", "", http.StatusNotFound},
+	} {
+		status, _ := do(tt.method, tt.path, tt.as, tt.body)
+		if status != tt.status {
+			t.Errorf("expecting %s %s as %s to respond with %d but got %d", tt.method, tt.path, tt.as, tt.status, status)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package apis
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/oxtyped/gpodder2go/pkg/data"
 	"github.com/oxtyped/gpodder2go/pkg/store"
@@ -15,18 +16,83 @@ type DeviceAPI struct {
 }
 
 type SubscriptionAPI struct {
-	Store store.Store
-	Data  data.DataInterface
+	Store        store.Store
+	Data         data.DataInterface
+	Registration DeviceRegistration
+
+	// Publisher announces the podcasts that users subscribe to, it is nil
+	// when federation is disabled
+	Publisher Publisher
+
+	// Observer is told about the uploads, it is nil when metrics are
+	// disabled
+	Observer Observer
+}
+
+// Publisher announces new subscriptions of a user to the servers following it.
+// It delivers them in the background so that slow remote servers do not hold
+// up the client.
+type Publisher interface {
+	PublishSubscriptions(username string, podcasts []string) error
+}
+
+// Kinds of uploads that are told to an Observer
+const (
+	UploadSubscriptions  = "subscriptions"
+	UploadEpisodeActions = "episode_actions"
+)
+
+// Observer is told what users do, for the metrics of the server
+type Observer interface {
+	Uploaded(username string, kind string)
+	LoggedIn(username string, expires time.Time)
+	LoggedOut(username string)
 }
 
 type EpisodeAPI struct {
-	Store store.Store
-	Data  data.DataInterface
+	Store        store.Store
+	Data         data.DataInterface
+	Registration DeviceRegistration
+
+	// PositionPolicy is the position policy of the users that have not set
+	// their own, see data.PositionPolicyNewest
+	PositionPolicy string
+
+	// Observer is told about the uploads, it is nil when metrics are
+	// disabled
+	Observer Observer
+}
+
+// SettingsChanges is the payload of a settings update
+type SettingsChanges struct {
+	Set    map[string]interface{} `json:"set"`
+	Remove []string               `json:"remove"`
+}
+
+// DeviceRegistration configures the registering of devices that clients upload
+// subscriptions or episode actions for without creating them first, as the
+// Simple API clients do
+type DeviceRegistration struct {
+	Enabled bool
+	Type    string
+	Caption string
 }
 
 type UserAPI struct {
 	Data              data.DataInterface
 	verifierSecretKey string
+
+	// SessionTTL is the lifetime of the session cookies
+	SessionTTL time.Duration
+
+	// Sessions keeps the sessions until they expire or the users log out,
+	// see middleware.VerifySessions. Sessions are only checked by their
+	// signature when it is nil.
+	Sessions store.Store
+
+	// Observer is told about the logins and logouts, it is nil when metrics
+	// are disabled
+	Observer Observer
 }
 
 type SyncAPI struct {
@@ -38,6 +104,7 @@ func NewUserAPI(data data.DataInterface, verifierSecretKey string) *UserAPI {
 	return &UserAPI{
 		Data:              data,
 		verifierSecretKey: verifierSecretKey,
+		SessionTTL:        2 * time.Minute,
 	}
 }
 
@@ -78,7 +145,32 @@ type EpisodeActionOutput struct {
 	Timestamp *timestamp.Timestamp `json:"timestamp"`
 }
 
+// EpisodeActionErrors lists every rejected item of an episode actions upload,
+// none of the items are stored when there is one
+type EpisodeActionErrors struct {
+	Errors []EpisodeActionError `json:"errors"`
+}
+
+type EpisodeActionError struct {
+	Index   int    `json:"index"` // Position of the item in the uploaded array
+	Message string `json:"message"`
+}
+
+// Health is the liveness or readiness of the server, with the status of each
+// dependency for readiness
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+}
+
 type SyncDeviceStatus struct {
 	Synchronized   [][]string `json:"synchronized"`
 	NotSynchronize []string   `json:"not-synchronize"`
+
+	// SyncStatus is a gpodder2go extension that clients ignore
+	SyncStatus []data.SyncGroupStatus `json:"sync-status,omitempty"`
 }
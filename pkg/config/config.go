@@ -0,0 +1,215 @@
+// Package config layers the options of the commands: the flags that are set
+// on the command line, then the G2G_* environment variables, then a YAML or
+// TOML config file. Every flag is an option, named after the flag.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables of the options
+const EnvPrefix = "G2G_"
+
+// Sources of the values of options
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// secretAnnotation marks the flags whose values are redacted when printed
+const secretAnnotation = "g2g_secret"
+
+// Redacted replaces the values of secret options when they are printed
+const Redacted = "<redacted>"
+
+// Option is the effective value of an option and where it comes from
+type Option struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// EnvName returns the environment variable of an option, G2G_FEDERATION_HOST
+// for federation-host
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// MarkSecret marks a flag as holding a secret, so that its value is redacted
+// by Options
+func MarkSecret(fs *pflag.FlagSet, name string) {
+	fs.SetAnnotation(name, secretAnnotation, []string{"true"})
+}
+
+// Load reads a config file into the values of options by name. The format is
+// YAML unless the file ends with .toml. Sections are flattened into the names
+// of their keys, so that
+//
+//	[federation]
+//	host = "https://g2g.example.com"
+//
+// sets federation-host. Lists are joined with commas as they are given to
+// flags, and underscores in names are taken as dashes.
+func Load(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading config file")
+	}
+
+	doc := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing config file %s", path)
+	}
+
+	values := map[string]string{}
+	err = flatten(values, "", doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func flatten(values map[string]string, prefix string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			name := strings.ToLower(strings.ReplaceAll(k, "_", "-"))
+			if prefix != "" {
+				name = prefix + "-" + name
+			}
+			err := flatten(values, name, child)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return errors.Errorf("expecting %s to be a list of values", prefix)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+
+	return nil
+}
+
+// Apply sets the flags that were not set on the command line from their
+// environment variables, then from the values of the config file, and returns
+// where the value of every flag comes from. Values of the config file that are
+// not flags of fs are left for the other commands.
+func Apply(fs *pflag.FlagSet, values map[string]string, lookupEnv func(string) (string, bool)) (map[string]string, error) {
+	sources := map[string]string{}
+
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+
+		if f.Changed {
+			sources[f.Name] = SourceFlag
+			return
+		}
+
+		value, source := "", ""
+		if v, ok := lookupEnv(EnvName(f.Name)); ok {
+			value, source = v, SourceEnv
+		} else if v, ok := values[f.Name]; ok {
+			value, source = v, SourceFile
+		} else {
+			sources[f.Name] = SourceDefault
+			return
+		}
+
+		// the flag is not marked as changed, so that it still reads as
+		// coming from the configuration rather than the command line
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = errors.Wrapf(setErr, "invalid %s %q from %s", f.Name, value, source)
+			return
+		}
+		sources[f.Name] = source
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// Options returns the effective values of the flags sorted by name, with the
+// values of the secret ones redacted
+func Options(fs *pflag.FlagSet, sources map[string]string) []Option {
+	options := []Option{}
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" {
+			return
+		}
+
+		value := f.Value.String()
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			value = strings.Join(v.GetSlice(), ",")
+		}
+		if _, ok := f.Annotations[secretAnnotation]; ok && value != "" {
+			value = Redacted
+		} else {
+			value = RedactURL(value)
+		}
+
+		source := sources[f.Name]
+		if source == "" {
+			source = SourceDefault
+		}
+
+		options = append(options, Option{Name: f.Name, Value: value, Source: source})
+	})
+
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Name < options[j].Name
+	})
+
+	return options
+}
+
+// RedactURL redacts the password of the values that are urls, such as the
+// redis:// ones of the cache
+func RedactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+
+	u.User = url.UserPassword(u.User.Username(), Redacted)
+	redacted, _ := url.PathUnescape(u.String())
+	return redacted
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	expected := map[string]string{
+		"addr":                       "0.0.0.0:3005",
+		"no-auth":                    "true",
+		"federation-host":            "https://g2g.example.com",
+		"federation-peers":           "a.example,b.example",
+		"federation-min-subscribers": "5",
+	}
+
+	files := map[string]string{
+		"g2g.yaml": `
+addr: 0.0.0.0:3005
+no_auth: true
+federation:
+  host: https://g2g.example.com
+  peers: [a.example, b.example]
+  min-subscribers: 5
+`,
+		"g2g.toml": `
+addr = "0.0.0.0:3005"
+no_auth = true
+
+[federation]
+host = "https://g2g.example.com"
+peers = ["a.example", "b.example"]
+min_subscribers = 5
+`,
+	}
+
+	for name, content := range files {
+		values, err := Load(writeFile(t, name, content))
+		if err != nil {
+			t.Fatalf("expecting %s to be loaded but got %#v", name, err)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("expecting %s to be loaded into %#v but got %#v", name, expected, values)
+		}
+	}
+
+	_, err := Load(writeFile(t, "g2g.yaml", "addr: [0.0.0.0, {port: 3005}]"))
+	if err == nil {
+		t.Error("expecting lists of sections to be rejected")
+	}
+
+	_, err = Load(writeFile(t, "g2g.toml", "addr = "))
+	if err == nil {
+		t.Error("expecting invalid TOML to be rejected")
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	addr := fs.String("addr", "localhost:3005", "")
+	database := fs.String("database", "g2g.db", "")
+	interval := fs.Duration("feed-refresh-interval", 6*time.Hour, "")
+	peers := fs.StringSlice("federation-peers", nil, "")
+	secret := fs.String("verifier-secret-key", "", "")
+	fs.String("position-policy", "newest", "")
+	fs.String("cache", "memory", "")
+	MarkSecret(fs, "verifier-secret-key")
+
+	err := fs.Parse([]string{"--addr", "127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"G2G_DATABASE":            "/data/env.db",
+		"G2G_VERIFIER_SECRET_KEY": "hunter2",
+		"G2G_ADDR":                "0.0.0.0:1",
+		"G2G_CACHE":               "redis://:hunter2@redis:6379/0",
+	}
+	values := map[string]string{
+		"addr":                  "0.0.0.0:2",
+		"database":              "/data/file.db",
+		"feed-refresh-interval": "1h",
+		"federation-peers":      "a.example,b.example",
+		"unknown":               "ignored",
+	}
+
+	sources, err := Apply(fs, values, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *addr != "127.0.0.1:8080" || *database != "/data/env.db" || *interval != time.Hour || !reflect.DeepEqual(*peers, []string{"a.example", "b.example"}) || *secret != "hunter2" {
+		t.Errorf("expecting flags over env over file but got %s, %s, %s, %#v, %s", *addr, *database, *interval, *peers, *secret)
+	}
+
+	options := Options(fs, sources)
+	expected := []Option{
+		{Name: "addr", Value: "127.0.0.1:8080", Source: SourceFlag},
+		{Name: "cache", Value: "redis://:" + Redacted + "@redis:6379/0", Source: SourceEnv},
+		{Name: "database", Value: "/data/env.db", Source: SourceEnv},
+		{Name: "federation-peers", Value: "a.example,b.example", Source: SourceFile},
+		{Name: "feed-refresh-interval", Value: "1h0m0s", Source: SourceFile},
+		{Name: "position-policy", Value: "newest", Source: SourceDefault},
+		{Name: "verifier-secret-key", Value: Redacted, Source: SourceEnv},
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("expecting options %#v but got %#v", expected, options)
+	}
+
+	_, err = Apply(fs, map[string]string{"feed-refresh-interval": "often"}, func(string) (string, bool) { return "", false })
+	if err == nil {
+		t.Error("expecting an invalid duration to be rejected")
+	}
+}
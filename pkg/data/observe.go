@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+)
+
+// Kinds of statements that are told to a QueryObserver
+const (
+	QueryKindQuery    = "query"
+	QueryKindExec     = "exec"
+	QueryKindBegin    = "begin"
+	QueryKindCommit   = "commit"
+	QueryKindRollback = "rollback"
+)
+
+// QueryObserver is told how long each statement of the database took
+type QueryObserver func(kind string, d time.Duration)
+
+// NewObservedSQLite is NewSQLite with the latency of every statement told to
+// observe, such as for the metrics of the server. Queries are timed until
+// their first rows are ready, not until they are all read.
+func NewObservedSQLite(file string, observe QueryObserver) *SQLite {
+	// the sqlite driver is only reachable through a database of its own
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		panic("failed to connect database")
+	}
+	d := db.Driver()
+	db.Close()
+
+	return &SQLite{db: sql.OpenDB(observedConnector{driver: d, name: file, observe: observe})}
+}
+
+type observedConnector struct {
+	driver  driver.Driver
+	name    string
+	observe QueryObserver
+}
+
+func (c observedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedConn{Conn: conn, observe: c.observe}, nil
+}
+
+func (c observedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// observedConn times the statements of a connection, falling back to what
+// database/sql does for the interfaces that the driver does not implement
+type observedConn struct {
+	driver.Conn
+	observe QueryObserver
+}
+
+func (c *observedConn) time(kind string, start time.Time, err error) {
+	if err != driver.ErrSkip {
+		c.observe(kind, time.Since(start))
+	}
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.time(QueryKindExec, start, err)
+	return result, err
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.time(QueryKindQuery, start, err)
+	return rows, err
+}
+
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *observedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		//lint:ignore SA1019 the fallback of drivers without BeginTx
+		tx, err = c.Conn.Begin()
+	}
+	c.time(QueryKindBegin, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedTx{Tx: tx, conn: c}, nil
+}
+
+func (c *observedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *observedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+type observedStmt struct {
+	driver.Stmt
+	conn *observedConn
+}
+
+func (s *observedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+
+	var (
+		result driver.Result
+		err    error
+	)
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		values, convErr := namedValues(args)
+		if convErr != nil {
+			return nil, convErr
+		}
+		//lint:ignore SA1019 the fallback of drivers without ExecContext
+		result, err = s.Stmt.Exec(values)
+	}
+	s.conn.time(QueryKindExec, start, err)
+	return result, err
+}
+
+func (s *observedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		values, convErr := namedValues(args)
+		if convErr != nil {
+			return nil, convErr
+		}
+		//lint:ignore SA1019 the fallback of drivers without QueryContext
+		rows, err = s.Stmt.Query(values)
+	}
+	s.conn.time(QueryKindQuery, start, err)
+	return rows, err
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, driver.ErrSkip
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+type observedTx struct {
+	driver.Tx
+	conn *observedConn
+}
+
+func (t *observedTx) Commit() error {
+	start := time.Now()
+	err := t.Tx.Commit()
+	t.conn.time(QueryKindCommit, start, err)
+	return err
+}
+
+func (t *observedTx) Rollback() error {
+	start := time.Now()
+	err := t.Tx.Rollback()
+	t.conn.time(QueryKindRollback, start, err)
+	return err
+}
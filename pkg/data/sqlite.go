@@ -3,9 +3,13 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +18,8 @@ import (
 	"github.com/oxtyped/go-opml/opml"
 	"github.com/pkg/errors"
 	_ "modernc.org/sqlite"
+
+	"github.com/oxtyped/gpodder2go/pkg/sanitize"
 )
 
 type SQLite struct {
@@ -34,6 +40,32 @@ func (s *SQLite) GetDB() *sql.DB {
 
 }
 
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLite) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *SQLite) SchemaVersion() (uint, bool, error) {
+	var (
+		version uint
+		dirty   bool
+	)
+
+	// the table of golang-migrate, it is empty before the first migration
+	err := s.db.QueryRow("SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "error retrieving schema version")
+	}
+
+	return version, dirty, nil
+}
+
 func (s *SQLite) GetUserIdFromName(username string) (int, error) {
 	var userId int
 	db := s.db
@@ -49,7 +81,7 @@ func (s *SQLite) GetUserIdFromName(username string) (int, error) {
 func (s *SQLite) CheckUserPassword(username, password string) bool {
 	var count int
 	db := s.db
-	err := db.QueryRow("SELECT count(*) from users WHERE username = ? AND password = ?", username, password).Scan(&count)
+	err := db.QueryRow("SELECT count(*) from users WHERE username = ? AND password = ? AND disabled = 0", username, password).Scan(&count)
 	if err != nil {
 		return false
 	}
@@ -63,158 +95,120 @@ func (s *SQLite) CheckUserPassword(username, password string) bool {
 	return false
 }
 
-func (s *SQLite) AddUser(username, password, email, name string) error {
-	db := s.db
-	_, err := db.Exec("INSERT INTO users (username, password, email, name) VALUES ($1, $2, $3, $4)", username, password, email, name)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// AddDevice creates a new Device and returns the id of the device and any error
-func (s *SQLite) AddDevice(username string, deviceName string, caption string, deviceType string) (int, error) {
-
-	var deviceId int
+// newSessionSecret is the SQL expression of a new session secret
+const newSessionSecret = "lower(hex(randomblob(16)))"
 
+// RetrieveSessionSecret returns the secret that the session cookies of a user
+// are signed with. It returns sql.ErrNoRows for users that do not exist or are
+// disabled, whose sessions are no longer valid.
+func (s *SQLite) RetrieveSessionSecret(username string) (string, error) {
 	db := s.db
-	userId, err := s.GetUserIdFromName(username)
-	if err != nil {
-		log.Printf("error getting user id from name: %#v", err)
-		return 0, err
-	}
 
-	err = db.QueryRow("INSERT INTO devices (user_id, name, type, caption) VALUES (?, ?, ?, ?) RETURNING id;", userId, deviceName, deviceType, caption).Scan(&deviceId)
+	var secret string
+	err := db.QueryRow("SELECT session_secret FROM users WHERE username = ? AND disabled = 0", username).Scan(&secret)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
-	return deviceId, nil
+	return secret, nil
 }
 
-func (s *SQLite) UpdateOrCreateDevice(username string, deviceName string, caption string, deviceType string) (int, error) {
-	var deviceId int
-
+func (s *SQLite) AddUser(username, password, email, name string) error {
 	db := s.db
-	userId, err := s.GetUserIdFromName(username)
-	if err != nil {
-		log.Printf("error getting user id from name: %#v", err)
-		return 0, err
-	}
-
-	err = db.QueryRow("INSERT INTO devices (user_id, name, type, caption) VALUES (?,?,?,?) ON CONFLICT(user_id, name) DO UPDATE SET user_id=excluded.user_id,name=excluded.name,type=excluded.type,caption=excluded.caption  RETURNING id;", userId, deviceName, deviceType, caption).Scan(&deviceId)
+	_, err := db.Exec("INSERT INTO users (username, password, email, name, session_secret) VALUES ($1, $2, $3, $4, "+newSessionSecret+")", username, password, email, name)
 	if err != nil {
-		return 0, err
+		return err
 	}
-
-	return deviceId, nil
+	return nil
 }
 
-func (s *SQLite) RetrieveDevices(username string) ([]Device, error) {
+// RetrieveUsers returns all the user accounts ordered by username
+func (s *SQLite) RetrieveUsers() ([]User, error) {
 	db := s.db
-	data := []Device{}
-
-	userId, err := s.GetUserIdFromName(username)
-	if err != nil {
-		return nil, errors.Wrap(err, "error getting user id from name")
-	}
+	users := []User{}
 
-	rows, err := db.Query("SELECT name, type, caption from devices WHERE user_id = ?", userId)
+	rows, err := db.Query("SELECT username, email, name, disabled, position_policy, suggestions, federated from users ORDER BY username")
 	if err != nil {
-		return nil, errors.Wrap(err, "error getting devices from user")
+		return nil, errors.Wrap(err, "error getting users")
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		i := Device{}
-		err := rows.Scan(&i.Name, &i.Type, &i.Caption)
+		u := User{}
+		err := rows.Scan(&u.Name, &u.Email, &u.DisplayName, &u.Disabled, &u.PositionPolicy, &u.Suggestions, &u.Federated)
 		if err != nil {
-			return nil, errors.Wrap(err, "error scanning devices from query")
+			return nil, errors.Wrap(err, "error scanning users from query")
 		}
 
-		data = append(data, i)
+		users = append(users, u)
 	}
 
-	return data, nil
+	return users, nil
 }
 
-func (l *SQLite) AddEpisodeActionHistory(username string, e EpisodeAction) error {
+// DeleteUser deletes a user together with all of its devices, subscriptions
+// and episode actions. Sync groups that are left without any devices are
+// removed as well.
+func (s *SQLite) DeleteUser(username string) error {
+	db := s.db
+
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return errors.Wrap(err, "error getting user id from name")
+	}
 
-	db := l.db
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	deviceIds := e.Devices
-
-	for _, deviceId := range deviceIds {
-		//	deviceId, err := l.GetDeviceIdFromName(v, username)
-		//	if err != nil {
-		//		return err
-		//	}
+	statements := []string{
+		"DELETE FROM audit_events WHERE user_id = ?",
+		"DELETE FROM settings WHERE user_id = ?",
+		"DELETE FROM episode_actions WHERE user_id = ?",
+		"DELETE FROM subscriptions WHERE user_id = ?",
+		"DELETE FROM devices WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
 
-		_, err = tx.Exec("INSERT INTO episode_actions(device_id, podcast, episode, action, position, started, total, timestamp) VALUES (?,?,?,?,?,?,?,?)", deviceId, e.Podcast, e.Episode, e.Action, e.Position, e.Started, e.Total, e.Timestamp.Unix())
+	for _, statement := range statements {
+		_, err := tx.Exec(statement, userId)
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "error deleting user %s", username)
 		}
 	}
-	tx.Commit()
-	return nil
-}
-
-func (l *SQLite) RetrieveEpisodeActionHistory(username string, deviceId string, since time.Time) ([]EpisodeAction, error) {
-	return []EpisodeAction{}, nil
-}
-
-// GetDevicesFromUsername returns a list of device names that belongs to
-// username
-func (s *SQLite) GetDevicesFromUsername(username string) ([]string, error) {
-	db := s.db
 
-	devices := []string{}
-
-	rows, err := db.Query("select devices.name from devices, users WHERE devices.user_id = users.id AND users.username = ?", username)
+	err = deleteEmptySyncGroups(tx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var s string
-		err := rows.Scan(&s)
-		if err != nil {
-			log.Printf("error scanning: %#v", err)
-			continue
-		}
-
-		devices = append(devices, s)
 
+	err = deleteFederationActor(tx, UserActor(username))
+	if err != nil {
+		return err
 	}
 
-	return devices, nil
+	return tx.Commit()
 }
 
-func (s *SQLite) GetDeviceIdFromName(deviceName string, username string) (int, error) {
-	var deviceId int
-
-	userId, err := s.GetUserIdFromName(username)
-	if err != nil {
-		return deviceId, err
-	}
-
+// UpdateUserPassword replaces the password of a user and ends their sessions
+func (s *SQLite) UpdateUserPassword(username string, password string) error {
 	db := s.db
-	err = db.QueryRow("SELECT id from devices WHERE name = ? AND user_id = ?", deviceName, userId).Scan(&deviceId)
+
+	result, err := db.Exec("UPDATE users SET password = ?, session_secret = "+newSessionSecret+" WHERE username = ?", password, username)
 	if err != nil {
-		return deviceId, err
+		return err
 	}
 
-	return deviceId, nil
+	return expectAffected(result, username)
 }
 
-// AddSubscriptionHistory adds and updates subscription
-func (s *SQLite) AddSubscriptionHistory(sub Subscription) error {
+// RenameUser changes the username of a user, all of the user's data is kept
+// as it is referenced by the user id. The federation data of the user is
+// removed as it belongs to the actor of the old username, which remote
+// servers know the user by. The sessions of the old username are ended.
+func (s *SQLite) RenameUser(username string, newUsername string) error {
 	db := s.db
 
 	tx, err := db.Begin()
@@ -223,520 +217,2247 @@ func (s *SQLite) AddSubscriptionHistory(sub Subscription) error {
 	}
 	defer tx.Rollback()
 
-	username := sub.User
-	devices := sub.Devices
-
-	userId, err := s.GetUserIdFromName(username)
+	result, err := tx.Exec("UPDATE users SET username = ?, session_secret = "+newSessionSecret+" WHERE username = ?", newUsername, username)
 	if err != nil {
-		return errors.Wrap(err, "error getting user_id from name")
+		return err
 	}
-	//deviceId, err := s.GetDeviceIdFromName(deviceName, username)
-	//if err != nil {
-	//	return errors.Wrap(err, "errors getting device_id from name")
-	//}
 
-	timestamp := strconv.FormatInt(sub.Timestamp.Unix(), 10)
-	// Check  if a corresponding podcast exists
-	for _, deviceId := range devices {
-		// transaction! change to transaction
-		_, err := tx.Exec("INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp) VALUES(?,?,?,?,?)", userId, deviceId, sub.Podcast, sub.Action, timestamp)
-		if err != nil {
-			return err
-		}
+	err = expectAffected(result, username)
+	if err != nil {
+		return err
 	}
 
-	err = tx.Commit()
+	err = deleteFederationActor(tx, UserActor(username))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-// RetrieveAllDeviceSubscriptionsSlice takes in a username and returns a slice
-// containing the url of all the subscribed podcasts
-func (s *SQLite) RetrieveAllDeviceSubscriptionsSlice(username string) ([]string, error) {
-
-	// retrieve all devices's Add
-	// subset it, if it exists anywhere its added
-
-	allDevices := []string{}
+// SetUserDisabled disables or enables a user. Disabled users are unable to
+// login and their sessions are ended.
+func (s *SQLite) SetUserDisabled(username string, disabled bool) error {
+	db := s.db
 
-	// get all devices
-	devices, err := s.GetDevicesFromUsername(username)
+	result, err := db.Exec("UPDATE users SET disabled = ?, session_secret = "+newSessionSecret+" WHERE username = ?", disabled, username)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	log.Printf("Retrieving %d devices from user %s", len(devices), username)
-
-	for _, v := range devices {
-		subs, err := s.RetrieveSubscriptionHistory(username, v, time.Time{})
-		if err != nil {
-			log.Printf("error retrieving subscription history: %#v", err)
+	return expectAffected(result, username)
+}
 
-			return nil, err
-		}
+// SetUserPositionPolicy sets the position policy of a user, an empty policy
+// falls back to the default policy of the server
+func (s *SQLite) SetUserPositionPolicy(username string, policy string) error {
+	db := s.db
 
-		// calculate what's the diff
-		add, _ := SubscriptionDiff(subs)
-		allDevices = append(allDevices, add...)
+	switch policy {
+	case "", PositionPolicyNewest, PositionPolicyFurthest:
+	default:
+		return errors.Errorf("unknown position policy %s", policy)
 	}
 
-	return allDevices, nil
+	result, err := db.Exec("UPDATE users SET position_policy = ? WHERE username = ?", policy, username)
+	if err != nil {
+		return err
+	}
 
+	return expectAffected(result, username)
 }
 
-// RetrieveAllDeviceSubscriptions takes in a username and returns an OPML file
-// of all the RSS feeds that the user was subscribed to on the platform
-func (s *SQLite) RetrieveAllDeviceSubscriptions(username string) (string, error) {
-	// retrieve all devices's Add
-	// subset it, if it exists anywhere its added
-
-	allDevices := []string{}
+// GetUserPositionPolicy returns the position policy of a user, which is empty
+// when the user has not set one
+func (s *SQLite) GetUserPositionPolicy(username string) (string, error) {
+	db := s.db
 
-	// get all devices
-	devices, err := s.GetDevicesFromUsername(username)
+	var policy string
+	err := db.QueryRow("SELECT position_policy FROM users WHERE username = ?", username).Scan(&policy)
 	if err != nil {
 		return "", err
 	}
 
-	log.Printf("Retrieving %d devices from user %s", len(devices), username)
-
-	for _, v := range devices {
-		subs, err := s.RetrieveSubscriptionHistory(username, v, time.Time{})
-		if err != nil {
-			log.Printf("error retrieving subscription history: %#v", err)
+	return policy, nil
+}
 
-			return "", err
-		}
+// SetUserSuggestions opts a user in or out of sharing their subscriptions for
+// the suggestions of other users, which is also what gets them suggestions
+func (s *SQLite) SetUserSuggestions(username string, enabled bool) error {
+	db := s.db
 
-		// calculate what's the diff
-		add, _ := SubscriptionDiff(subs)
-		allDevices = append(allDevices, add...)
+	result, err := db.Exec("UPDATE users SET suggestions = ? WHERE username = ?", enabled, username)
+	if err != nil {
+		return err
 	}
-	allDevices = unique(allDevices)
-
-	var wg sync.WaitGroup
 
-	o := opml.NewOPMLFromBlank("tmpfile")
-	for _, v := range allDevices {
-		v := v
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	return expectAffected(result, username)
+}
 
-			o.AddRSSFromURL(v, 2*time.Second)
-		}()
+// expectAffected returns sql.ErrNoRows when the update on username did not
+// change any rows
+func expectAffected(result sql.Result, username string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
 	}
 
-	wg.Wait()
+	if affected == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "no user %s", username)
+	}
 
-	return o.XML()
+	return nil
 }
 
-// RetrieveDeviceSubscriptionsSlice takes in a username and devicename and returns
-// a slice of all the urls of the subscribed podcasts on the device
-func (s *SQLite) RetrieveDeviceSubscriptionsSlice(username string, deviceName string) ([]string, error) {
-	subs, err := s.RetrieveSubscriptionHistory(username, deviceName, time.Time{})
-	if err != nil {
-		log.Printf("error retrieving subscription history: %#v", err)
+// AddDevice creates a new Device and returns the id of the device and any error
+func (s *SQLite) AddDevice(username string, deviceName string, caption string, deviceType string) (int, error) {
 
-		return nil, err
+	var deviceId int
+
+	db := s.db
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		slog.Error("error getting user id from name", "error", err)
+		return 0, err
 	}
 
-	// calculate what's the diff
-	add, _ := SubscriptionDiff(subs)
+	err = db.QueryRow("INSERT INTO devices (user_id, name, type, caption) VALUES (?, ?, ?, ?) RETURNING id;", userId, deviceName, deviceType, caption).Scan(&deviceId)
+	if err != nil {
+		return 0, err
+	}
 
-	return add, nil
+	return deviceId, nil
 }
 
-// RetrieveDeviceSubscriptions takes in a username and devicename and returns
-// the OPML of its subscriptions
-func (s *SQLite) RetrieveDeviceSubscriptions(username string, deviceName string) (string, error) {
-	subs, err := s.RetrieveSubscriptionHistory(username, deviceName, time.Time{})
+// RegisterDevice creates a device that a client used without creating it
+// first and records the reason in the audit trail of the user
+func (s *SQLite) RegisterDevice(username string, deviceName string, caption string, deviceType string, reason string) (int, error) {
+	var deviceId int
+
+	db := s.db
+	userId, err := s.GetUserIdFromName(username)
 	if err != nil {
-		log.Printf("error retrieving subscription history: %#v", err)
+		return 0, errors.Wrap(err, "error getting user id from name")
+	}
 
-		return "", err
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	// calculate what's the diff
-	add, _ := SubscriptionDiff(subs)
+	err = tx.QueryRow("INSERT INTO devices (user_id, name, type, caption) VALUES (?, ?, ?, ?) RETURNING id;", userId, deviceName, deviceType, caption).Scan(&deviceId)
+	if err != nil {
+		return 0, errors.Wrap(err, "error adding device")
+	}
 
-	o := opml.NewOPMLFromBlank("tmpfile")
-	for _, v := range add {
-		go func() {
-			err := o.AddRSSFromURL(v, 2*time.Second)
-			if err != nil {
-				log.Printf("error adding RSS feed from URL: %#v", err)
-			}
-		}()
+	_, err = tx.Exec("INSERT INTO audit_events (user_id, device_id, action, detail) VALUES (?, ?, ?, ?)", userId, deviceId, AuditDeviceRegistered, reason)
+	if err != nil {
+		return 0, errors.Wrap(err, "error adding audit event")
 	}
 
-	return o.XML()
+	return deviceId, tx.Commit()
 }
 
-func (s *SQLite) RetrieveSubscriptionHistory(username string, deviceName string, since time.Time) ([]Subscription, error) {
+// RetrieveAuditEvents returns the audit trail of a user, oldest first
+func (s *SQLite) RetrieveAuditEvents(username string) ([]AuditEvent, error) {
 	db := s.db
+	events := []AuditEvent{}
+
 	userId, err := s.GetUserIdFromName(username)
 	if err != nil {
-		log.Printf("unable to find user id from username: %#v", err)
-		return nil, err
-	}
-	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
-	if err != nil {
-		log.Printf("unable to find device id from device name: %#v", err)
-		return nil, err
+		return nil, errors.Wrap(err, "error getting user id from name")
 	}
-	subscriptions := []Subscription{}
 
-	rows, err := db.Query("select podcast, action, timestamp from subscriptions where user_id = ? AND device_id = ? AND timestamp > ? ", userId, deviceId, strconv.FormatInt(since.Unix(), 10))
+	rows, err := db.Query("SELECT devices.name, audit_events.action, audit_events.detail, audit_events.created_at FROM audit_events LEFT JOIN devices ON devices.id = audit_events.device_id WHERE audit_events.user_id = ? ORDER BY audit_events.id", userId)
 	if err != nil {
-		log.Printf("error selecting rows: %#v", err)
-		return nil, err
+		return nil, errors.Wrap(err, "error getting audit events")
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		sub := Subscription{}
-		var ts string
-		err := rows.Scan(&sub.Podcast, &sub.Action, &ts)
+		e := AuditEvent{User: username}
+		var device, detail sql.NullString
+		err := rows.Scan(&device, &e.Action, &detail, &e.CreatedAt)
 		if err != nil {
-			log.Printf("error scanning rows into struct: %#v", err)
-			continue
+			return nil, errors.Wrap(err, "error scanning audit events")
+		}
+		e.Device = device.String
+		e.Detail = detail.String
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+func (s *SQLite) UpdateOrCreateDevice(username string, deviceName string, caption string, deviceType string) (int, error) {
+	var deviceId int
+
+	db := s.db
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		slog.Error("error getting user id from name", "error", err)
+		return 0, err
+	}
+
+	err = db.QueryRow("INSERT INTO devices (user_id, name, type, caption) VALUES (?,?,?,?) ON CONFLICT(user_id, name) DO UPDATE SET user_id=excluded.user_id,name=excluded.name,type=excluded.type,caption=excluded.caption  RETURNING id;", userId, deviceName, deviceType, caption).Scan(&deviceId)
+	if err != nil {
+		return 0, err
+	}
+
+	return deviceId, nil
+}
+
+func (s *SQLite) RetrieveDevices(username string) ([]Device, error) {
+	db := s.db
+	data := []Device{}
+
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user id from name")
+	}
+
+	rows, err := db.Query("SELECT name, type, caption from devices WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting devices from user")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i := Device{}
+		var caption sql.NullString
+		err := rows.Scan(&i.Name, &i.Type, &caption)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning devices from query")
+		}
+		i.Caption = caption.String
+
+		data = append(data, i)
+	}
+
+	return data, nil
+}
+
+func (l *SQLite) AddEpisodeActionHistory(username string, e EpisodeAction) error {
+	return l.AddEpisodeActionHistories(username, []EpisodeAction{e})
+}
+
+// AddEpisodeActionHistories adds all of the episode actions or none of them.
+// An action is recorded once for each of its Devices, or once without a device
+// if it has none.
+func (l *SQLite) AddEpisodeActionHistories(username string, actions []EpisodeAction) error {
+
+	db := l.db
+
+	userId, err := l.GetUserIdFromName(username)
+	if err != nil {
+		return errors.Wrap(err, "error getting user id from name")
+	}
+
+	// the upload time that since is compared against
+	createdAt := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range actions {
+		deviceIds := []*int{}
+		for _, deviceId := range e.Devices {
+			deviceId := deviceId
+			deviceIds = append(deviceIds, &deviceId)
+		}
+		if len(deviceIds) == 0 {
+			deviceIds = append(deviceIds, nil)
+		}
+
+		for _, deviceId := range deviceIds {
+			_, err = tx.Exec("INSERT INTO episode_actions(user_id, device_id, podcast, episode, guid, action, position, started, total, timestamp, created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?)", userId, deviceId, e.Podcast, e.Episode, e.GUID, e.Action, e.Position, e.Started, e.Total, strconv.FormatInt(e.Timestamp.Unix(), 10), createdAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RetrieveEpisodeActionHistory returns the episode actions of username that
+// were uploaded since, optionally only the ones of podcast or deviceName. When
+// aggregated, only the latest action of each episode is returned, with the
+// position to resume at picked by policy when it is a play action.
+func (l *SQLite) RetrieveEpisodeActionHistory(username string, podcast string, deviceName string, since time.Time, aggregated bool, policy string) ([]EpisodeAction, error) {
+	db := l.db
+
+	userId, err := l.GetUserIdFromName(username)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user id from name")
+	}
+
+	conditions, args := episodeActionConditions("", userId, podcast, deviceName, since)
+
+	// the latest action of an episode is picked with the max() of sqlite that
+	// takes the bare id column from the row with the latest timestamp, so that
+	// it is done from the episode_actions_latest index alone without loading
+	// the older actions
+	// https://www.sqlite.org/lang_select.html#bareagg
+	ids := "SELECT id FROM episode_actions WHERE " + conditions
+	if aggregated {
+		ids = "SELECT id FROM (SELECT id, MAX(CAST(timestamp AS INTEGER)) FROM episode_actions WHERE " + conditions + " GROUP BY podcast, episode)"
+	}
+
+	query := "SELECT e.podcast, e.episode, e.guid, d.name, e.action, e.position, e.started, e.total, e.timestamp FROM episode_actions e LEFT JOIN devices d ON d.id = e.device_id WHERE e.id IN (" + ids + ") ORDER BY CAST(e.timestamp AS INTEGER), e.id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error selecting episode actions")
+	}
+	defer rows.Close()
+
+	actions := []EpisodeAction{}
+	for rows.Next() {
+		action := EpisodeAction{}
+		var guid, device sql.NullString
+		var position, started, total sql.NullInt64
+		var ts int64
+		err := rows.Scan(&action.Podcast, &action.Episode, &guid, &device, &action.Action, &position, &started, &total, &ts)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning episode action")
+		}
+
+		action.GUID = guid.String
+		action.Device = device.String
+		action.Position = nullInt(position)
+		action.Started = nullInt(started)
+		action.Total = nullInt(total)
+		action.Timestamp.Time = time.Unix(ts, 0).UTC()
+
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if aggregated && policy == PositionPolicyFurthest {
+		err = l.resolveFurthestPositions(userId, podcast, deviceName, since, actions)
+		if err != nil {
+			return nil, errors.Wrap(err, "error resolving furthest positions")
+		}
+	}
+
+	return actions, nil
+}
+
+// episodeActionConditions returns the conditions and their args that select
+// the episode actions of userId that were uploaded since, optionally only the
+// ones of podcast or deviceName, with the columns prefixed by prefix
+func episodeActionConditions(prefix string, userId int, podcast string, deviceName string, since time.Time) (string, []interface{}) {
+	conditions := prefix + "user_id = ? AND CAST(" + prefix + "created_at AS INTEGER) >= ?"
+	args := []interface{}{userId, since.Unix()}
+	if podcast != "" {
+		conditions += " AND " + prefix + "podcast = ?"
+		args = append(args, podcast)
+	}
+	if deviceName != "" {
+		conditions += " AND " + prefix + "device_id IN (SELECT id FROM devices WHERE user_id = ? AND name = ?)"
+		args = append(args, userId, deviceName)
+	}
+
+	return conditions, args
+}
+
+// resolveFurthestPositions replaces the position of the play actions with the
+// furthest one that the episode was played to among the actions that
+// RetrieveEpisodeActionHistory selected, so across the devices of the user
+// unless deviceName is set. Only the play actions since the episode was last
+// marked as new, on any device, count, so that an episode that is played
+// again starts over.
+func (l *SQLite) resolveFurthestPositions(userId int, podcast string, deviceName string, since time.Time, actions []EpisodeAction) error {
+	db := l.db
+
+	conditions, args := episodeActionConditions("p.", userId, podcast, deviceName, since)
+	conditions += " AND p.action = ?"
+	args = append(args, EpisodeActionPlay)
+
+	// the bare columns are taken from the row with the furthest position,
+	// the same as the latest action in RetrieveEpisodeActionHistory
+	rows, err := db.Query("SELECT p.podcast, p.episode, p.position, p.started, p.total, MAX(p.position) FROM episode_actions p WHERE "+conditions+" AND CAST(p.timestamp AS INTEGER) >= COALESCE((SELECT MAX(CAST(n.timestamp AS INTEGER)) FROM episode_actions n WHERE n.user_id = p.user_id AND n.podcast = p.podcast AND n.episode = p.episode AND n.action = ?), 0) GROUP BY p.podcast, p.episode", append(args, EpisodeActionNew)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type key struct{ podcast, episode string }
+	furthest := map[key]EpisodeAction{}
+	for rows.Next() {
+		action := EpisodeAction{}
+		var position, started, total, max sql.NullInt64
+		err := rows.Scan(&action.Podcast, &action.Episode, &position, &started, &total, &max)
+		if err != nil {
+			return err
+		}
+
+		action.Position = nullInt(position)
+		action.Started = nullInt(started)
+		action.Total = nullInt(total)
+		furthest[key{action.Podcast, action.Episode}] = action
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range actions {
+		action := &actions[i]
+		if action.Action != EpisodeActionPlay {
+			continue
+		}
+
+		f, ok := furthest[key{action.Podcast, action.Episode}]
+		if !ok || f.Position == nil || (action.Position != nil && *action.Position >= *f.Position) {
+			continue
+		}
+		action.Position, action.Started, action.Total = f.Position, f.Started, f.Total
+	}
+
+	return nil
+}
+
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
+
+// RetrieveDevice returns the device deviceName of username including its sync
+// group and the time of its latest subscription or episode action
+func (s *SQLite) RetrieveDevice(username string, deviceName string) (Device, error) {
+	db := s.db
+	device := Device{User: &User{Name: username}}
+
+	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		return device, errors.Wrap(err, "error getting device id from name")
+	}
+
+	var caption sql.NullString
+	err = db.QueryRow("SELECT id, name, type, caption, device_sync_group_id from devices WHERE id = ?", deviceId).Scan(&device.Id, &device.Name, &device.Type, &caption, &device.SyncGroupId)
+	if err != nil {
+		return device, errors.Wrap(err, "error getting device")
+	}
+	device.Caption = caption.String
+
+	var lastActivity sql.NullInt64
+	err = db.QueryRow("SELECT MAX(ts) FROM (SELECT MAX(CAST(timestamp AS INTEGER)) AS ts FROM subscriptions WHERE device_id = ? UNION ALL SELECT MAX(CAST(timestamp AS INTEGER)) FROM episode_actions WHERE device_id = ?)", deviceId, deviceId).Scan(&lastActivity)
+	if err != nil {
+		return device, errors.Wrap(err, "error getting last activity of device")
+	}
+
+	if lastActivity.Valid {
+		device.LastActivity = time.Unix(lastActivity.Int64, 0)
+	}
+
+	return device, nil
+}
+
+// RenameDevice changes the name of a device, which is the device id that
+// clients reference it by
+func (s *SQLite) RenameDevice(username string, deviceName string, newDeviceName string) error {
+	db := s.db
+
+	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		return errors.Wrap(err, "error getting device id from name")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE devices SET name = ? WHERE id = ?", newDeviceName, deviceId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE settings SET target = ? WHERE user_id = (SELECT user_id FROM devices WHERE id = ?) AND scope = 'device' AND target = ?", newDeviceName, deviceId, deviceName)
+	if err != nil {
+		return errors.Wrap(err, "error renaming device settings")
+	}
+
+	return tx.Commit()
+}
+
+// DeleteDevice deletes a device together with its subscription and episode
+// action history
+func (s *SQLite) DeleteDevice(username string, deviceName string) error {
+	db := s.db
+
+	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		return errors.Wrap(err, "error getting device id from name")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"UPDATE audit_events SET device_id = NULL WHERE device_id = ?",
+		"DELETE FROM settings WHERE (user_id, scope, target) IN (SELECT user_id, 'device', name FROM devices WHERE id = ?)",
+		"DELETE FROM episode_actions WHERE device_id = ?",
+		"DELETE FROM subscriptions WHERE device_id = ?",
+		"DELETE FROM devices WHERE id = ?",
+	}
+
+	for _, statement := range statements {
+		_, err := tx.Exec(statement, deviceId)
+		if err != nil {
+			return errors.Wrapf(err, "error deleting device %s", deviceName)
+		}
+	}
+
+	err = deleteEmptySyncGroups(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeDevices moves the subscriptions, episode action history and device
+// settings of srcDeviceName onto dstDeviceName and deletes srcDeviceName. This
+// is used when a client is reinstalled and starts syncing with a new device id.
+// The podcasts that both devices are subscribed to stay subscribed once, so
+// that a single unsubscribe removes them, and the settings of dstDeviceName
+// win over the ones of srcDeviceName.
+func (s *SQLite) MergeDevices(username string, srcDeviceName string, dstDeviceName string) error {
+	db := s.db
+
+	srcDeviceId, err := s.GetDeviceIdFromName(srcDeviceName, username)
+	if err != nil {
+		return errors.Wrapf(err, "error getting device id of %s", srcDeviceName)
+	}
+
+	dstDeviceId, err := s.GetDeviceIdFromName(dstDeviceName, username)
+	if err != nil {
+		return errors.Wrapf(err, "error getting device id of %s", dstDeviceName)
+	}
+
+	if srcDeviceId == dstDeviceId {
+		return errors.New("cannot merge a device into itself")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE episode_actions SET device_id = ? WHERE device_id = ?", dstDeviceId, srcDeviceId)
+	if err != nil {
+		return errors.Wrapf(err, "error merging device %s into %s", srcDeviceName, dstDeviceName)
+	}
+
+	// moving the rows would count the podcasts of both devices twice, so the
+	// new device is only subscribed to the ones that it is missing, as of the
+	// latest change of the old device
+	_, err = tx.Exec(`INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp)
+SELECT user_id, ?, podcast, 'SUBSCRIBE', MAX(CAST(timestamp AS INTEGER)) FROM subscriptions WHERE device_id = ?
+GROUP BY podcast HAVING `+subscriptionCount+` > 0
+AND podcast NOT IN (SELECT podcast FROM subscriptions WHERE device_id = ? GROUP BY podcast HAVING `+subscriptionCount+` > 0)`, dstDeviceId, srcDeviceId, dstDeviceId)
+	if err != nil {
+		return errors.Wrapf(err, "error merging subscriptions of %s into %s", srcDeviceName, dstDeviceName)
+	}
+
+	_, err = tx.Exec("DELETE FROM subscriptions WHERE device_id = ?", srcDeviceId)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting subscriptions of %s", srcDeviceName)
+	}
+
+	// the settings that the new device has are kept, the others are moved
+	_, err = tx.Exec("UPDATE OR IGNORE settings SET target = ? WHERE user_id = (SELECT user_id FROM devices WHERE id = ?) AND scope = 'device' AND target = ?", dstDeviceName, srcDeviceId, srcDeviceName)
+	if err != nil {
+		return errors.Wrapf(err, "error merging settings of %s into %s", srcDeviceName, dstDeviceName)
+	}
+
+	_, err = tx.Exec("DELETE FROM settings WHERE user_id = (SELECT user_id FROM devices WHERE id = ?) AND scope = 'device' AND target = ?", srcDeviceId, srcDeviceName)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting settings of %s", srcDeviceName)
+	}
+
+	// the new device takes over the sync group of the old device if it has
+	// none of its own
+	_, err = tx.Exec("UPDATE devices SET device_sync_group_id = (SELECT device_sync_group_id FROM devices WHERE id = ?) WHERE id = ? AND device_sync_group_id IS NULL", srcDeviceId, dstDeviceId)
+	if err != nil {
+		return errors.Wrap(err, "error moving sync group")
+	}
+
+	_, err = tx.Exec("UPDATE audit_events SET device_id = ? WHERE device_id = ?", dstDeviceId, srcDeviceId)
+	if err != nil {
+		return errors.Wrap(err, "error moving audit events")
+	}
+
+	_, err = tx.Exec("DELETE FROM devices WHERE id = ?", srcDeviceId)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting device %s", srcDeviceName)
+	}
+
+	err = deleteEmptySyncGroups(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return s.updateSyncGroupStatuses([]int{dstDeviceId})
+}
+
+// deleteEmptySyncGroups removes the sync groups that no longer have any
+// devices in them
+func deleteEmptySyncGroups(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM device_sync_groups WHERE id NOT IN (SELECT device_sync_group_id FROM devices WHERE device_sync_group_id IS NOT NULL)")
+	if err != nil {
+		return errors.Wrap(err, "error deleting empty sync groups")
+	}
+
+	return nil
+}
+
+// GetDevicesFromUsername returns a list of device names that belongs to
+// username
+func (s *SQLite) GetDevicesFromUsername(username string) ([]string, error) {
+	db := s.db
+
+	devices := []string{}
+
+	rows, err := db.Query("select devices.name from devices, users WHERE devices.user_id = users.id AND users.username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s string
+		err := rows.Scan(&s)
+		if err != nil {
+			slog.Error("error scanning", "error", err)
+			continue
+		}
+
+		devices = append(devices, s)
+
+	}
+
+	return devices, nil
+}
+
+func (s *SQLite) GetDeviceIdFromName(deviceName string, username string) (int, error) {
+	var deviceId int
+
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return deviceId, err
+	}
+
+	db := s.db
+	err = db.QueryRow("SELECT id from devices WHERE name = ? AND user_id = ?", deviceName, userId).Scan(&deviceId)
+	if err != nil {
+		return deviceId, err
+	}
+
+	return deviceId, nil
+}
+
+// AddSubscriptionHistory adds and updates subscription, see
+// AddSubscriptionHistories.
+func (s *SQLite) AddSubscriptionHistory(sub Subscription) error {
+	return s.AddSubscriptionHistories([]Subscription{sub})
+}
+
+// AddSubscriptionHistories adds all of the subscription actions or none of
+// them. The devices that are already in the state of an action, subscribed to
+// a podcast that is subscribed or not subscribed to one that is unsubscribed,
+// are skipped, as SubscriptionDiff would count the action on them twice. The
+// status of the sync groups of the devices that changed is updated once all
+// of the actions are added.
+func (s *SQLite) AddSubscriptionHistories(subs []Subscription) error {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed := []int{}
+	seen := map[int]bool{}
+	for _, sub := range subs {
+		userId, err := s.GetUserIdFromName(sub.User)
+		if err != nil {
+			return errors.Wrap(err, "error getting user_id from name")
+		}
+
+		timestamp := strconv.FormatInt(sub.Timestamp.Unix(), 10)
+		// Check  if a corresponding podcast exists
+		for _, deviceId := range sub.Devices {
+			var count int
+			err := tx.QueryRow("SELECT COALESCE("+subscriptionCount+", 0) FROM subscriptions WHERE device_id = ? AND podcast = ?", deviceId, sub.Podcast).Scan(&count)
+			if err != nil {
+				return errors.Wrapf(err, "error getting subscription of device %d", deviceId)
+			}
+
+			if (sub.Action == "SUBSCRIBE" && count > 0) || (sub.Action == "UNSUBSCRIBE" && count <= 0) {
+				continue
+			}
+
+			_, err = tx.Exec("INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp) VALUES(?,?,?,?,?)", userId, deviceId, sub.Podcast, sub.Action, timestamp)
+			if err != nil {
+				return err
+			}
+			if !seen[deviceId] {
+				seen[deviceId] = true
+				changed = append(changed, deviceId)
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return s.updateSyncGroupStatuses(changed)
+}
+
+// RetrieveAllDeviceSubscriptionsSlice takes in a username and returns a slice
+// containing the url of all the subscribed podcasts
+func (s *SQLite) RetrieveAllDeviceSubscriptionsSlice(username string) ([]string, error) {
+
+	// retrieve all devices's Add
+	// subset it, if it exists anywhere its added
+
+	allDevices := []string{}
+
+	// get all devices
+	devices, err := s.GetDevicesFromUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("retrieving devices", "devices", len(devices), "username", username)
+
+	for _, v := range devices {
+		subs, err := s.RetrieveSubscriptionHistory(username, v, time.Time{})
+		if err != nil {
+			slog.Error("error retrieving subscription history", "error", err)
+
+			return nil, err
+		}
+
+		// calculate what's the diff
+		add, _ := SubscriptionDiff(subs)
+		allDevices = append(allDevices, add...)
+	}
+
+	return allDevices, nil
+
+}
+
+// RetrieveAllDeviceSubscriptions takes in a username and returns an OPML file
+// of all the RSS feeds that the user was subscribed to on the platform
+func (s *SQLite) RetrieveAllDeviceSubscriptions(username string) (string, error) {
+	// retrieve all devices's Add
+	// subset it, if it exists anywhere its added
+
+	allDevices := []string{}
+
+	// get all devices
+	devices, err := s.GetDevicesFromUsername(username)
+	if err != nil {
+		return "", err
+	}
+
+	slog.Debug("retrieving devices", "devices", len(devices), "username", username)
+
+	for _, v := range devices {
+		subs, err := s.RetrieveSubscriptionHistory(username, v, time.Time{})
+		if err != nil {
+			slog.Error("error retrieving subscription history", "error", err)
+
+			return "", err
+		}
+
+		// calculate what's the diff
+		add, _ := SubscriptionDiff(subs)
+		allDevices = append(allDevices, add...)
+	}
+	allDevices = unique(allDevices)
+
+	var wg sync.WaitGroup
+
+	o := opml.NewOPMLFromBlank("tmpfile")
+	for _, v := range allDevices {
+		v := v
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			o.AddRSSFromURL(v, 2*time.Second)
+		}()
+	}
+
+	wg.Wait()
+
+	return o.XML()
+}
+
+// RetrieveDeviceSubscriptionsSlice takes in a username and devicename and returns
+// a slice of all the urls of the subscribed podcasts on the device
+func (s *SQLite) RetrieveDeviceSubscriptionsSlice(username string, deviceName string) ([]string, error) {
+	subs, err := s.RetrieveSubscriptionHistory(username, deviceName, time.Time{})
+	if err != nil {
+		slog.Error("error retrieving subscription history", "error", err)
+
+		return nil, err
+	}
+
+	// calculate what's the diff
+	add, _ := SubscriptionDiff(subs)
+
+	return add, nil
+}
+
+// RetrieveDeviceSubscriptions takes in a username and devicename and returns
+// the OPML of its subscriptions
+func (s *SQLite) RetrieveDeviceSubscriptions(username string, deviceName string) (string, error) {
+	subs, err := s.RetrieveSubscriptionHistory(username, deviceName, time.Time{})
+	if err != nil {
+		slog.Error("error retrieving subscription history", "error", err)
+
+		return "", err
+	}
+
+	// calculate what's the diff
+	add, _ := SubscriptionDiff(subs)
+
+	o := opml.NewOPMLFromBlank("tmpfile")
+	for _, v := range add {
+		go func() {
+			err := o.AddRSSFromURL(v, 2*time.Second)
+			if err != nil {
+				slog.Error("error adding RSS feed from URL", "error", err)
+			}
+		}()
+	}
+
+	return o.XML()
+}
+
+func (s *SQLite) RetrieveSubscriptionHistory(username string, deviceName string, since time.Time) ([]Subscription, error) {
+	db := s.db
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		slog.Error("unable to find user id from username", "error", err)
+		return nil, err
+	}
+	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		slog.Error("unable to find device id from device name", "error", err)
+		return nil, err
+	}
+	subscriptions := []Subscription{}
+
+	rows, err := db.Query("select podcast, action, timestamp from subscriptions where user_id = ? AND device_id = ? AND timestamp > ? ", userId, deviceId, strconv.FormatInt(since.Unix(), 10))
+	if err != nil {
+		slog.Error("error selecting rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		sub := Subscription{}
+		var ts string
+		err := rows.Scan(&sub.Podcast, &sub.Action, &ts)
+		if err != nil {
+			slog.Error("error scanning rows into struct", "error", err)
+			continue
 		}
 
 		timestampTime, err := strconv.ParseInt(ts, 10, 64)
 		if err != nil {
-			log.Printf("error parsing timestamp into struct: %#v", err)
+			slog.Error("error parsing timestamp into struct", "error", err)
+			continue
+		}
+		sub.Timestamp.Time = time.Unix(timestampTime, 0)
+
+		subscriptions = append(subscriptions, sub)
+
+	}
+
+	return subscriptions, nil
+}
+
+// SanitizeHistory rewrites the podcast and episode urls in the subscription
+// and episode action history into their sanitized form and returns the number
+// of rows that were changed or removed. Rows with rejected urls are removed.
+// The subscription history is normalized before and after the rewriting, so
+// that a device stays subscribed to a podcast that it was subscribed to under
+// any of its urls, once. Running it again on sanitized history is a no-op.
+func (s *SQLite) SanitizeHistory() (int, error) {
+	db := s.db
+	changed := 0
+
+	type row struct {
+		id      int
+		podcast string
+		episode string
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	readRows := func(query string, scan func(*sql.Rows, *row) error) ([]row, error) {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		result := []row{}
+		for rows.Next() {
+			r := row{}
+			if err := scan(rows, &r); err != nil {
+				return nil, err
+			}
+			result = append(result, r)
+		}
+
+		return result, rows.Err()
+	}
+
+	normalized, err := normalizeSubscriptions(tx)
+	if err != nil {
+		return 0, err
+	}
+	changed += normalized
+
+	subs, err := readRows("SELECT id, podcast FROM subscriptions", func(rows *sql.Rows, r *row) error {
+		return rows.Scan(&r.id, &r.podcast)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting subscriptions")
+	}
+
+	for _, r := range subs {
+		u, err := sanitize.URL(r.podcast)
+		if err != nil {
+			_, err := tx.Exec("DELETE FROM subscriptions WHERE id = ?", r.id)
+			if err != nil {
+				return 0, errors.Wrap(err, "error deleting subscription")
+			}
+			changed++
+			continue
+		}
+
+		if u != r.podcast {
+			_, err := tx.Exec("UPDATE subscriptions SET podcast = ? WHERE id = ?", u, r.id)
+			if err != nil {
+				return 0, errors.Wrap(err, "error updating subscription")
+			}
+			changed++
+		}
+	}
+
+	// the podcasts that were subscribed to under several urls
+	normalized, err = normalizeSubscriptions(tx)
+	if err != nil {
+		return 0, err
+	}
+	changed += normalized
+
+	actions, err := readRows("SELECT id, podcast, episode FROM episode_actions", func(rows *sql.Rows, r *row) error {
+		return rows.Scan(&r.id, &r.podcast, &r.episode)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting episode actions")
+	}
+
+	for _, r := range actions {
+		podcast, podcastErr := sanitize.URL(r.podcast)
+		episode, episodeErr := sanitize.URL(r.episode)
+
+		if podcastErr != nil || episodeErr != nil {
+			_, err := tx.Exec("DELETE FROM episode_actions WHERE id = ?", r.id)
+			if err != nil {
+				return 0, errors.Wrap(err, "error deleting episode action")
+			}
+			changed++
+			continue
+		}
+
+		if podcast != r.podcast || episode != r.episode {
+			_, err := tx.Exec("UPDATE episode_actions SET podcast = ?, episode = ? WHERE id = ?", podcast, episode, r.id)
+			if err != nil {
+				return 0, errors.Wrap(err, "error updating episode action")
+			}
+			changed++
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM episode_actions WHERE id NOT IN (SELECT MIN(id) FROM episode_actions GROUP BY user_id, device_id, podcast, episode, guid, action, position, started, total, timestamp)")
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting duplicated episode actions")
+	}
+	duplicates, _ := result.RowsAffected()
+	changed += int(duplicates)
+
+	return changed, tx.Commit()
+}
+
+// normalizeSubscriptions drops the repeated actions of the subscription
+// history, oldest first, so that the subscriptionCount of every device and
+// podcast is 1 when it is subscribed and 0 when it is not, as migration 16
+// does. It returns the number of rows that were dropped.
+func normalizeSubscriptions(tx *sql.Tx) (int, error) {
+	result, err := tx.Exec(`DELETE FROM subscriptions WHERE id IN (
+SELECT id FROM (
+SELECT id, action,
+ROW_NUMBER() OVER (PARTITION BY device_id, podcast, action ORDER BY CAST(timestamp AS INTEGER), id) AS n,
+` + subscriptionCount + ` OVER (PARTITION BY device_id, podcast) AS count
+FROM subscriptions
+) WHERE (action = 'SUBSCRIBE' AND n < count) OR (action = 'UNSUBSCRIBE' AND n <= -count)
+)`)
+	if err != nil {
+		return 0, errors.Wrap(err, "error normalizing subscriptions")
+	}
+
+	dropped, _ := result.RowsAffected()
+	return int(dropped), nil
+}
+
+func unique(stringSlice []string) []string {
+	keys := make(map[string]bool)
+	list := []string{}
+	for _, entry := range stringSlice {
+		if _, value := keys[entry]; !value {
+			keys[entry] = true
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// GetDevicesInSyncGroupFromDeviceId takes in a deviceId and returns a list of
+// deviceIds that belongs to the same syncgroup including itself. If there's no
+// sync group, it should return a nil to signal that the device has no existing
+// sync_group, but not return an error as it is returning a valid position.
+func (s *SQLite) GetDevicesInSyncGroupFromDeviceId(deviceId int) ([]int, error) {
+
+	var deviceSyncGroupId sql.NullInt64
+	var returnedDeviceId int
+	var devicesFromSyncGroup []int
+	db := s.db
+
+	// get the sync group id
+	err := db.QueryRow("select device_sync_group_id from devices where id =? LIMIT 1", deviceId).Scan(&deviceSyncGroupId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else {
+			slog.Error("error getting device_sync_group_id", "error", err)
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query("select id from devices WHERE device_sync_group_id = ?", deviceSyncGroupId)
+	if err != nil {
+		slog.Error("error getting devices from sync group", "error", err)
+		return nil, err
+	}
+
+	for rows.Next() {
+		rows.Scan(&returnedDeviceId)
+		devicesFromSyncGroup = append(devicesFromSyncGroup, returnedDeviceId)
+
+	}
+
+	return devicesFromSyncGroup, nil
+}
+
+// AddSyncGroup takes in a slice of device_ids and add them to a SyncGroup if
+// they do not exist. Returns error if it already existed.
+//
+// Each device can only have one sync group at a time. Sync group's purpose is
+// to link devices together so that any new podcast subscriptions will always be
+// setup and installed on each device
+func (s *SQLite) AddSyncGroup(device_names []string, username string) error {
+	db := s.db
+
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, _, err = addSyncGroup(tx, device_names, username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LinkSyncGroup is AddSyncGroup followed by ConvergeSyncGroup on the first of
+// device_names, in one transaction so that the devices are never left linked
+// but not converged
+func (s *SQLite) LinkSyncGroup(device_names []string, username string) error {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userId, device_ids, err := addSyncGroup(tx, device_names, username)
+	if err != nil {
+		return err
+	}
+
+	err = convergeSyncGroup(tx, userId, device_ids[0])
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addSyncGroup links device_names in tx and returns the id of the user and
+// the ids of the devices
+func addSyncGroup(tx *sql.Tx, device_names []string, username string) (int, []int, error) {
+
+	var device_ids []int
+	var userId int
+
+	err := tx.QueryRow("select id from users where username = ?", username).Scan(&userId)
+	if err != nil {
+		slog.Error("error retrieving user info", "error", err)
+		return userId, nil, err
+	}
+
+	if len(device_names) == 0 {
+		return userId, nil, errors.New("no device provided")
+	}
+
+	for _, v := range device_names {
+		var i int
+		err := tx.QueryRow("SELECT id from devices WHERE name = ? AND user_id = ?", v, userId).Scan(&i)
+		if err != nil {
+			return userId, nil, err
+		}
+
+		device_ids = append(device_ids, i)
+	}
+
+	// get device_ids
+
+	// do a check if device_ids all belong to the user. If it doesn't, send out an
+	// error
+	// TODO FIX THIS
+	//	return errors.New("something screwed up")
+
+	// getDeviceSyncGroup takes in a deviceId and returns the device_sync_group_id
+	// of a device if it exists, if not it returns nil
+	var getDeviceSyncGroup = func(deviceId int) *int {
+
+		var deviceSyncGroupId *int
+
+		err := tx.QueryRow("SELECT device_sync_group_id from devices WHERE id = ? AND user_id = ?", deviceId, userId).Scan(&deviceSyncGroupId)
+		if err != nil {
+
+			slog.Error("error selecting sync group id", "error", err)
+			return nil
+		}
+
+		return deviceSyncGroupId
+	}
+
+	// updateDeviceSyncGroup takes in a device_id and a device_sync_group_id to
+	// update the device with the new sync_group_id
+	var updateDeviceSyncGroup = func(deviceId *int, newSyncGroup *int) error {
+
+		if deviceId == nil {
+			return errors.New("no device provided")
+
+		}
+
+		result, err := tx.Exec("UPDATE devices SET device_sync_group_id = ? WHERE id = ?", newSyncGroup, deviceId)
+		if err != nil {
+			return err
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+
+			return fmt.Errorf("expecting device to be updated with new device_sync_group but none is changed; is there a device_id %d", deviceId)
+		}
+
+		// the group has a new device that has yet to be converged with it
+		_, err = tx.Exec("UPDATE device_sync_groups SET sync_status = ? WHERE id = ?", SyncStatusPending, newSyncGroup)
+		if err != nil {
+			return err
+		}
+
+		return nil
+
+	}
+
+	// createDeviceSyncGroup takes in 2 device_ids and creates a syncgroup linking
+	// both of the devices together
+	var createDeviceSyncGroup = func(firstDeviceId *int, secondDeviceId *int) error {
+
+		var lastInsertId *int
+
+		err := tx.QueryRow("insert into device_sync_groups (sync_status) VALUES ('pending') RETURNING id").Scan(&lastInsertId)
+		if err != nil {
+			return err
+		}
+
+		err = updateDeviceSyncGroup(firstDeviceId, lastInsertId)
+		if err != nil {
+			return err
+		}
+		err = updateDeviceSyncGroup(secondDeviceId, lastInsertId)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// take the first device as the first device
+	firstDeviceId := device_ids[0]
+
+	for _, currentDeviceId := range device_ids[1:] {
+
+		currentDeviceSyncGroupId := getDeviceSyncGroup(currentDeviceId)
+		firstDeviceSyncGroupId := getDeviceSyncGroup(firstDeviceId)
+
+		// if both devices belong to a different sync group, assign the
+		// sync group in the current_device to the other sync group
+		if currentDeviceSyncGroupId != nil && firstDeviceSyncGroupId != nil {
+
+			// update deviceSyncGroup id with firstDeviceSyncGroup id
+			err = updateDeviceSyncGroup(&currentDeviceId, firstDeviceSyncGroupId)
+			if err != nil {
+				return userId, nil, errors.Wrapf(err, "error updating device %d sync group with %d", currentDeviceId, firstDeviceSyncGroupId)
+			}
+
+		} else if currentDeviceSyncGroupId == nil && firstDeviceSyncGroupId == nil {
+			// if both devices have no sync groups, create one and assign it to both
+			// of them
+
+			slog.Debug("no sync groups found, creating a new one")
+			err = createDeviceSyncGroup(&firstDeviceId, &currentDeviceId)
+			if err != nil {
+				return userId, nil, errors.Wrapf(err, "error creating a new device sync group for device id %d and %d", firstDeviceId, currentDeviceId)
+			}
+
+		} else if currentDeviceSyncGroupId == nil && firstDeviceSyncGroupId != nil {
+			// if current_device has no sync group but there's an existing sync group
+			// on the other device, assign the sync group to current_device
+
+			err = updateDeviceSyncGroup(&currentDeviceId, firstDeviceSyncGroupId)
+			if err != nil {
+				return userId, nil, err
+			}
+
+		} else if currentDeviceSyncGroupId != nil && firstDeviceSyncGroupId == nil {
+			// if current_device has a sync group but the other device has no sync
+			// group, assign the current_device's sync group to the other device
+
+			err = updateDeviceSyncGroup(&firstDeviceId, currentDeviceSyncGroupId)
+			if err != nil {
+				return userId, nil, err
+			}
+
+		}
+
+	}
+
+	return userId, device_ids, nil
+
+}
+
+// ConvergeSyncGroup subscribes every device in the sync group of deviceName to
+// the podcasts that any of the other devices in the group are subscribed to.
+// Devices only share the changes made after they are linked, so this is what
+// gets the subscriptions that they had before into the same state, as mygpo
+// does when devices are linked.
+func (s *SQLite) ConvergeSyncGroup(deviceName string, username string) error {
+	db := s.db
+
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return errors.Wrap(err, "error getting user id from name")
+	}
+
+	deviceId, err := s.GetDeviceIdFromName(deviceName, username)
+	if err != nil {
+		return errors.Wrap(err, "error getting device id from name")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = convergeSyncGroup(tx, userId, deviceId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// convergeSyncGroup converges the sync group of deviceId in tx
+func convergeSyncGroup(tx *sql.Tx, userId int, deviceId int) error {
+	rows, err := tx.Query("SELECT id FROM devices WHERE device_sync_group_id = (SELECT device_sync_group_id FROM devices WHERE id = ?)", deviceId)
+	if err != nil {
+		return errors.Wrap(err, "error getting devices from sync group")
+	}
+
+	deviceIds := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error scanning devices")
+		}
+		deviceIds = append(deviceIds, id)
+	}
+	rows.Close()
+
+	if len(deviceIds) < 2 {
+		return nil
+	}
+
+	subscribed, all, err := syncGroupSubscriptions(tx, deviceIds)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	for _, id := range deviceIds {
+		current := map[string]bool{}
+		for _, v := range subscribed[id] {
+			current[v] = true
+		}
+
+		for _, podcast := range all {
+			if current[podcast] {
+				continue
+			}
+
+			_, err := tx.Exec("INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp) VALUES(?,?,?,?,?)", userId, id, podcast, "SUBSCRIBE", timestamp)
+			if err != nil {
+				return errors.Wrapf(err, "error subscribing device %d to %s", id, podcast)
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE device_sync_groups SET sync_status = ?, sync_time = CURRENT_TIMESTAMP WHERE id = (SELECT device_sync_group_id FROM devices WHERE id = ?)", SyncStatusSynced, deviceId)
+	if err != nil {
+		return errors.Wrap(err, "error updating sync status")
+	}
+
+	return nil
+}
+
+// querier reads from either the database or a transaction
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// syncGroupSubscriptions returns the podcasts that each of the devices are
+// subscribed to and the sorted union of all of them
+func syncGroupSubscriptions(q querier, deviceIds []int) (map[int][]string, []string, error) {
+	subscribed := map[int][]string{}
+	all := []string{}
+
+	for _, id := range deviceIds {
+		subs := []Subscription{}
+
+		rows, err := q.Query("select podcast, action from subscriptions where device_id = ? ORDER BY id", id)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error getting subscriptions of device %d", id)
+		}
+
+		for rows.Next() {
+			sub := Subscription{}
+			if err := rows.Scan(&sub.Podcast, &sub.Action); err != nil {
+				rows.Close()
+				return nil, nil, errors.Wrap(err, "error scanning subscriptions")
+			}
+			subs = append(subs, sub)
+		}
+		rows.Close()
+
+		add, _ := SubscriptionDiff(subs)
+		subscribed[id] = add
+		all = append(all, add...)
+	}
+
+	all = unique(all)
+	sort.Strings(all)
+
+	return subscribed, all, nil
+}
+
+// GetSyncGroupStatus returns the state of the sync group id. A group whose
+// devices are all subscribed to the same podcasts is synced, otherwise the
+// devices that are missing podcasts are listed as out of date. The stored
+// status is only updated when subscriptions change, see updateSyncGroupStatus.
+func (s *SQLite) GetSyncGroupStatus(id int) (SyncGroupStatus, error) {
+	db := s.db
+
+	status := SyncGroupStatus{Id: id, Devices: []string{}, OutOfDate: []OutOfDateDevice{}}
+
+	var (
+		storedStatus string
+		syncTime     time.Time
+	)
+	err := db.QueryRow("SELECT sync_status, sync_time FROM device_sync_groups WHERE id = ?", id).Scan(&storedStatus, &syncTime)
+	if err != nil {
+		return status, errors.Wrapf(err, "error getting sync group %d", id)
+	}
+
+	rows, err := db.Query("SELECT id, name FROM devices WHERE device_sync_group_id = ? ORDER BY name", id)
+	if err != nil {
+		return status, errors.Wrapf(err, "error getting devices of sync group %d", id)
+	}
+
+	deviceIds := []int{}
+	names := map[int]string{}
+	for rows.Next() {
+		var (
+			deviceId int
+			name     string
+		)
+		if err := rows.Scan(&deviceId, &name); err != nil {
+			rows.Close()
+			return status, errors.Wrap(err, "error scanning devices")
+		}
+
+		deviceIds = append(deviceIds, deviceId)
+		names[deviceId] = name
+		status.Devices = append(status.Devices, name)
+	}
+	rows.Close()
+
+	subscribed, all, err := syncGroupSubscriptions(db, deviceIds)
+	if err != nil {
+		return status, err
+	}
+
+	for _, deviceId := range deviceIds {
+		current := map[string]bool{}
+		for _, v := range subscribed[deviceId] {
+			current[v] = true
+		}
+
+		missing := []string{}
+		for _, v := range all {
+			if !current[v] {
+				missing = append(missing, v)
+			}
+		}
+
+		if len(missing) > 0 {
+			status.OutOfDate = append(status.OutOfDate, OutOfDateDevice{Name: names[deviceId], Missing: missing})
+		}
+	}
+
+	switch {
+	case len(status.OutOfDate) == 0:
+		status.Status = SyncStatusSynced
+	case storedStatus == SyncStatusPending:
+		status.Status = SyncStatusPending
+	default:
+		status.Status = SyncStatusOutOfDate
+	}
+
+	if status.Status != SyncStatusPending {
+		status.LastSync = &syncTime
+	}
+
+	return status, nil
+}
+
+// updateSyncGroupStatuses stores the status of the sync groups of deviceIds
+// when it changed, so that transitions can be followed in the logs. Devices
+// that end up with the same subscriptions on their own are converged as of
+// now.
+func (s *SQLite) updateSyncGroupStatuses(deviceIds []int) error {
+	db := s.db
+
+	if len(deviceIds) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT DISTINCT g.id, g.sync_status FROM device_sync_groups g JOIN devices d ON d.device_sync_group_id = g.id WHERE d.id IN (?)", deviceIds)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return errors.Wrap(err, "error getting sync groups of devices")
+	}
+
+	stored := map[int]string{}
+	for rows.Next() {
+		var (
+			id     int
+			status string
+		)
+		if err := rows.Scan(&id, &status); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error scanning sync groups")
+		}
+		stored[id] = status
+	}
+	rows.Close()
+
+	for id, storedStatus := range stored {
+		status, err := s.GetSyncGroupStatus(id)
+		if err != nil {
+			return err
+		}
+		if status.Status == storedStatus {
 			continue
 		}
-		sub.Timestamp.Time = time.Unix(timestampTime, 0)
 
-		subscriptions = append(subscriptions, sub)
+		slog.Info("sync group changed", "group_id", id, "from", storedStatus, "to", status.Status)
 
+		query := "UPDATE device_sync_groups SET sync_status = ? WHERE id = ?"
+		if status.Status == SyncStatusSynced {
+			query = "UPDATE device_sync_groups SET sync_status = ?, sync_time = CURRENT_TIMESTAMP WHERE id = ?"
+		}
+		_, err = db.Exec(query, status.Status, id)
+		if err != nil {
+			return errors.Wrap(err, "error updating sync status")
+		}
 	}
 
-	return subscriptions, nil
+	return nil
 }
 
-func unique(stringSlice []string) []string {
-	keys := make(map[string]bool)
-	list := []string{}
-	for _, entry := range stringSlice {
-		if _, value := keys[entry]; !value {
-			keys[entry] = true
-			list = append(list, entry)
+// StopDeviceSync takes in a device name and username to stop device sync
+func (s *SQLite) StopDeviceSync(deviceName string, username string) error {
+	db := s.db
+
+	_, err := db.Exec("UPDATE devices SET device_sync_group_id = NULL WHERE name = ? AND user_id = (SELECT id from users WHERE username = ?)", deviceName, username)
+	return err
+
+}
+
+// GetDeviceSyncGroupIds takes in a username and returns a SyncStatus and error
+func (s *SQLite) GetDeviceSyncGroupIds(username string) ([]int, error) {
+	var ids []int
+
+	db := s.db
+
+	rows, err := db.Query("select DISTINCT device_sync_group_id from devices WHERE user_id = (select id from users where username = ?);", username)
+	if err != nil {
+		return ids, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id *int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+
+		if id != nil {
+			ids = append(ids, *id)
 		}
 	}
-	return list
-}
 
-// GetDevicesInSyncGroupFromDeviceId takes in a deviceId and returns a list of
-// deviceIds that belongs to the same syncgroup including itself. If there's no
-// sync group, it should return a nil to signal that the device has no existing
-// sync_group, but not return an error as it is returning a valid position.
-func (s *SQLite) GetDevicesInSyncGroupFromDeviceId(deviceId int) ([]int, error) {
+	return ids, nil
+}
 
-	var deviceSyncGroupId sql.NullInt64
-	var returnedDeviceId int
-	var devicesFromSyncGroup []int
+// GetDeviceNameFromDeviceSyncGroupId takes in a device_sync_group_id and
+// returns a string slice of device names that belongs to the group
+func (s *SQLite) GetDeviceNameFromDeviceSyncGroupId(id int) ([]string, error) {
+	var names []string
 	db := s.db
 
-	// get the sync group id
-	err := db.QueryRow("select device_sync_group_id from devices where id =? LIMIT 1", deviceId).Scan(&deviceSyncGroupId)
+	rows, err := db.Query("select name from devices where device_sync_group_id = ?;", id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		} else {
-			log.Printf("error getting device_sync_group_id: %#v", err)
-			return nil, err
+		return names, err
+	}
+
+	for rows.Next() {
+
+		var name string
+		if err := rows.Scan(&name); err != nil {
+
+			return names, err
 		}
+
+		names = append(names, name)
+
 	}
 
-	rows, err := db.Query("select id from devices WHERE device_sync_group_id = ?", deviceSyncGroupId)
+	return names, nil
+
+}
+
+func (s *SQLite) GetNotSyncedDevices(username string) ([]string, error) {
+	var devices []string
+
+	db := s.db
+
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return nil, err
+	}
+	deviceGroupIds, err := s.GetDeviceSyncGroupIds(username)
 	if err != nil {
-		log.Printf("error getting devices from sync group: %#v", err)
 		return nil, err
 	}
 
+	intValues := []int{}
+	for _, v := range deviceGroupIds {
+		intValues = append(intValues, v)
+	}
+
+	// sqlx.In rejects an empty list, none of the devices are synced then
+	query, args := "select name from devices where user_id = ?;", []interface{}{userId}
+	if len(intValues) > 0 {
+		query, args, err = sqlx.In("select name from devices where user_id = ? AND id NOT IN (select id FROM devices WHERE device_sync_group_id IN (?));", userId, intValues)
+		if err != nil {
+			return devices, err
+		}
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return devices, err
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		rows.Scan(&returnedDeviceId)
-		devicesFromSyncGroup = append(devicesFromSyncGroup, returnedDeviceId)
+
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			slog.Error("error scanning not synced devices", "username", username, "error", err)
+			return devices, err
+		}
+
+		devices = append(devices, name)
 
 	}
 
-	return devicesFromSyncGroup, nil
+	return devices, nil
+
 }
 
-// AddSyncGroup takes in a slice of device_ids and add them to a SyncGroup if
-// they do not exist. Returns error if it already existed.
+// UpdatePodcast stores the metadata and tags of a podcast as fetched from its
+// feed, replacing the ones from the previous fetch
+func (s *SQLite) UpdatePodcast(podcast Podcast) error {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO podcasts (url, title, author, description, website, logo_url, fetched_at) VALUES (?,?,?,?,?,?,?) ON CONFLICT (url) DO UPDATE SET title = excluded.title, author = excluded.author, description = excluded.description, website = excluded.website, logo_url = excluded.logo_url, fetched_at = excluded.fetched_at", podcast.URL, podcast.Title, podcast.Author, podcast.Description, podcast.Website, podcast.LogoURL, strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		return errors.Wrap(err, "error updating podcast")
+	}
+
+	_, err = tx.Exec("DELETE FROM podcast_tags WHERE podcast = ?", podcast.URL)
+	if err != nil {
+		return errors.Wrap(err, "error deleting podcast tags")
+	}
+
+	for _, tag := range podcast.Tags {
+		_, err = tx.Exec("INSERT OR IGNORE INTO podcast_tags (podcast, tag, title) VALUES (?,?,?)", podcast.URL, tag.Tag, tag.Title)
+		if err != nil {
+			return errors.Wrap(err, "error adding podcast tag")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RetrieveStalePodcasts returns the podcasts that users are subscribed to
+// whose metadata was never fetched or fetched before fetchedBefore
+func (s *SQLite) RetrieveStalePodcasts(fetchedBefore time.Time) ([]string, error) {
+	db := s.db
+	urls := []string{}
+
+	rows, err := db.Query("SELECT DISTINCT s.podcast FROM current_subscriptions s LEFT JOIN podcasts p ON p.url = s.podcast WHERE p.fetched_at IS NULL OR CAST(p.fetched_at AS INTEGER) < ? ORDER BY s.podcast", fetchedBefore.Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting stale podcasts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string
+		err := rows.Scan(&url)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning stale podcasts")
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+// RetrievePodcast returns a podcast that users are subscribed to, or
+// sql.ErrNoRows when there is none
+func (s *SQLite) RetrievePodcast(url string) (Podcast, error) {
+	podcasts, err := s.retrievePodcasts("instance_subscriptions", "s.podcast = ?", []interface{}{url}, 1)
+	if err != nil {
+		return Podcast{}, err
+	}
+
+	if len(podcasts) == 0 {
+		return Podcast{}, sql.ErrNoRows
+	}
+
+	return podcasts[0], nil
+}
+
+// RetrieveToplist returns the count podcasts with the most subscribers
+func (s *SQLite) RetrieveToplist(count int) ([]Podcast, error) {
+	return s.retrievePodcasts("instance_subscriptions", "1 = 1", nil, count)
+}
+
+// RetrievePublicToplist returns the count podcasts with the most subscribers
+// out of the subscriptions that users made public, which is the toplist that
+// may leave the instance
+func (s *SQLite) RetrievePublicToplist(count int) ([]Podcast, error) {
+	return s.retrievePodcasts("public_subscriptions", "1 = 1", nil, count)
+}
+
+// SearchPodcasts returns the count podcasts with the most subscribers whose
+// url, title, author or description contain query
+func (s *SQLite) SearchPodcasts(query string, count int) ([]Podcast, error) {
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+
+	return s.retrievePodcasts("instance_subscriptions", `s.podcast LIKE ? ESCAPE '\' OR p.title LIKE ? ESCAPE '\' OR p.author LIKE ? ESCAPE '\' OR p.description LIKE ? ESCAPE '\'`, []interface{}{like, like, like, like}, count)
+}
+
+// RetrieveTagPodcasts returns the count podcasts with the most subscribers
+// that have tag
+func (s *SQLite) RetrieveTagPodcasts(tag string, count int) ([]Podcast, error) {
+	return s.retrievePodcasts("instance_subscriptions", "s.podcast IN (SELECT podcast FROM podcast_tags WHERE tag = ?)", []interface{}{tag}, count)
+}
+
+// retrievePodcasts returns the count podcasts matching the conditions that
+// have the most subscribers in the subscriptions view, counting every user
+// once no matter how many of their devices are subscribed
+func (s *SQLite) retrievePodcasts(subscriptions string, conditions string, args []interface{}, count int) ([]Podcast, error) {
+	db := s.db
+	podcasts := []Podcast{}
+
+	rows, err := db.Query("SELECT s.podcast, COALESCE(p.title, ''), COALESCE(p.author, ''), COALESCE(p.description, ''), COALESCE(p.website, ''), COALESCE(p.logo_url, ''), COUNT(DISTINCT s.user_id) AS subscribers FROM "+subscriptions+" s LEFT JOIN podcasts p ON p.url = s.podcast WHERE ("+conditions+") GROUP BY s.podcast ORDER BY subscribers DESC, s.podcast LIMIT ?", append(args, count)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting podcasts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := Podcast{}
+		err := rows.Scan(&p.URL, &p.Title, &p.Author, &p.Description, &p.Website, &p.LogoURL, &p.Subscribers)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning podcasts")
+		}
+		podcasts = append(podcasts, p)
+	}
+
+	return podcasts, rows.Err()
+}
+
+// RetrieveTopTags returns the count tags of the most podcasts that users are
+// subscribed to
+func (s *SQLite) RetrieveTopTags(count int) ([]Tag, error) {
+	db := s.db
+	tags := []Tag{}
+
+	rows, err := db.Query("SELECT tag, MIN(title), COUNT(DISTINCT podcast) AS usage FROM podcast_tags WHERE podcast IN (SELECT podcast FROM instance_subscriptions) GROUP BY tag ORDER BY usage DESC, tag LIMIT ?", count)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting tags")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Tag{}
+		err := rows.Scan(&t.Tag, &t.Title, &t.Usage)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning tags")
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// RetrieveSuggestions returns the count podcasts that username is not
+// subscribed to that are the most co-subscribed with the ones they are, out
+// of the subscriptions of the other users that opted in to suggestions. Users
+// that have not opted in get no suggestions.
 //
-// Each device can only have one sync group at a time. Sync group's purpose is
-// to link devices together so that any new podcast subscriptions will always be
-// setup and installed on each device
-func (s *SQLite) AddSyncGroup(device_names []string, username string) error {
+// This is item-to-item collaborative filtering: a podcast scores the sum of
+// its cosine similarity with each podcast of the user, which is the number of
+// users subscribed to both over the square root of the product of their
+// numbers of subscribers.
+func (s *SQLite) RetrieveSuggestions(username string, count int) ([]Podcast, error) {
+	db := s.db
 
-	var device_ids []int
 	var userId int
+	var enabled bool
+	err := db.QueryRow("SELECT id, suggestions FROM users WHERE username = ?", username).Scan(&userId, &enabled)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user")
+	}
 
-	db := s.db
+	if !enabled {
+		return []Podcast{}, nil
+	}
 
-	ctx := context.Background()
+	// shared is the subscriptions of the other users that opted in, counting
+	// every user once no matter how many of their devices are subscribed
+	shared := "SELECT DISTINCT s.user_id, s.podcast FROM instance_subscriptions s JOIN users u ON u.id = s.user_id WHERE u.suggestions = 1 AND u.disabled = 0 AND s.user_id != ?"
+	mine := "SELECT podcast FROM current_subscriptions WHERE user_id = ?"
 
-	tx, err := db.BeginTx(ctx, nil)
+	subscribers := map[string]int{}
+	rows, err := db.Query("SELECT podcast, COUNT(*) FROM ("+shared+") GROUP BY podcast", userId)
 	if err != nil {
-		return err
+		return nil, errors.Wrap(err, "error counting subscribers")
 	}
+	defer rows.Close()
 
-	defer tx.Rollback()
+	for rows.Next() {
+		var podcast string
+		var n int
+		err := rows.Scan(&podcast, &n)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning subscribers")
+		}
+		subscribers[podcast] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	err = tx.QueryRow("select id from users where username = ?", username).Scan(&userId)
+	rows, err = db.Query("WITH shared AS ("+shared+") SELECT m.podcast, o.podcast, COUNT(*) FROM shared m JOIN shared o ON o.user_id = m.user_id WHERE m.podcast IN ("+mine+") AND o.podcast NOT IN ("+mine+") GROUP BY m.podcast, o.podcast", userId, userId, userId)
 	if err != nil {
-		log.Printf("error retrieving user info: %#v", err)
-		return err
+		return nil, errors.Wrap(err, "error counting co-subscriptions")
 	}
+	defer rows.Close()
 
-	for _, v := range device_names {
-		i, err := s.GetDeviceIdFromName(v, username)
+	scores := map[string]float64{}
+	for rows.Next() {
+		var podcast, candidate string
+		var n int
+		err := rows.Scan(&podcast, &candidate, &n)
 		if err != nil {
-			return err
+			return nil, errors.Wrap(err, "error scanning co-subscriptions")
 		}
-
-		device_ids = append(device_ids, i)
+		scores[candidate] += float64(n) / math.Sqrt(float64(subscribers[podcast]*subscribers[candidate]))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("device_ids is %#v", device_ids)
-	// get device_ids
+	candidates := []string{}
+	for candidate := range scores {
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if scores[candidates[i]] != scores[candidates[j]] {
+			return scores[candidates[i]] > scores[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
 
-	// do a check if device_ids all belong to the user. If it doesn't, send out an
-	// error
-	// TODO FIX THIS
-	//	return errors.New("something screwed up")
+	suggestions := []Podcast{}
+	if len(candidates) == 0 {
+		return suggestions, nil
+	}
 
-	// getDeviceSyncGroup takes in a deviceId and returns the device_sync_group_id
-	// of a device if it exists, if not it returns nil
-	var getDeviceSyncGroup = func(deviceId int) *int {
+	// the metadata and subscriber counts are the ones of the directory
+	query, args, err := sqlx.In("s.podcast IN (?)", candidates)
+	if err != nil {
+		return nil, err
+	}
+	podcasts, err := s.retrievePodcasts("instance_subscriptions", query, args, len(candidates))
+	if err != nil {
+		return nil, err
+	}
 
-		var deviceSyncGroupId *int
+	byURL := map[string]Podcast{}
+	for _, p := range podcasts {
+		byURL[p.URL] = p
+	}
+	for _, candidate := range candidates {
+		if p, ok := byURL[candidate]; ok {
+			suggestions = append(suggestions, p)
+		}
+	}
 
-		err := tx.QueryRow("SELECT device_sync_group_id from devices WHERE id = ? AND user_id = ?", deviceId, userId).Scan(&deviceSyncGroupId)
-		if err != nil {
+	return suggestions, nil
+}
 
-			log.Printf("error selecting sync group id: %#v", err)
-			return nil
-		}
+// RetrieveSettings returns the settings of a user for a scope and its target,
+// see SettingsTarget
+func (s *SQLite) RetrieveSettings(username string, scope string, target string) (map[string]interface{}, error) {
+	db := s.db
 
-		return deviceSyncGroupId
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user id from name")
 	}
 
-	// updateDeviceSyncGroup takes in a device_id and a device_sync_group_id to
-	// update the device with the new sync_group_id
-	var updateDeviceSyncGroup = func(deviceId *int, newSyncGroup *int) error {
-
-		if deviceId == nil {
-			return errors.New("no device provided")
+	rows, err := db.Query("SELECT key, value FROM settings WHERE user_id = ? AND scope = ? AND target = ?", userId, scope, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting settings")
+	}
+	defer rows.Close()
 
+	settings := map[string]interface{}{}
+	for rows.Next() {
+		var key, value string
+		err := rows.Scan(&key, &value)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning settings")
 		}
 
-		result, err := tx.Exec("UPDATE devices SET device_sync_group_id = ? WHERE id = ?", newSyncGroup, deviceId)
+		var v interface{}
+		err = json.Unmarshal([]byte(value), &v)
 		if err != nil {
-			return err
+			return nil, errors.Wrapf(err, "error decoding setting %s", key)
 		}
+		settings[key] = v
+	}
 
-		if affected, _ := result.RowsAffected(); affected == 0 {
+	return settings, rows.Err()
+}
 
-			return fmt.Errorf("expecting device to be updated with new device_sync_group but none is changed; is there a device_id %d", deviceId)
-		}
-		return nil
+// UpdateSettings sets and removes settings of a user for a scope and its
+// target, and returns the settings that result
+func (s *SQLite) UpdateSettings(username string, scope string, target string, set map[string]interface{}, remove []string) (map[string]interface{}, error) {
+	db := s.db
 
+	userId, err := s.GetUserIdFromName(username)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user id from name")
 	}
 
-	// createDeviceSyncGroup takes in 2 device_ids and creates a syncgroup linking
-	// both of the devices together
-	var createDeviceSyncGroup = func(firstDeviceId *int, secondDeviceId *int) error {
-
-		var lastInsertId *int
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-		err = tx.QueryRow("insert into device_sync_groups (sync_status) VALUES ('pending') RETURNING id").Scan(&lastInsertId)
+	for key, v := range set {
+		value, err := json.Marshal(v)
 		if err != nil {
-			return err
+			return nil, errors.Wrapf(err, "error encoding setting %s", key)
 		}
 
-		err = updateDeviceSyncGroup(firstDeviceId, lastInsertId)
+		_, err = tx.Exec("INSERT OR REPLACE INTO settings (user_id, scope, target, key, value) VALUES (?,?,?,?,?)", userId, scope, target, key, string(value))
 		if err != nil {
-			return err
+			return nil, errors.Wrap(err, "error setting setting")
 		}
-		err = updateDeviceSyncGroup(secondDeviceId, lastInsertId)
+	}
+
+	for _, key := range remove {
+		_, err = tx.Exec("DELETE FROM settings WHERE user_id = ? AND scope = ? AND target = ? AND key = ?", userId, scope, target, key)
 		if err != nil {
-			return err
+			return nil, errors.Wrap(err, "error removing setting")
 		}
-
-		return nil
 	}
 
-	// take the first device as the first device
-	firstDeviceId := device_ids[0]
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 
-	for _, currentDeviceId := range device_ids[1:] {
+	return s.RetrieveSettings(username, scope, target)
+}
 
-		currentDeviceSyncGroupId := getDeviceSyncGroup(currentDeviceId)
-		firstDeviceSyncGroupId := getDeviceSyncGroup(firstDeviceId)
+// RetrieveSubscriptionPrivacy returns the privacy that applies to the
+// subscription of a user to a podcast, see SettingPrivacy
+func (s *SQLite) RetrieveSubscriptionPrivacy(username string, podcast string) (string, error) {
+	db := s.db
 
-		// if both devices belong to a different sync group, assign the
-		// sync group in the current_device to the other sync group
-		if currentDeviceSyncGroupId != nil && firstDeviceSyncGroupId != nil {
+	var value string
+	err := db.QueryRow(`SELECT COALESCE(
+		(SELECT value FROM settings WHERE user_id = u.id AND scope = 'podcast' AND target = ? AND key = 'privacy'),
+		(SELECT value FROM settings WHERE user_id = u.id AND scope = 'account' AND target = '' AND key = 'privacy'),
+		'"public"') FROM users u WHERE u.username = ?`, podcast, username).Scan(&value)
+	if err != nil {
+		return "", err
+	}
 
-			// update deviceSyncGroup id with firstDeviceSyncGroup id
-			err = updateDeviceSyncGroup(&currentDeviceId, firstDeviceSyncGroupId)
-			if err != nil {
-				return errors.Wrapf(err, "error updating device %d sync group with %d", currentDeviceId, firstDeviceSyncGroupId)
-			}
+	var privacy string
+	err = json.Unmarshal([]byte(value), &privacy)
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding privacy")
+	}
 
-		} else if currentDeviceSyncGroupId == nil && firstDeviceSyncGroupId == nil {
-			// if both devices have no sync groups, create one and assign it to both
-			// of them
+	return privacy, nil
+}
 
-			log.Printf("no sync groups found, creating a new one")
-			err = createDeviceSyncGroup(&firstDeviceId, &currentDeviceId)
-			if err != nil {
-				return errors.Wrapf(err, "error creating a new device sync group for device id %d and %d", firstDeviceId, currentDeviceId)
-			}
+// SetUserFederated opts a user in or out of being an ActivityPub actor that
+// publishes their subscriptions
+func (s *SQLite) SetUserFederated(username string, enabled bool) error {
+	db := s.db
 
-		} else if currentDeviceSyncGroupId == nil && firstDeviceSyncGroupId != nil {
-			// if current_device has no sync group but there's an existing sync group
-			// on the other device, assign the sync group to current_device
+	result, err := db.Exec("UPDATE users SET federated = ? WHERE username = ?", enabled, username)
+	if err != nil {
+		return err
+	}
 
-			err = updateDeviceSyncGroup(&currentDeviceId, firstDeviceSyncGroupId)
-			if err != nil {
-				return err
-			}
+	return expectAffected(result, username)
+}
 
-		} else if currentDeviceSyncGroupId != nil && firstDeviceSyncGroupId == nil {
-			// if current_device has a sync group but the other device has no sync
-			// group, assign the current_device's sync group to the other device
+// IsUserFederated returns whether a user opted in to federation, disabled
+// users never are
+func (s *SQLite) IsUserFederated(username string) (bool, error) {
+	db := s.db
 
-			err = updateDeviceSyncGroup(&firstDeviceId, currentDeviceSyncGroupId)
-			if err != nil {
-				return err
-			}
+	var federated bool
+	err := db.QueryRow("SELECT federated AND NOT disabled FROM users WHERE username = ?", username).Scan(&federated)
+	if err != nil {
+		return false, err
+	}
 
-		}
+	return federated, nil
+}
 
-	}
+// RetrieveFederationKey returns the PEM encoded private key of a local actor,
+// or sql.ErrNoRows when it has none yet
+func (s *SQLite) RetrieveFederationKey(actor string) (string, error) {
+	db := s.db
 
-	err = tx.Commit()
+	var key string
+	err := db.QueryRow("SELECT private_key FROM federation_keys WHERE actor = ?", actor).Scan(&key)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return key, nil
+}
+
+// AddFederationKey stores the private key of a local actor, unless it already
+// has one
+func (s *SQLite) AddFederationKey(actor string, privateKey string) error {
+	db := s.db
 
+	_, err := db.Exec("INSERT OR IGNORE INTO federation_keys (actor, private_key) VALUES (?,?)", actor, privateKey)
+	return err
 }
 
-// StopDeviceSync takes in a device name and username to stop device sync
-func (s *SQLite) StopDeviceSync(deviceName string, username string) error {
+// AddFederationFollower records that a remote actor follows a local actor
+func (s *SQLite) AddFederationFollower(actor string, follower FederationActor) error {
 	db := s.db
 
-	_, err := db.Exec("UPDATE devices SET device_sync_group_id = NULL WHERE name = ? AND user_id = (SELECT id from users WHERE username = ?)", deviceName, username)
+	_, err := db.Exec("INSERT INTO federation_followers (actor, follower, inbox) VALUES (?,?,?) ON CONFLICT (actor, follower) DO UPDATE SET inbox = excluded.inbox", actor, follower.Id, follower.Inbox)
 	return err
+}
+
+func (s *SQLite) DeleteFederationFollower(actor string, follower string) error {
+	db := s.db
 
+	_, err := db.Exec("DELETE FROM federation_followers WHERE actor = ? AND follower = ?", actor, follower)
+	return err
 }
 
-// GetDeviceSyncGroupIds takes in a username and returns a SyncStatus and error
-func (s *SQLite) GetDeviceSyncGroupIds(username string) ([]int, error) {
-	var ids []int
+func (s *SQLite) RetrieveFederationFollowers(actor string) ([]FederationActor, error) {
+	return s.retrieveFederationActors("SELECT follower, inbox, 1 FROM federation_followers WHERE actor = ? ORDER BY follower", actor)
+}
 
+// AddFederationFollowing records that a local actor sent a follow to a remote
+// actor, which is accepted once the remote actor replies
+func (s *SQLite) AddFederationFollowing(actor string, following FederationActor) error {
 	db := s.db
 
-	rows, err := db.Query("select DISTINCT device_sync_group_id from devices WHERE user_id = (select id from users where username = ?);", username)
+	_, err := db.Exec("INSERT INTO federation_following (actor, following, inbox, accepted) VALUES (?,?,?,0) ON CONFLICT (actor, following) DO UPDATE SET inbox = excluded.inbox", actor, following.Id, following.Inbox)
+	return err
+}
+
+// AcceptFederationFollowing marks the follow of a remote actor as accepted,
+// returning sql.ErrNoRows when the local actor never followed it
+func (s *SQLite) AcceptFederationFollowing(actor string, following string) error {
+	db := s.db
+
+	result, err := db.Exec("UPDATE federation_following SET accepted = 1 WHERE actor = ? AND following = ?", actor, following)
 	if err != nil {
-		return ids, err
+		return err
 	}
 
+	return expectAffected(result, following)
+}
+
+func (s *SQLite) RetrieveFederationFollowing(actor string) ([]FederationActor, error) {
+	return s.retrieveFederationActors("SELECT following, inbox, accepted FROM federation_following WHERE actor = ? ORDER BY following", actor)
+}
+
+func (s *SQLite) retrieveFederationActors(query string, actor string) ([]FederationActor, error) {
+	db := s.db
+	actors := []FederationActor{}
+
+	rows, err := db.Query(query, actor)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting federation actors")
+	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id *int
-		if err := rows.Scan(&id); err != nil {
-			return ids, err
-		}
-
-		if id != nil {
-			ids = append(ids, *id)
+		a := FederationActor{}
+		err := rows.Scan(&a.Id, &a.Inbox, &a.Accepted)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning federation actors")
 		}
+		actors = append(actors, a)
 	}
 
-	return ids, nil
+	return actors, rows.Err()
 }
 
-// GetDeviceNameFromDeviceSyncGroupId takes in a device_sync_group_id and
-// returns a string slice of device names that belongs to the group
-func (s *SQLite) GetDeviceNameFromDeviceSyncGroupId(id int) ([]string, error) {
-	var names []string
+// AddFederationActivity stores an activity in the outbox or the inbox of a
+// local actor
+func (s *SQLite) AddFederationActivity(actor string, box string, activity FederationActivity) error {
 	db := s.db
 
-	rows, err := db.Query("select name from devices where device_sync_group_id = ?;", id)
+	_, err := db.Exec("INSERT INTO federation_activities (actor, box, activity_id, type, sender, payload, created_at) VALUES (?,?,?,?,?,?,?)", actor, box, activity.Id, activity.Type, activity.Actor, activity.Payload, strconv.FormatInt(activity.CreatedAt.Unix(), 10))
+	return err
+}
+
+// RetrieveFederationActivities returns the count latest activities in the
+// outbox or the inbox of a local actor, newest first
+func (s *SQLite) RetrieveFederationActivities(actor string, box string, count int) ([]FederationActivity, error) {
+	db := s.db
+	activities := []FederationActivity{}
+
+	rows, err := db.Query("SELECT activity_id, type, sender, payload, created_at FROM federation_activities WHERE actor = ? AND box = ? ORDER BY id DESC LIMIT ?", actor, box, count)
 	if err != nil {
-		return names, err
+		return nil, errors.Wrap(err, "error getting federation activities")
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-
-		var name string
-		if err := rows.Scan(&name); err != nil {
-
-			return names, err
+		a := FederationActivity{}
+		var createdAt int64
+		err := rows.Scan(&a.Id, &a.Type, &a.Actor, &a.Payload, &createdAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning federation activities")
 		}
-
-		names = append(names, name)
-
+		a.CreatedAt = time.Unix(createdAt, 0).UTC()
+		activities = append(activities, a)
 	}
 
-	return names, nil
-
+	return activities, rows.Err()
 }
 
-func (s *SQLite) GetNotSyncedDevices(username string) ([]string, error) {
-	var devices []string
-
+// ReplaceFederatedToplist caches the toplist that a peer instance published,
+// replacing the one it published before
+func (s *SQLite) ReplaceFederatedToplist(peer string, podcasts []Podcast, receivedAt time.Time) error {
 	db := s.db
 
-	userId, err := s.GetUserIdFromName(username)
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	deviceGroupIds, err := s.GetDeviceSyncGroupIds(username)
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM federated_toplists WHERE peer = ?", peer)
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "error deleting federated toplist")
 	}
 
-	intValues := []int{}
-	for _, v := range deviceGroupIds {
-		intValues = append(intValues, v)
+	for _, p := range podcasts {
+		_, err = tx.Exec("INSERT OR REPLACE INTO federated_toplists (peer, podcast, title, subscribers, received_at) VALUES (?,?,?,?,?)", peer, p.URL, p.Title, p.Subscribers, strconv.FormatInt(receivedAt.Unix(), 10))
+		if err != nil {
+			return errors.Wrap(err, "error adding federated toplist podcast")
+		}
 	}
 
-	query, args, err := sqlx.In("select name from devices where user_id = ? AND id NOT IN (select id FROM devices WHERE device_sync_group_id IN (?));", userId, intValues)
+	return tx.Commit()
+}
 
-	rows, err := db.Query(query, args...)
+// RetrieveFederatedToplist returns the count podcasts with the most
+// subscribers on this instance and on the peers whose toplists were received
+// since receivedSince. Peers only publish the numbers of subscribers, so the
+// subscribers of the instance are counted the same way.
+func (s *SQLite) RetrieveFederatedToplist(count int, receivedSince time.Time) ([]Podcast, error) {
+	db := s.db
+	podcasts := []Podcast{}
+
+	rows, err := db.Query(`SELECT t.podcast, COALESCE(NULLIF(p.title, ''), MAX(t.title)), COALESCE(p.author, ''), COALESCE(p.description, ''), COALESCE(p.website, ''), COALESCE(p.logo_url, ''), SUM(t.subscribers) AS subscribers FROM (
+		SELECT podcast, '' AS title, COUNT(DISTINCT user_id) AS subscribers FROM instance_subscriptions GROUP BY podcast
+		UNION ALL
+		SELECT podcast, title, subscribers FROM federated_toplists WHERE CAST(received_at AS INTEGER) >= ?
+	) t LEFT JOIN podcasts p ON p.url = t.podcast GROUP BY t.podcast ORDER BY subscribers DESC, t.podcast LIMIT ?`, receivedSince.Unix(), count)
 	if err != nil {
-		return devices, err
+		return nil, errors.Wrap(err, "error getting federated toplist")
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			fmt.Printf("error scanning rows: %#v", err)
-			return devices, err
+		p := Podcast{}
+		err := rows.Scan(&p.URL, &p.Title, &p.Author, &p.Description, &p.Website, &p.LogoURL, &p.Subscribers)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning federated toplist")
 		}
+		podcasts = append(podcasts, p)
+	}
 
-		devices = append(devices, name)
+	return podcasts, rows.Err()
+}
 
+// deleteFederationActor removes the keys, followers, follows and activities of
+// a local actor
+func deleteFederationActor(tx *sql.Tx, actor string) error {
+	for _, table := range []string{"federation_keys", "federation_followers", "federation_following", "federation_activities"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE actor = ?", actor)
+		if err != nil {
+			return errors.Wrapf(err, "error deleting %s of %s", table, actor)
+		}
 	}
 
-	return devices, nil
-
+	return nil
 }
@@ -2,11 +2,17 @@ package data
 
 import (
 	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/utils/strings/slices"
 )
 
-func cleanup(t *testing.T, db *sql.DB) {
+func cleanup(t testing.TB, db *sql.DB) {
 	_, err := db.Exec("DELETE FROM users")
 	if err != nil {
 		t.Error(err)
@@ -29,10 +35,24 @@ func cleanup(t *testing.T, db *sql.DB) {
 	if err != nil {
 		t.Error(err)
 	}
-	_, err = db.Exec("DELETE FROM device_sync_group_devices")
+	_, err = db.Exec("DELETE FROM audit_events")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = db.Exec("DELETE FROM podcast_tags")
 	if err != nil {
 		t.Error(err)
 	}
+	_, err = db.Exec("DELETE FROM podcasts")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, table := range []string{"federation_keys", "federation_followers", "federation_following", "federation_activities", "federated_toplists", "settings"} {
+		_, err = db.Exec("DELETE FROM " + table)
+		if err != nil {
+			t.Error(err)
+		}
+	}
 }
 
 // Test
@@ -110,6 +130,23 @@ func TestAddSubscriptionHistory(t *testing.T) {
 	// setup Device table
 
 	// Test that can pull the information
+
+	// actions that do not change the state of the device are not recorded
+	for _, action := range []string{"SUBSCRIBE", "UNSUBSCRIBE", "UNSUBSCRIBE"} {
+		s.Action = action
+		err = data.AddSubscriptionHistory(s)
+		if err != nil {
+			t.Fatalf("error adding subscription: %#v", err)
+		}
+	}
+
+	subs, err := data.RetrieveSubscriptionHistory("somename", "testdevice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 || subs[0].Action != "SUBSCRIBE" || subs[1].Action != "UNSUBSCRIBE" {
+		t.Errorf("expecting a single subscribe and unsubscribe to be recorded but got %#v", subs)
+	}
 }
 
 func TestUpdateOrCreateDevice(t *testing.T) {
@@ -203,3 +240,1385 @@ func TestAddSyncGroup(t *testing.T) {
 		t.Errorf("expecting id to be 3 but got %#v", id)
 	}
 }
+
+func TestDeleteUser(t *testing.T) {
+
+	var count int
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.AddUser("other", "pass", "other@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceId, err := data.AddDevice("username", "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.AddDevice("username", "device2", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDeviceId, err := data.AddDevice("other", "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddSyncGroup([]string{"device1", "device2"}, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []Subscription{
+		{User: "username", Devices: []int{deviceId}, Podcast: "podcasturl", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}},
+		{User: "other", Devices: []int{otherDeviceId}, Podcast: "podcasturl", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}},
+	} {
+		err = data.AddSubscriptionHistory(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = data.AddEpisodeActionHistory("username", EpisodeAction{Podcast: "podcasturl", Episode: "episode", Devices: []int{deviceId}, Action: "download", Timestamp: CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.DeleteUser("username")
+	if err != nil {
+		t.Fatalf("error deleting user: %#v", err)
+	}
+
+	for table, expected := range map[string]int{
+		"users":              1,
+		"devices":            1,
+		"subscriptions":      1,
+		"episode_actions":    0,
+		"device_sync_groups": 0,
+	} {
+		err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != expected {
+			t.Errorf("expecting %d rows left in %s but got %d", expected, table, count)
+		}
+	}
+
+	if err := data.DeleteUser("username"); err == nil {
+		t.Error("expecting an error deleting a user that does not exist")
+	}
+}
+
+func TestSetUserDisabled(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.SetUserDisabled("username", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.CheckUserPassword("username", "pass") {
+		t.Error("expecting disabled user to not be able to login")
+	}
+
+	err = data.SetUserDisabled("username", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.CheckUserPassword("username", "pass") {
+		t.Error("expecting enabled user to be able to login")
+	}
+
+	if err := data.SetUserDisabled("nobody", true); err == nil {
+		t.Error("expecting an error disabling a user that does not exist")
+	}
+}
+
+func TestMergeDevices(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldDeviceId, err := data.AddDevice("username", "oldphone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDeviceId, err := data.AddDevice("username", "newphone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []Subscription{
+		{User: "username", Devices: []int{oldDeviceId}, Podcast: "oldpodcast", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Unix(100, 0)}},
+		{User: "username", Devices: []int{newDeviceId}, Podcast: "newpodcast", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Unix(200, 0)}},
+		{User: "username", Devices: []int{oldDeviceId, newDeviceId}, Podcast: "sharedpodcast", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Unix(150, 0)}},
+	} {
+		err = data.AddSubscriptionHistory(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = data.UpdateSettings("username", SettingsScopeDevice, "oldphone", map[string]interface{}{"flattr": true, "volume": 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.UpdateSettings("username", SettingsScopeDevice, "newphone", map[string]interface{}{"volume": 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.MergeDevices("username", "oldphone", "newphone")
+	if err != nil {
+		t.Fatalf("error merging devices: %#v", err)
+	}
+
+	if _, err := data.GetDeviceIdFromName("oldphone", "username"); err == nil {
+		t.Error("expecting the merged device to be deleted")
+	}
+
+	subs, err := data.RetrieveDeviceSubscriptionsSlice("username", "newphone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 3 {
+		t.Errorf("expecting the merged device to have 3 subscriptions but got %#v", subs)
+	}
+
+	device, err := data.RetrieveDevice("username", "newphone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.LastActivity.Unix() != 200 {
+		t.Errorf("expecting last activity to be the latest subscription but got %s", device.LastActivity)
+	}
+
+	// the podcast that both devices were subscribed to is only counted once
+	err = data.AddSubscriptionHistory(Subscription{User: "username", Devices: []int{newDeviceId}, Podcast: "sharedpodcast", Action: "UNSUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Unix(300, 0)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs, err = data.RetrieveDeviceSubscriptionsSlice("username", "newphone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 || slices.Contains(subs, "sharedpodcast") {
+		t.Errorf("expecting a single unsubscribe to remove the shared podcast but got %#v", subs)
+	}
+
+	settings, err := data.RetrieveSettings("username", SettingsScopeDevice, "newphone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings["flattr"] != true || settings["volume"] != float64(1) {
+		t.Errorf("expecting the settings of the old device to be merged under the ones of the new device but got %#v", settings)
+	}
+
+	var orphaned int
+	err = db.QueryRow("SELECT COUNT(*) FROM settings WHERE scope = 'device' AND target = 'oldphone'").Scan(&orphaned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphaned != 0 {
+		t.Errorf("expecting the settings of the merged device to be removed but got %d", orphaned)
+	}
+}
+
+func TestGetSyncGroupStatus(t *testing.T) {
+
+	var id int
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceId, err := data.AddDevice("username", "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.AddDevice("username", "device2", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddSubscriptionHistory(Subscription{User: "username", Devices: []int{deviceId}, Podcast: "podcasturl", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddSyncGroup([]string{"device1", "device2"}, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.QueryRow("SELECT id from device_sync_groups LIMIT 1").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := data.GetSyncGroupStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Status != SyncStatusPending {
+		t.Errorf("expecting newly linked group to be %s but got %s", SyncStatusPending, status.Status)
+	}
+
+	if len(status.OutOfDate) != 1 || status.OutOfDate[0].Name != "device2" || status.OutOfDate[0].Missing[0] != "podcasturl" {
+		t.Errorf("expecting device2 to be missing podcasturl but got %#v", status.OutOfDate)
+	}
+
+	err = data.ConvergeSyncGroup("device1", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = data.GetSyncGroupStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Status != SyncStatusSynced || status.LastSync == nil {
+		t.Errorf("expecting converged group to be %s with a last sync time but got %#v", SyncStatusSynced, status)
+	}
+
+	// a change that only reaches one of the devices puts it out of date
+	err = data.AddSubscriptionHistory(Subscription{User: "username", Devices: []int{deviceId}, Podcast: "otherpodcasturl", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = data.GetSyncGroupStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Status != SyncStatusOutOfDate {
+		t.Errorf("expecting group to be %s but got %s", SyncStatusOutOfDate, status.Status)
+	}
+
+	storedStatus := func() string {
+		var stored string
+		err := db.QueryRow("SELECT sync_status FROM device_sync_groups WHERE id = ?", id).Scan(&stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	// the status is stored by the upload, not by retrieving it
+	if stored := storedStatus(); stored != SyncStatusOutOfDate {
+		t.Errorf("expecting the upload to store %s but got %s", SyncStatusOutOfDate, stored)
+	}
+
+	_, err = db.Exec("UPDATE device_sync_groups SET sync_status = ? WHERE id = ?", SyncStatusPending, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.GetSyncGroupStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedStatus(); stored != SyncStatusPending {
+		t.Errorf("expecting retrieving the status not to change it but got %s", stored)
+	}
+
+	// devices that end up with the same subscriptions on their own are synced
+	deviceId2, err := data.GetDeviceIdFromName("device2", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.AddSubscriptionHistory(Subscription{User: "username", Devices: []int{deviceId2}, Podcast: "otherpodcasturl", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedStatus(); stored != SyncStatusSynced {
+		t.Errorf("expecting the upload to store %s but got %s", SyncStatusSynced, stored)
+	}
+}
+
+// TestAddSubscriptionHistories tests that the status of a sync group is
+// updated once per batch of subscriptions rather than once per podcast
+func TestAddSubscriptionHistories(t *testing.T) {
+	queries := 0
+	data := NewObservedSQLite("testme.db", func(kind string, d time.Duration) {
+		if kind == QueryKindQuery {
+			queries++
+		}
+	})
+	defer data.Close()
+	cleanup(t, data.GetDB())
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := data.AddDevice("username", "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.AddDevice("username", "device2", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.LinkSyncGroup([]string{"device1", "device2"}, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the queries of a batch of podcasts that reach only one of the devices
+	batch := func(podcasts ...string) int {
+		subs := []Subscription{}
+		for _, podcast := range podcasts {
+			subs = append(subs, Subscription{User: "username", Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+		}
+
+		queries = 0
+		err := data.AddSubscriptionHistories(subs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queries
+	}
+
+	single := batch("podcast0")
+	podcasts := []string{}
+	for i := 1; i <= 10; i++ {
+		podcasts = append(podcasts, fmt.Sprintf("podcast%d", i))
+	}
+	// every podcast is looked up for its user and its subscription, the
+	// status is updated once
+	if many := batch(podcasts...); many-single > 2*(len(podcasts)-1) {
+		t.Errorf("expecting the status to be updated once but got %d queries for %d podcasts and %d for one", many, len(podcasts), single)
+	}
+
+	var stored string
+	err = data.GetDB().QueryRow("SELECT sync_status FROM device_sync_groups").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != SyncStatusOutOfDate {
+		t.Errorf("expecting the batch to store %s but got %s", SyncStatusOutOfDate, stored)
+	}
+
+	// nothing is added when one of the subscriptions fails
+	err = data.AddSubscriptionHistories([]Subscription{
+		{User: "username", Devices: []int{deviceId}, Podcast: "added", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}},
+		{User: "missing", Devices: []int{deviceId}, Podcast: "missing", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}},
+	})
+	if err == nil {
+		t.Error("expecting the subscriptions of a missing user to fail")
+	}
+	subs, err := data.RetrieveDeviceSubscriptionsSlice("username", "device1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(subs, "added") {
+		t.Errorf("expecting no subscription of a failed batch to be added but got %#v", subs)
+	}
+}
+
+// TestLinkSyncGroup tests that linked devices are converged with the link, and
+// that nothing is linked when one of the devices does not exist
+func TestLinkSyncGroup(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceIds := []int{}
+	for _, name := range []string{"device1", "device2"} {
+		deviceId, err := data.AddDevice("username", name, "", "laptop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deviceIds = append(deviceIds, deviceId)
+
+		err = data.AddSubscriptionHistory(Subscription{User: "username", Devices: []int{deviceId}, Podcast: name + "podcast", Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = data.LinkSyncGroup([]string{"device1", "unknown"}, "username")
+	if err == nil {
+		t.Errorf("expecting an unknown device not to be linked")
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM devices WHERE device_sync_group_id IS NOT NULL").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expecting no device to be linked but got %d", count)
+	}
+
+	err = data.LinkSyncGroup([]string{"device1", "device2"}, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"device1", "device2"} {
+		subs, err := data.RetrieveDeviceSubscriptionsSlice("username", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) != 2 {
+			t.Errorf("expecting %s to be subscribed to the podcasts of both devices but got %#v", name, subs)
+		}
+	}
+
+	var id int
+	err = db.QueryRow("SELECT device_sync_group_id FROM devices WHERE id = ?", deviceIds[0]).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := data.GetSyncGroupStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != SyncStatusSynced {
+		t.Errorf("expecting linked group to be %s but got %s", SyncStatusSynced, status.Status)
+	}
+}
+
+func TestSanitizeHistory(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceId, err := data.AddDevice("username", "device1", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// history stored before it was sanitized, which AddSubscriptionHistory
+	// would not record as is
+	for idx, sub := range []Subscription{
+		{Podcast: "HTTPS://Example.com/feed.xml", Action: "SUBSCRIBE"},
+		{Podcast: "https://example.com/feed.xml?utm_source=share", Action: "SUBSCRIBE"},
+		{Podcast: "ftp://example.com/feed.xml", Action: "SUBSCRIBE"},
+		{Podcast: "https://example.com/feed.xml", Action: "UNSUBSCRIBE"},
+	} {
+		_, err = db.Exec("INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp) SELECT user_id, id, ?, ?, ? FROM devices WHERE id = ?", sub.Podcast, sub.Action, 100+idx, deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changed, err := data.SanitizeHistory()
+	if err != nil {
+		t.Fatalf("error sanitizing history: %#v", err)
+	}
+
+	// the unsubscribe of a url that was never subscribed to is dropped, the
+	// first two subscriptions are rewritten, the third is rejected and the
+	// first one then repeats the second
+	if changed != 5 {
+		t.Errorf("expecting 5 rows to be changed but got %d", changed)
+	}
+
+	subs, err := data.RetrieveSubscriptionHistory("username", "device1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subs) != 1 || subs[0].Podcast != "https://example.com/feed.xml" || subs[0].Timestamp.Unix() != 101 {
+		t.Errorf("expecting the latest subscribe of the sanitized url but got %#v", subs)
+	}
+
+	// the device was subscribed to the podcast under its other urls
+	add, _ := SubscriptionDiff(subs)
+	if len(add) != 1 {
+		t.Errorf("expecting podcast to stay subscribed but got %#v", add)
+	}
+
+	changed, err = data.SanitizeHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed != 0 {
+		t.Errorf("expecting sanitized history to be left as is but %d rows changed", changed)
+	}
+}
+
+// TestRetrieveEpisodeActionHistory tests the filters of the episode action
+// history and that only the latest action of each episode is returned when
+// aggregated
+func TestRetrieveEpisodeActionHistory(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phone, err := data.AddDevice("username", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := data.AddDevice("username", "laptop", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position := 120
+	err = data.AddEpisodeActionHistories("username", []EpisodeAction{
+		{Podcast: "http://example.com/a.rss", Episode: "http://example.com/a1.mp3", Devices: []int{phone}, Action: EpisodeActionDownload, Timestamp: CustomTimestamp{Time: time.Unix(100, 0)}},
+		{Podcast: "http://example.com/a.rss", Episode: "http://example.com/a1.mp3", Devices: []int{laptop}, Action: EpisodeActionPlay, Position: &position, Timestamp: CustomTimestamp{Time: time.Unix(300, 0)}},
+		{Podcast: "http://example.com/a.rss", Episode: "http://example.com/a1.mp3", Devices: []int{phone}, Action: EpisodeActionDelete, Timestamp: CustomTimestamp{Time: time.Unix(200, 0)}},
+		{Podcast: "http://example.com/b.rss", Episode: "http://example.com/b1.mp3", Action: EpisodeActionNew, Timestamp: CustomTimestamp{Time: time.Unix(150, 0)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := data.RetrieveEpisodeActionHistory("username", "", "", time.Unix(0, 0), false, PositionPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 4 {
+		t.Errorf("expecting all 4 episode actions but got %#v", actions)
+	}
+
+	actions, err = data.RetrieveEpisodeActionHistory("username", "", "", time.Unix(0, 0), true, PositionPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions[0].Action != EpisodeActionNew || actions[1].Action != EpisodeActionPlay || actions[1].Device != "laptop" || *actions[1].Position != position {
+		t.Errorf("expecting the latest action of each episode but got %#v", actions)
+	}
+
+	actions, err = data.RetrieveEpisodeActionHistory("username", "http://example.com/a.rss", "phone", time.Unix(0, 0), true, PositionPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Action != EpisodeActionDelete {
+		t.Errorf("expecting the latest action of the phone but got %#v", actions)
+	}
+
+	actions, err = data.RetrieveEpisodeActionHistory("username", "", "", time.Now().Add(time.Hour), false, PositionPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 0 {
+		t.Errorf("expecting no episode actions to be uploaded since but got %#v", actions)
+	}
+}
+
+// TestRetrieveEpisodeActionHistoryPositionPolicy tests that the position of
+// the aggregated play actions is picked by the position policy, among the
+// actions that the filters select
+func TestRetrieveEpisodeActionHistoryPositionPolicy(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := data.GetUserPositionPolicy("username")
+	if err != nil || policy != "" {
+		t.Fatalf("expecting no position policy for a new user but got %s, %#v", policy, err)
+	}
+
+	err = data.SetUserPositionPolicy("username", "random")
+	if err == nil {
+		t.Error("expecting unknown position policy to be rejected")
+	}
+
+	err = data.SetUserPositionPolicy("username", PositionPolicyFurthest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err = data.GetUserPositionPolicy("username")
+	if err != nil || policy != PositionPolicyFurthest {
+		t.Fatalf("expecting position policy to be set but got %s, %#v", policy, err)
+	}
+
+	play := func(episode string, position int, ts int64) EpisodeAction {
+		return EpisodeAction{Podcast: "http://example.com/a.rss", Episode: episode, Action: EpisodeActionPlay, Position: &position, Timestamp: CustomTimestamp{Time: time.Unix(ts, 0)}}
+	}
+
+	// the second episode was marked as new after it was played to the end
+	err = data.AddEpisodeActionHistories("username", []EpisodeAction{
+		play("http://example.com/1.mp3", 1800, 100),
+		play("http://example.com/1.mp3", 60, 200),
+		play("http://example.com/2.mp3", 3600, 100),
+		{Podcast: "http://example.com/a.rss", Episode: "http://example.com/2.mp3", Action: EpisodeActionNew, Timestamp: CustomTimestamp{Time: time.Unix(150, 0)}},
+		play("http://example.com/2.mp3", 30, 200),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for policy, expected := range map[string][]int{
+		PositionPolicyNewest:   {60, 30},
+		PositionPolicyFurthest: {1800, 30},
+	} {
+		actions, err := data.RetrieveEpisodeActionHistory("username", "", "", time.Unix(0, 0), true, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		positions := map[string]int{}
+		for _, action := range actions {
+			positions[action.Episode] = *action.Position
+		}
+
+		if positions["http://example.com/1.mp3"] != expected[0] || positions["http://example.com/2.mp3"] != expected[1] {
+			t.Errorf("expecting positions %#v with the %s policy but got %#v", expected, policy, positions)
+		}
+	}
+	// the furthest position is picked among the actions of the device and
+	// the ones uploaded since, as filtered
+	phone, err := data.AddDevice("username", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := data.AddDevice("username", "laptop", "", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onPhone, onLaptop := play("http://example.com/3.mp3", 100, 300), play("http://example.com/3.mp3", 900, 200)
+	onPhone.Devices, onLaptop.Devices = []int{phone}, []int{laptop}
+	err = data.AddEpisodeActionHistories("username", []EpisodeAction{onPhone, onLaptop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE episode_actions SET created_at = '50' WHERE episode = ? AND position = ?", "http://example.com/1.mp3", 1800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		device   string
+		episode  string
+		expected int
+	}{
+		{"", "http://example.com/3.mp3", 900},
+		{"phone", "http://example.com/3.mp3", 100},
+		{"", "http://example.com/1.mp3", 60},
+	} {
+		actions, err := data.RetrieveEpisodeActionHistory("username", "", tc.device, time.Unix(100, 0), true, PositionPolicyFurthest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, action := range actions {
+			if action.Episode == tc.episode && *action.Position != tc.expected {
+				t.Errorf("expecting %s to be at %d for device %q since 100 but got %d", tc.episode, tc.expected, tc.device, *action.Position)
+			}
+		}
+	}
+}
+
+// TestRetrieveToplist tests that podcasts are ranked by the number of users
+// that are currently subscribed to them, together with their metadata
+func TestRetrieveToplist(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	subscribe := func(username string, podcasts ...string) {
+		err := data.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, deviceName := range []string{"phone", "laptop"} {
+			deviceId, err := data.AddDevice(username, deviceName, "", "mobile")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, podcast := range podcasts {
+				err = data.AddSubscriptionHistory(Subscription{User: username, Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	subscribe("alice", "http://example.com/a.rss", "http://example.com/b.rss")
+	subscribe("bob", "http://example.com/b.rss", "http://example.com/c.rss")
+	subscribe("carol", "http://example.com/b.rss", "http://example.com/c.rss")
+
+	// carol no longer listens to c on any of her devices
+	for _, deviceName := range []string{"phone", "laptop"} {
+		deviceId, err := data.GetDeviceIdFromName(deviceName, "carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = data.AddSubscriptionHistory(Subscription{User: "carol", Devices: []int{deviceId}, Podcast: "http://example.com/c.rss", Action: "UNSUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := data.UpdatePodcast(Podcast{URL: "http://example.com/c.rss", Title: "Cooking Show", Tags: []Tag{{Title: "Food", Tag: "food"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := data.RetrieveStalePodcasts(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stale, []string{"http://example.com/a.rss", "http://example.com/b.rss"}) {
+		t.Errorf("expecting podcasts without metadata to be stale but got %#v", stale)
+	}
+
+	toplist, err := data.RetrieveToplist(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribers := map[string]int{}
+	for _, p := range toplist {
+		subscribers[p.URL] = p.Subscribers
+	}
+	if len(toplist) != 3 || toplist[0].URL != "http://example.com/b.rss" || !reflect.DeepEqual(subscribers, map[string]int{"http://example.com/a.rss": 1, "http://example.com/b.rss": 3, "http://example.com/c.rss": 1}) {
+		t.Errorf("expecting podcasts to be ranked by subscribers but got %#v", toplist)
+	}
+
+	results, err := data.SearchPodcasts("cooking", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].URL != "http://example.com/c.rss" || results[0].Title != "Cooking Show" {
+		t.Errorf("expecting to find the podcast by its title but got %#v", results)
+	}
+
+	tags, err := data.RetrieveTopTags(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != (Tag{Title: "Food", Tag: "food", Usage: 1}) {
+		t.Errorf("expecting the tags of the podcasts but got %#v", tags)
+	}
+
+	_, err = data.RetrievePodcast("http://example.com/unknown.rss")
+	if err != sql.ErrNoRows {
+		t.Errorf("expecting no podcast that nobody is subscribed to but got %#v", err)
+	}
+}
+
+// TestRetrieveSuggestions tests that podcasts are suggested by how often they
+// are subscribed to together with the podcasts of the user, out of the users
+// that opted in only
+// TestCurrentSubscriptions tests that the directory counts the subscriptions
+// of devices the way the Subscriptions API returns them, for history that
+// repeats actions
+func TestCurrentSubscriptions(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("alice", "pass", "alice@test.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceId, err := data.AddDevice("alice", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, sub := range []Subscription{
+		{Podcast: "http://example.com/a.rss", Action: "SUBSCRIBE"},
+		{Podcast: "http://example.com/a.rss", Action: "SUBSCRIBE"},
+		{Podcast: "http://example.com/a.rss", Action: "UNSUBSCRIBE"},
+		{Podcast: "http://example.com/b.rss", Action: "UNSUBSCRIBE"},
+		{Podcast: "http://example.com/b.rss", Action: "SUBSCRIBE"},
+	} {
+		_, err = db.Exec("INSERT INTO subscriptions (user_id, device_id, podcast, action, timestamp) SELECT user_id, id, ?, ?, ? FROM devices WHERE id = ?", sub.Podcast, sub.Action, 100+idx, deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subs, err := data.RetrieveDeviceSubscriptionsSlice("alice", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(subs, []string{"http://example.com/a.rss"}) {
+		t.Fatalf("expecting the device to be subscribed to a but got %#v", subs)
+	}
+
+	toplist, err := data.RetrieveToplist(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toplist) != 1 || toplist[0].URL != subs[0] {
+		t.Errorf("expecting the toplist to agree with the subscriptions of the device but got %#v", toplist)
+	}
+
+	stale, err := data.RetrieveStalePodcasts(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stale, subs) {
+		t.Errorf("expecting the feeds of the subscriptions of the device to be refreshed but got %#v", stale)
+	}
+}
+
+func TestRetrieveSuggestions(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	for username, podcasts := range map[string][]string{
+		"alice": {"http://example.com/a.rss", "http://example.com/b.rss"},
+		"bob":   {"http://example.com/a.rss", "http://example.com/c.rss"},
+		"carol": {"http://example.com/a.rss", "http://example.com/c.rss", "http://example.com/d.rss"},
+		"dave":  {"http://example.com/a.rss", "http://example.com/e.rss"},
+	} {
+		err := data.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deviceId, err := data.AddDevice(username, "phone", "", "mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, podcast := range podcasts {
+			err = data.AddSubscriptionHistory(Subscription{User: username, Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if username != "dave" {
+			err = data.SetUserSuggestions(username, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	suggestions, err := data.RetrieveSuggestions("alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{}
+	for _, p := range suggestions {
+		urls = append(urls, p.URL)
+	}
+	if !reflect.DeepEqual(urls, []string{"http://example.com/c.rss", "http://example.com/d.rss"}) {
+		t.Errorf("expecting c and then d to be suggested but got %#v", urls)
+	}
+
+	suggestions, err = data.RetrieveSuggestions("dave", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 0 {
+		t.Errorf("expecting no suggestions for a user that has not opted in but got %#v", suggestions)
+	}
+}
+
+// BenchmarkRetrieveEpisodeActionHistory measures the aggregated episode
+// actions of a library of 5000 episodes with 20 actions each
+func TestFederation(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("alice", "pass", "alice@test.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	federated, err := data.IsUserFederated("alice")
+	if err != nil || federated {
+		t.Fatalf("expecting users not to be federated by default but got %t, %#v", federated, err)
+	}
+
+	err = data.SetUserFederated("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federated, _ = data.IsUserFederated("alice")
+	if !federated {
+		t.Fatal("expecting alice to be federated")
+	}
+
+	actor := UserActor("alice")
+
+	_, err = data.RetrieveFederationKey(actor)
+	if err != sql.ErrNoRows {
+		t.Errorf("expecting no key yet but got %#v", err)
+	}
+	data.AddFederationKey(actor, "first")
+	data.AddFederationKey(actor, "second")
+	key, _ := data.RetrieveFederationKey(actor)
+	if key != "first" {
+		t.Errorf("expecting the first key to be kept but got %s", key)
+	}
+
+	remote := FederationActor{Id: "https://remote.example/ap/instance", Inbox: "https://remote.example/ap/instance/inbox"}
+	data.AddFederationFollower(actor, remote)
+	data.AddFederationFollower(actor, remote)
+	followers, _ := data.RetrieveFederationFollowers(actor)
+	if len(followers) != 1 || followers[0].Id != remote.Id || !followers[0].Accepted {
+		t.Errorf("expecting remote to follow alice once but got %#v", followers)
+	}
+
+	data.AddFederationFollowing(actor, remote)
+	following, _ := data.RetrieveFederationFollowing(actor)
+	if len(following) != 1 || following[0].Accepted {
+		t.Errorf("expecting alice to be waiting for remote to accept but got %#v", following)
+	}
+	err = data.AcceptFederationFollowing(actor, remote.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	following, _ = data.RetrieveFederationFollowing(actor)
+	if len(following) != 1 || !following[0].Accepted {
+		t.Errorf("expecting remote to have accepted but got %#v", following)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = data.AddFederationActivity(actor, FederationOutbox, FederationActivity{Id: fmt.Sprintf("https://local.example/%d", i), Type: "Add", Actor: "https://local.example/ap/users/alice", Payload: "{}", CreatedAt: time.Unix(int64(i), 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	activities, _ := data.RetrieveFederationActivities(actor, FederationOutbox, 2)
+	if len(activities) != 2 || activities[0].Id != "https://local.example/2" {
+		t.Errorf("expecting the 2 newest activities but got %#v", activities)
+	}
+	if inbox, _ := data.RetrieveFederationActivities(actor, FederationInbox, 2); len(inbox) != 0 {
+		t.Errorf("expecting an empty inbox but got %#v", inbox)
+	}
+
+	// the federation data of a user goes with it
+	err = data.DeleteUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	followers, _ = data.RetrieveFederationFollowers(actor)
+	activities, _ = data.RetrieveFederationActivities(actor, FederationOutbox, 10)
+	if len(followers) != 0 || len(activities) != 0 {
+		t.Errorf("expecting the federation data of alice to be deleted but got %#v, %#v", followers, activities)
+	}
+}
+
+func TestRetrieveFederatedToplist(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("alice", "pass", "alice@test.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := data.AddDevice("alice", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, podcast := range []string{"http://example.com/a.rss", "http://example.com/b.rss"} {
+		err = data.AddSubscriptionHistory(Subscription{User: "alice", Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	err = data.ReplaceFederatedToplist("https://peer.example/ap/instance", []Podcast{{URL: "http://example.com/stale.rss", Subscribers: 100}}, now.Add(-48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the latest toplist of a peer replaces its previous one
+	err = data.ReplaceFederatedToplist("https://peer.example/ap/instance", []Podcast{{URL: "http://example.com/b.rss", Subscribers: 4}, {URL: "http://example.com/c.rss", Title: "C", Subscribers: 2}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.ReplaceFederatedToplist("https://old.example/ap/instance", []Podcast{{URL: "http://example.com/old.rss", Subscribers: 100}}, now.Add(-48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podcasts, err := data.RetrieveFederatedToplist(10, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Podcast{
+		{URL: "http://example.com/b.rss", Subscribers: 5},
+		{URL: "http://example.com/c.rss", Title: "C", Subscribers: 2},
+		{URL: "http://example.com/a.rss", Subscribers: 1},
+	}
+	if !reflect.DeepEqual(podcasts, expected) {
+		t.Errorf("expecting %#v but got %#v", expected, podcasts)
+	}
+}
+
+func TestSettings(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	err := data.AddUser("alice", "pass", "alice@test.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = data.AddDevice("alice", "phone", "", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := data.UpdateSettings("alice", SettingsScopeDevice, "phone", map[string]interface{}{"flattr": true, "volume": 0.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(settings, map[string]interface{}{"flattr": true, "volume": 0.5}) {
+		t.Errorf("expecting the settings that were set but got %#v", settings)
+	}
+
+	settings, err = data.UpdateSettings("alice", SettingsScopeDevice, "phone", nil, []string{"flattr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(settings, map[string]interface{}{"volume": 0.5}) {
+		t.Errorf("expecting flattr to be removed but got %#v", settings)
+	}
+
+	// settings of devices follow their renames
+	err = data.RenameDevice("alice", "phone", "tablet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, _ = data.RetrieveSettings("alice", SettingsScopeDevice, "tablet")
+	if !reflect.DeepEqual(settings, map[string]interface{}{"volume": 0.5}) {
+		t.Errorf("expecting the settings of the renamed device but got %#v", settings)
+	}
+	settings, _ = data.RetrieveSettings("alice", SettingsScopeAccount, "")
+	if len(settings) != 0 {
+		t.Errorf("expecting no account settings but got %#v", settings)
+	}
+
+	_, err = data.RetrieveSettings("nobody", SettingsScopeAccount, "")
+	if errors.Cause(err) != sql.ErrNoRows {
+		t.Errorf("expecting no settings for an unknown user but got %#v", err)
+	}
+}
+
+// TestPrivacy checks that subscriptions are only counted where their privacy
+// allows, and that private ones never show up in what other users or other
+// instances can see
+func TestPrivacy(t *testing.T) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(t, db)
+
+	const (
+		secret   = "http://example.com/secret.rss"
+		local    = "http://example.com/local.rss"
+		shared   = "http://example.com/shared.rss"
+		override = "http://example.com/override.rss"
+	)
+
+	for username, podcasts := range map[string][]string{
+		"alice": {secret, override, shared},
+		"bob":   {local, shared},
+		"carol": {shared, local},
+	} {
+		err := data.AddUser(username, "pass", username+"@test.com", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deviceId, err := data.AddDevice(username, "phone", "", "mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, podcast := range podcasts {
+			err = data.AddSubscriptionHistory(Subscription{User: username, Devices: []int{deviceId}, Podcast: podcast, Action: "SUBSCRIBE", Timestamp: CustomTimestamp{Time: time.Now()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = data.UpdatePodcast(Podcast{URL: podcast, Title: "Example", Tags: []Tag{{Title: "Example", Tag: "example"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = data.SetUserSuggestions(username, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice is private but for two podcasts, bob is instance only but for one
+	// podcast, carol is public
+	for _, setting := range []struct {
+		username, scope, target, privacy string
+	}{
+		{"alice", SettingsScopeAccount, "", PrivacyPrivate},
+		{"alice", SettingsScopePodcast, override, PrivacyPublic},
+		{"alice", SettingsScopePodcast, shared, PrivacyInstance},
+		{"bob", SettingsScopeAccount, "", PrivacyInstance},
+		{"bob", SettingsScopePodcast, shared, PrivacyPublic},
+	} {
+		_, err := data.UpdateSettings(setting.username, setting.scope, setting.target, map[string]interface{}{SettingPrivacy: setting.privacy}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for username, expected := range map[string]map[string]string{
+		"alice": {secret: PrivacyPrivate, override: PrivacyPublic, shared: PrivacyInstance},
+		"bob":   {local: PrivacyInstance, shared: PrivacyPublic},
+		"carol": {local: PrivacyPublic},
+	} {
+		for podcast, privacy := range expected {
+			got, err := data.RetrieveSubscriptionPrivacy(username, podcast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != privacy {
+				t.Errorf("expecting %s of %s to be %s but got %s", podcast, username, privacy, got)
+			}
+		}
+	}
+
+	subscribers := func(podcasts []Podcast) map[string]int {
+		counts := map[string]int{}
+		for _, p := range podcasts {
+			counts[p.URL] = p.Subscribers
+		}
+		return counts
+	}
+
+	instance := map[string]int{shared: 3, local: 2, override: 1}
+
+	toplist, _ := data.RetrieveToplist(10)
+	if got := subscribers(toplist); !reflect.DeepEqual(got, instance) {
+		t.Errorf("expecting toplist %#v but got %#v", instance, got)
+	}
+
+	search, _ := data.SearchPodcasts("example", 10)
+	if got := subscribers(search); !reflect.DeepEqual(got, instance) {
+		t.Errorf("expecting search results %#v but got %#v", instance, got)
+	}
+
+	tagged, _ := data.RetrieveTagPodcasts("example", 10)
+	if got := subscribers(tagged); !reflect.DeepEqual(got, instance) {
+		t.Errorf("expecting tag podcasts %#v but got %#v", instance, got)
+	}
+
+	federated, _ := data.RetrieveFederatedToplist(10, time.Now().Add(-time.Hour))
+	if got := subscribers(federated); !reflect.DeepEqual(got, instance) {
+		t.Errorf("expecting federated toplist %#v but got %#v", instance, got)
+	}
+
+	public := map[string]int{shared: 2, local: 1, override: 1}
+	publicToplist, _ := data.RetrievePublicToplist(10)
+	if got := subscribers(publicToplist); !reflect.DeepEqual(got, public) {
+		t.Errorf("expecting public toplist %#v but got %#v", public, got)
+	}
+
+	_, err := data.RetrievePodcast(secret)
+	if err != sql.ErrNoRows {
+		t.Errorf("expecting no data on a podcast that only has private subscribers but got %#v", err)
+	}
+
+	// alice shares a podcast with bob, so both of her other podcasts would be
+	// suggested to bob if the secret one was not private
+	suggestions, _ := data.RetrieveSuggestions("bob", 10)
+	if got := subscribers(suggestions); !reflect.DeepEqual(got, map[string]int{override: 1}) {
+		t.Errorf("expecting suggestions of bob %#v but got %#v", map[string]int{override: 1}, got)
+	}
+
+	tags, _ := data.RetrieveTopTags(10)
+	if len(tags) != 1 || tags[0].Usage != 3 {
+		t.Errorf("expecting the tag of the 3 podcasts that are not private but got %#v", tags)
+	}
+
+	for _, podcasts := range [][]Podcast{toplist, search, tagged, federated, publicToplist, suggestions} {
+		if _, ok := subscribers(podcasts)[secret]; ok {
+			t.Errorf("expecting private subscriptions never to be shared but got %#v", podcasts)
+		}
+	}
+}
+
+func BenchmarkRetrieveEpisodeActionHistory(b *testing.B) {
+
+	data := NewSQLite("testme.db")
+	db := data.db
+
+	cleanup(b, db)
+	defer cleanup(b, db)
+
+	err := data.AddUser("username", "pass", "test@test.com", "name")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	deviceId, err := data.AddDevice("username", "phone", "", "mobile")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	actions := []EpisodeAction{}
+	for i := 0; i < 100000; i++ {
+		position := i
+		actions = append(actions, EpisodeAction{
+			Podcast:   fmt.Sprintf("http://example.com/%d.rss", i%50),
+			Episode:   fmt.Sprintf("http://example.com/%d.mp3", i%5000),
+			Devices:   []int{deviceId},
+			Action:    EpisodeActionPlay,
+			Position:  &position,
+			Timestamp: CustomTimestamp{Time: time.Unix(int64(i), 0)},
+		})
+	}
+
+	err = data.AddEpisodeActionHistories("username", actions)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, aggregated := range []bool{true, false} {
+		b.Run(fmt.Sprintf("aggregated=%t", aggregated), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := data.RetrieveEpisodeActionHistory("username", "", "", time.Unix(0, 0), aggregated, PositionPolicyNewest)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewObservedSQLite(t *testing.T) {
+	observed := map[string]int{}
+	s := NewObservedSQLite("testme.db", func(kind string, d time.Duration) {
+		if d < 0 {
+			t.Errorf("expecting %s to take a positive duration but got %s", kind, d)
+		}
+		observed[kind]++
+	})
+	defer s.Close()
+	cleanup(t, s.GetDB())
+
+	err := s.AddUser("alice", "pass", "alice@test.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.RetrieveUsers()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("expecting the user to be retrieved but got %#v, %#v", users, err)
+	}
+	err = s.DeleteUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []string{QueryKindExec, QueryKindQuery, QueryKindBegin, QueryKindCommit} {
+		if observed[kind] == 0 {
+			t.Errorf("expecting %s statements to be observed but got %#v", kind, observed)
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	s := NewSQLite("testme.db")
+
+	err := s.Ping()
+	if err != nil {
+		t.Fatalf("expecting the database to be reachable but got %#v", err)
+	}
+
+	version, dirty, err := s.SchemaVersion()
+	if err != nil || version == 0 || dirty {
+		t.Errorf("expecting the test database to be migrated but got %d, %t, %#v", version, dirty, err)
+	}
+
+	_, _, err = NewSQLite(filepath.Join(t.TempDir(), "empty.db")).SchemaVersion()
+	if err == nil {
+		t.Error("expecting a database that was never initialised to have no schema version")
+	}
+}
@@ -8,10 +8,24 @@ import (
 type DataInterface interface {
 	AddUser(string, string, string, string) error
 	CheckUserPassword(string, string) bool
+	RetrieveSessionSecret(username string) (string, error)
+
+	// Accounts
+	RetrieveUsers() ([]User, error)
+	DeleteUser(username string) error
+	UpdateUserPassword(username string, password string) error
+	RenameUser(username string, newUsername string) error
+	SetUserDisabled(username string, disabled bool) error
+	SetUserPositionPolicy(username string, policy string) error
+	GetUserPositionPolicy(username string) (string, error)
+	SetUserSuggestions(username string, enabled bool) error
+
 	AddSubscriptionHistory(Subscription) error
+	AddSubscriptionHistories([]Subscription) error
 	RetrieveSubscriptionHistory(string, string, time.Time) ([]Subscription, error)
 	AddEpisodeActionHistory(username string, e EpisodeAction) error
-	RetrieveEpisodeActionHistory(username string, deviceId string, since time.Time) ([]EpisodeAction, error)
+	AddEpisodeActionHistories(username string, actions []EpisodeAction) error
+	RetrieveEpisodeActionHistory(username string, podcast string, deviceName string, since time.Time, aggregated bool, policy string) ([]EpisodeAction, error)
 
 	// Devices
 	RetrieveDevices(username string) ([]Device, error)
@@ -22,14 +36,70 @@ type DataInterface interface {
 	RetrieveDeviceSubscriptions(username string, deviceNme string) (string, error)
 	RetrieveDeviceSubscriptionsSlice(username string, deviceNme string) ([]string, error)
 	GetDeviceIdFromName(deviceName string, username string) (int, error)
+	RegisterDevice(username string, deviceName string, caption string, deviceType string, reason string) (int, error)
+	RetrieveDevice(username string, deviceName string) (Device, error)
+	RenameDevice(username string, deviceName string, newDeviceName string) error
+	DeleteDevice(username string, deviceName string) error
+	MergeDevices(username string, srcDeviceName string, dstDeviceName string) error
+
+	// Maintenance
+	SanitizeHistory() (int, error)
+
+	// Audit
+	RetrieveAuditEvents(username string) ([]AuditEvent, error)
+
+	// Directory
+	UpdatePodcast(podcast Podcast) error
+	RetrieveStalePodcasts(fetchedBefore time.Time) ([]string, error)
+	RetrievePodcast(url string) (Podcast, error)
+	RetrieveToplist(count int) ([]Podcast, error)
+	SearchPodcasts(query string, count int) ([]Podcast, error)
+	RetrieveTopTags(count int) ([]Tag, error)
+	RetrieveTagPodcasts(tag string, count int) ([]Podcast, error)
+	RetrieveSuggestions(username string, count int) ([]Podcast, error)
+	RetrievePublicToplist(count int) ([]Podcast, error)
+
+	// Settings
+	RetrieveSettings(username string, scope string, target string) (map[string]interface{}, error)
+	UpdateSettings(username string, scope string, target string, set map[string]interface{}, remove []string) (map[string]interface{}, error)
+	RetrieveSubscriptionPrivacy(username string, podcast string) (string, error)
+
+	// Federation
+	SetUserFederated(username string, enabled bool) error
+	IsUserFederated(username string) (bool, error)
+	RetrieveFederationKey(actor string) (string, error)
+	AddFederationKey(actor string, privateKey string) error
+	AddFederationFollower(actor string, follower FederationActor) error
+	DeleteFederationFollower(actor string, follower string) error
+	RetrieveFederationFollowers(actor string) ([]FederationActor, error)
+	AddFederationFollowing(actor string, following FederationActor) error
+	AcceptFederationFollowing(actor string, following string) error
+	RetrieveFederationFollowing(actor string) ([]FederationActor, error)
+	AddFederationActivity(actor string, box string, activity FederationActivity) error
+	RetrieveFederationActivities(actor string, box string, count int) ([]FederationActivity, error)
+	ReplaceFederatedToplist(peer string, podcasts []Podcast, receivedAt time.Time) error
+	RetrieveFederatedToplist(count int, receivedSince time.Time) ([]Podcast, error)
 
 	// sync
 	AddSyncGroup(deviceIds []string, username string) error
+	ConvergeSyncGroup(deviceName string, username string) error
+	LinkSyncGroup(deviceNames []string, username string) error
+	GetSyncGroupStatus(id int) (SyncGroupStatus, error)
 	StopDeviceSync(deviceName string, username string) error
 	GetDeviceSyncGroupIds(username string) ([]int, error)
 	GetDevicesInSyncGroupFromDeviceId(deviceId int) ([]int, error)
 	GetDeviceNameFromDeviceSyncGroupId(deviceId int) ([]string, error)
 	GetNotSyncedDevices(username string) ([]string, error)
+
+	// Ping checks that the database can be reached
+	Ping() error
+
+	// SchemaVersion returns the version of the last migration applied to
+	// the database, and whether it failed halfway
+	SchemaVersion() (version uint, dirty bool, err error)
+
+	// Close closes the database once the server is done with it
+	Close() error
 }
 
 type Subscription struct {
@@ -47,25 +117,173 @@ type Device struct {
 	Name    string `json:"name"` // Name is represents the actual DeviceId that is referenced in handlers
 	Type    string `json:"type"`
 	Caption string `json:"caption"` // To be deprecated
+
+	SyncGroupId  *int      `json:"sync_group,omitempty"`
+	LastActivity time.Time `json:"last_activity"` // Latest subscription or episode action of the device
+}
+
+// Sync statuses of a device sync group
+const (
+	SyncStatusPending   = "pending"     // devices were linked but have not been converged yet
+	SyncStatusSynced    = "synced"      // all devices are subscribed to the same podcasts
+	SyncStatusOutOfDate = "out-of-date" // some devices are missing podcasts of the others
+)
+
+type SyncGroupStatus struct {
+	Id        int               `json:"id"`
+	Status    string            `json:"status"`
+	LastSync  *time.Time        `json:"last_sync"` // Last time that the group was converged
+	Devices   []string          `json:"devices"`
+	OutOfDate []OutOfDateDevice `json:"out_of_date"`
+}
+
+type OutOfDateDevice struct {
+	Name    string   `json:"device"`
+	Missing []string `json:"missing"` // Podcasts that other devices in the group are subscribed to
+}
+
+// Podcast is a podcast of the directory, with its metadata from its feed and
+// the number of users of the instance that are subscribed to it
+// https://gpoddernet.readthedocs.io/en/latest/api/reference/directory.html
+type Podcast struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Subscribers int    `json:"subscribers"`
+	LogoURL     string `json:"logo_url"`
+	Website     string `json:"website"`
+
+	Tags []Tag `json:"-"` // Only set when updating the podcast
+}
+
+type Tag struct {
+	Title string `json:"title"`
+	Tag   string `json:"tag"`
+	Usage int    `json:"usage"` // Number of podcasts with the tag
+}
+
+// Scopes of the Settings API, see SettingsTarget
+const (
+	SettingsScopeAccount = "account"
+	SettingsScopeDevice  = "device"
+	SettingsScopePodcast = "podcast"
+	SettingsScopeEpisode = "episode"
+)
+
+// SettingsTarget returns what the settings of a scope are about, which is
+// nothing for the account scope
+func SettingsTarget(scope string, device string, podcast string, episode string) string {
+	switch scope {
+	case SettingsScopeDevice:
+		return device
+	case SettingsScopePodcast:
+		return podcast
+	case SettingsScopeEpisode:
+		return podcast + " " + episode
+	}
+	return ""
 }
 
+// SettingPrivacy is the setting of the account and podcast scopes that
+// controls what the subscriptions of a user are shared in. The setting of a
+// podcast overrides the one of the account, which defaults to PrivacyPublic.
+const SettingPrivacy = "privacy"
+
+const (
+	PrivacyPrivate  = "private"  // Not shared at all
+	PrivacyInstance = "instance" // Counted in the directory and suggestions of the instance
+	PrivacyPublic   = "public"   // Also counted in what is federated
+)
+
+// Local ActivityPub actors are the instance itself and the users that opted
+// in to federation
+const FederationInstanceActor = "instance"
+
+// UserActor returns the local ActivityPub actor of a user
+func UserActor(username string) string {
+	return "users/" + username
+}
+
+// Boxes of the activities of a local actor
+const (
+	FederationOutbox = "outbox" // published by the actor
+	FederationInbox  = "inbox"  // received by the actor
+)
+
+// FederationActor is a remote ActivityPub actor that follows or is followed
+// by a local actor
+type FederationActor struct {
+	Id       string `json:"id"`
+	Inbox    string `json:"inbox"`
+	Accepted bool   `json:"accepted"` // Always true for followers
+}
+
+// FederationActivity is an ActivityPub activity that a local actor published
+// or received
+type FederationActivity struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`   // Id of the actor that published the activity
+	Payload   string    `json:"payload"` // The activity as JSON
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditEvent records a change that the server made on its own for a user
+type AuditEvent struct {
+	User      string    `json:"user"`
+	Device    string    `json:"device"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Audit event actions
+const (
+	AuditDeviceRegistered = "DEVICE_REGISTERED"
+)
+
 type User struct {
-	Name string `json:"name"`
+	Name        string `json:"name"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+
+	PositionPolicy string `json:"position_policy,omitempty"` // Empty for the default policy of the server
+	Suggestions    bool   `json:"suggestions,omitempty"`     // Opted in to share subscriptions for suggestions
+	Federated      bool   `json:"federated,omitempty"`       // Opted in to publish subscriptions over ActivityPub
 }
 
+// Position policies decide which play action of an episode, out of the ones
+// uploaded by the devices of a user, has the position to resume playback at
+const (
+	PositionPolicyNewest   = "newest"   // the play action with the latest timestamp
+	PositionPolicyFurthest = "furthest" // the play action with the furthest position
+)
+
 type EpisodeAction struct {
 	Podcast   string          `json:"podcast"`
 	Episode   string          `json:"episode"`
-	Device    string          `json:"device"`
-	Devices   []int           `json:"devices"`
+	GUID      string          `json:"guid,omitempty"`
+	Device    string          `json:"device,omitempty"`
+	Devices   []int           `json:"-"`
 	Action    string          `json:"action"`
-	Position  int             `json:"position"`
-	Started   int             `json:"started"`
-	Total     int             `json:"total"`
+	Position  *int            `json:"position,omitempty"` // Only for play actions, in seconds
+	Started   *int            `json:"started,omitempty"`  // Only for play actions, in seconds
+	Total     *int            `json:"total,omitempty"`    // Only for play actions, in seconds
 	Timestamp CustomTimestamp `json:"timestamp"`
 }
 
-// CustomTimestamp is to handle ISO 8601 timestamp for unmarshalling
+// Episode actions
+const (
+	EpisodeActionDownload = "download"
+	EpisodeActionDelete   = "delete"
+	EpisodeActionPlay     = "play"
+	EpisodeActionNew      = "new"
+)
+
+// CustomTimestamp is to handle ISO 8601 and Unix timestamps for unmarshalling,
+// see ParseTimestamp for the accepted formats
 type CustomTimestamp struct {
 	time.Time
 }
@@ -76,7 +294,7 @@ func (c *CustomTimestamp) UnmarshalJSON(b []byte) error {
 		return nil
 	}
 
-	t, err := time.Parse("2006-01-02T15:04:05", value) // parse time
+	t, err := ParseTimestamp(value) // parse time
 	if err != nil {
 		return err
 	}
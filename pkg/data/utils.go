@@ -1,5 +1,12 @@
 package data
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // SubscriptionDiff takes in a slice of Subscription and returns a separated
 // string slice of podcasts that are to be added or removed.
 // https://github.com/gpodder/mygpo/blob/e20f107009bd07e8baf226a48131fc1b1e0383ff/mygpo/subscriptions/__init__.py#L149-L167
@@ -29,3 +36,63 @@ func SubscriptionDiff(subs []Subscription) (Add []string, Remove []string) {
 
 	return add, remove
 }
+
+// subscriptionCount is the SQL aggregate that counts the actions of a device
+// on a podcast the way SubscriptionDiff does, the device is subscribed to the
+// podcast when it is positive
+const subscriptionCount = "SUM(CASE action WHEN 'SUBSCRIBE' THEN 1 WHEN 'UNSUBSCRIBE' THEN -1 ELSE 0 END)"
+
+// timestampLayouts are the ISO 8601 variants that clients send. time.Parse
+// accepts fractional seconds after the seconds field even when the layout does
+// not have them, and layouts without a zone are parsed as UTC.
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z0700",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// maxEpochSeconds separates Unix timestamps in seconds from the ones in
+// milliseconds, it is in the year 5138 in seconds and in 1973 in milliseconds
+const maxEpochSeconds = 100_000_000_000
+
+// ParseTimestamp parses a timestamp sent by a client, either one of the ISO
+// 8601 variants or a Unix timestamp in seconds or milliseconds, into UTC.
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ParseSince(value)
+	}
+
+	for _, layout := range timestampLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown timestamp format (%s)", value)
+}
+
+// ParseSince parses the since query parameter, a Unix timestamp that some
+// clients send in milliseconds instead of seconds, into UTC.
+func ParseSince(value string) (time.Time, error) {
+	i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("timestamp (%d) must not be negative", i)
+	}
+
+	if i >= maxEpochSeconds {
+		return time.UnixMilli(i).UTC(), nil
+	}
+	return time.Unix(i, 0).UTC(), nil
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2009, 12, 12, 9, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"2009-12-12T09:00:00":           expected,
+		"2009-12-12T09:00:00Z":          expected,
+		"2009-12-12T09:00:00.000Z":      expected,
+		"2009-12-12T09:00:00.5":         expected.Add(500 * time.Millisecond),
+		"2009-12-12T11:00:00+02:00":     expected,
+		"2009-12-12T11:00:00+0200":      expected,
+		"2009-12-12T04:00:00.000-05:00": expected,
+		"2009-12-12 09:00:00":           expected,
+		"1260608400":                    expected,
+		"1260608400000":                 expected,
+	}
+
+	for value, want := range tests {
+		got, err := ParseTimestamp(value)
+		if err != nil {
+			t.Errorf("expecting %s to be parsed but got %#v", value, err)
+			continue
+		}
+		if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("expecting %s to be parsed into %s but got %s", value, want, got)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday", "12/12/2009", "-1"} {
+		_, err := ParseTimestamp(value)
+		if err == nil {
+			t.Errorf("expecting %s to be rejected", value)
+		}
+	}
+}
+
+func TestCustomTimestampUnmarshalJSON(t *testing.T) {
+	var e EpisodeAction
+	err := json.Unmarshal([]byte(`{"timestamp": 1260608400}`), &e)
+	if err != nil {
+		t.Fatalf("expecting epoch integer timestamp to be parsed but got %#v", err)
+	}
+	if !e.Timestamp.Equal(time.Date(2009, 12, 12, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("expecting timestamp to be 2009-12-12T09:00:00Z but got %s", e.Timestamp)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	tests := map[string]time.Time{
+		"0":             time.Unix(0, 0),
+		"1260608400":    time.Unix(1260608400, 0),
+		"1260608400123": time.UnixMilli(1260608400123),
+	}
+
+	for value, want := range tests {
+		got, err := ParseSince(value)
+		if err != nil {
+			t.Errorf("expecting %s to be parsed but got %#v", value, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("expecting %s to be parsed into %s but got %s", value, want, got)
+		}
+	}
+
+	for _, value := range []string{"", "-10", "soon", "1.5"} {
+		_, err := ParseSince(value)
+		if err == nil {
+			t.Errorf("expecting %s to be rejected", value)
+		}
+	}
+}
+
+func FuzzParseTimestamp(f *testing.F) {
+	for _, seed := range []string{"2009-12-12T09:00:00", "2009-12-12T09:00:00.123Z", "2009-12-12T11:00:00+02:00", "2009-12-12 09:00:00", "1260608400", "1260608400000", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		got, err := ParseTimestamp(value)
+		if err != nil {
+			return
+		}
+		if got.Location() != time.UTC {
+			t.Errorf("expecting %q to be normalised to UTC but got %s", value, got.Location())
+		}
+
+		// what we send back out must be accepted again
+		if got.Year() < 0 || got.Year() > 9999 {
+			return
+		}
+		again, err := ParseTimestamp(got.Format(time.RFC3339Nano))
+		if err != nil {
+			t.Fatalf("expecting %s parsed from %q to be parsed again but got %#v", got, value, err)
+		}
+		if !again.Equal(got) {
+			t.Errorf("expecting %s parsed from %q to be parsed again into the same time but got %s", got, value, again)
+		}
+	})
+}
+
+func FuzzParseSince(f *testing.F) {
+	for _, seed := range []string{"0", "1260608400", "1260608400000", "-1", "99999999999", "100000000000"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		got, err := ParseSince(value)
+		if err != nil {
+			return
+		}
+		if got.Location() != time.UTC {
+			t.Errorf("expecting %q to be normalised to UTC but got %s", value, got.Location())
+		}
+		if got.Before(time.Unix(0, 0)) {
+			t.Errorf("expecting %q not to be before the epoch but got %s", value, got)
+		}
+
+		// a since in seconds that a client got from us must be parsed unchanged
+		if got.Unix() < maxEpochSeconds {
+			again, err := ParseSince(strconv.FormatInt(got.Unix(), 10))
+			if err != nil || again.Unix() != got.Unix() {
+				t.Errorf("expecting %d parsed from %q to be parsed again unchanged but got %s, %#v", got.Unix(), value, again, err)
+			}
+		}
+	})
+}
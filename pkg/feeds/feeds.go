@@ -0,0 +1,152 @@
+package feeds
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+// Fetcher fetches the metadata of podcasts from their feeds
+type Fetcher struct {
+	Client *http.Client
+}
+
+func NewFetcher(timeout time.Duration) *Fetcher {
+	return &Fetcher{
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Fetch downloads the feed of the podcast at url and returns its metadata
+func (f *Fetcher) Fetch(ctx context.Context, url string) (data.Podcast, error) {
+	parser := gofeed.NewParser()
+	parser.Client = f.Client
+	parser.UserAgent = "gpodder2go"
+
+	feed, err := parser.ParseURLWithContext(url, ctx)
+	if err != nil {
+		return data.Podcast{}, errors.Wrap(err, "error parsing feed")
+	}
+
+	podcast := data.Podcast{
+		URL:         url,
+		Title:       strings.TrimSpace(feed.Title),
+		Description: strings.TrimSpace(feed.Description),
+		Website:     feed.Link,
+	}
+
+	if feed.Image != nil {
+		podcast.LogoURL = feed.Image.URL
+	}
+
+	if len(feed.Authors) > 0 && feed.Authors[0] != nil {
+		podcast.Author = feed.Authors[0].Name
+	}
+
+	for _, category := range feed.Categories {
+		tag := Tag(category)
+		if tag == "" {
+			continue
+		}
+		podcast.Tags = append(podcast.Tags, data.Tag{Title: strings.TrimSpace(category), Tag: tag})
+	}
+
+	return podcast, nil
+}
+
+// Tag turns a feed category into a tag, "Society & Culture" into
+// "society-culture"
+func Tag(category string) string {
+	words := strings.FieldsFunc(strings.ToLower(category), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r > 127)
+	})
+
+	return strings.Join(words, "-")
+}
+
+// Refresher keeps the metadata of the podcasts that users are subscribed to
+// up to date by fetching the feeds whose metadata is older than Interval
+type Refresher struct {
+	Data     data.DataInterface
+	Fetcher  *Fetcher
+	Interval time.Duration
+
+	// Observe is told the stats of every refresh when it is set, such as
+	// for the metrics of the server
+	Observe func(Stats)
+}
+
+// Stats of a refresh of the podcast metadata
+type Stats struct {
+	Refreshed int // Feeds fetched and stored
+	Failed    int // Feeds that failed to be fetched
+	Duration  time.Duration
+}
+
+// Run refreshes the metadata every Interval until ctx is done
+func (r *Refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		refreshed, err := r.Refresh(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "error refreshing podcast metadata", "error", err)
+		} else if refreshed > 0 {
+			slog.InfoContext(ctx, "📡 Refreshed the metadata of podcasts", "podcasts", refreshed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the feeds of the podcasts with stale metadata and returns
+// the number of podcasts that were updated. Feeds that fail to be fetched are
+// retried on the next refresh.
+func (r *Refresher) Refresh(ctx context.Context) (int, error) {
+	stats := Stats{}
+	if r.Observe != nil {
+		start := time.Now()
+		defer func() {
+			stats.Duration = time.Since(start)
+			r.Observe(stats)
+		}()
+	}
+
+	urls, err := r.Data.RetrieveStalePodcasts(time.Now().Add(-r.Interval))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, url := range urls {
+		if ctx.Err() != nil {
+			return stats.Refreshed, ctx.Err()
+		}
+
+		podcast, err := r.Fetcher.Fetch(ctx, url)
+		if err != nil {
+			slog.WarnContext(ctx, "error fetching feed", "url", url, "error", err)
+			stats.Failed++
+			continue
+		}
+
+		err = r.Data.UpdatePodcast(podcast)
+		if err != nil {
+			return stats.Refreshed, err
+		}
+		stats.Refreshed++
+	}
+
+	return stats.Refreshed, nil
+}
@@ -0,0 +1,110 @@
+package feeds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oxtyped/gpodder2go/pkg/data"
+)
+
+const feed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+  <channel>
+    <title> Example Podcast </title>
+    <link>https://example.com</link>
+    <description>A podcast about examples</description>
+    <itunes:author>Jane Doe</itunes:author>
+    <itunes:image href="https://example.com/logo.png"/>
+    <itunes:category text="Society &amp; Culture"/>
+    <category>Technology</category>
+  </channel>
+</rss>`
+
+func TestFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed))
+	}))
+	defer ts.Close()
+
+	podcast, err := NewFetcher(time.Second).Fetch(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("expecting feed to be fetched but got %#v", err)
+	}
+
+	if podcast.URL != ts.URL || podcast.Title != "Example Podcast" || podcast.Website != "https://example.com" || podcast.Author != "Jane Doe" || podcast.LogoURL != "https://example.com/logo.png" {
+		t.Errorf("expecting the metadata of the feed but got %#v", podcast)
+	}
+
+	tags := map[string]string{}
+	for _, tag := range podcast.Tags {
+		tags[tag.Tag] = tag.Title
+	}
+
+	if tags["technology"] != "Technology" || tags["society-culture"] != "Society & Culture" {
+		t.Errorf("expecting the categories of the feed as tags but got %#v", podcast.Tags)
+	}
+}
+
+func TestTag(t *testing.T) {
+	tests := map[string]string{
+		"Technology":        "technology",
+		"Society & Culture": "society-culture",
+		" True Crime ":      "true-crime",
+		"Kids & Family":     "kids-family",
+		"&":                 "",
+	}
+
+	for category, expected := range tests {
+		if tag := Tag(category); tag != expected {
+			t.Errorf("expecting %q to be tagged %q but got %q", category, expected, tag)
+		}
+	}
+}
+
+// refreshData is the data of a refresh, the other methods are not used
+type refreshData struct {
+	data.DataInterface
+	stale   []string
+	updated []data.Podcast
+}
+
+func (d *refreshData) RetrieveStalePodcasts(time.Time) ([]string, error) {
+	return d.stale, nil
+}
+
+func (d *refreshData) UpdatePodcast(p data.Podcast) error {
+	d.updated = append(d.updated, p)
+	return nil
+}
+
+func TestRefreshStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.rss" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(feed))
+	}))
+	defer ts.Close()
+
+	d := &refreshData{stale: []string{ts.URL + "/feed.rss", ts.URL + "/missing.rss", ts.URL + "/other.rss"}}
+	observed := []Stats{}
+	refresher := &Refresher{
+		Data:     d,
+		Fetcher:  NewFetcher(time.Second),
+		Interval: time.Hour,
+		Observe:  func(s Stats) { observed = append(observed, s) },
+	}
+
+	refreshed, err := refresher.Refresh(context.Background())
+	if err != nil || refreshed != 2 || len(d.updated) != 2 {
+		t.Fatalf("expecting 2 podcasts to be refreshed but got %d, %#v", refreshed, err)
+	}
+
+	if len(observed) != 1 || observed[0].Refreshed != 2 || observed[0].Failed != 1 || observed[0].Duration <= 0 {
+		t.Errorf("expecting the stats of the refresh to be observed but got %#v", observed)
+	}
+}
@@ -0,0 +1,178 @@
+// Package logging sets up the structured logs of the server. Every line that
+// is logged with the context of a request carries its request id and the
+// user that it was authenticated as, credentials are redacted, and payloads
+// are only logged when they are asked for.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/pkg/errors"
+
+	"github.com/oxtyped/gpodder2go/pkg/config"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+)
+
+// Formats of the logs
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// PayloadKey is the key of the attributes that hold the payloads of requests
+// and responses, such as subscriptions and episode actions, which are omitted
+// unless Options.Payloads is set
+const PayloadKey = "payload"
+
+// Omitted replaces the payloads that are not logged
+const Omitted = "<omitted>"
+
+// credentialKeys are the parts of the keys of attributes whose values are
+// redacted
+var credentialKeys = []string{"password", "secret", "token", "authorization", "cookie", "session"}
+
+type Options struct {
+	Format string
+	Level  slog.Level
+
+	// Payloads logs the payloads of requests and responses, which hold the
+	// subscriptions and listening history of users
+	Payloads bool
+}
+
+// New returns a logger that writes to w
+func New(w io.Writer, o Options) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level:       o.Level,
+		ReplaceAttr: replaceAttr(o.Payloads),
+	}
+
+	var h slog.Handler
+	switch o.Format {
+	case FormatText, "":
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, errors.Errorf("invalid log format %q, expecting text or json", o.Format)
+	}
+
+	return slog.New(contextHandler{h}), nil
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return l, errors.Errorf("invalid log level %q, expecting debug, info, warn or error", level)
+	}
+	return l, nil
+}
+
+func replaceAttr(payloads bool) func([]string, slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		key := strings.ToLower(a.Key)
+
+		if key == PayloadKey && !payloads {
+			return slog.String(a.Key, Omitted)
+		}
+
+		for _, k := range credentialKeys {
+			if strings.Contains(key, k) {
+				return slog.String(a.Key, config.Redacted)
+			}
+		}
+
+		// the cache and peer urls may carry passwords, on their own or in
+		// the errors about them
+		if a.Value.Kind() == slog.KindString {
+			return slog.String(a.Key, redactURLs(a.Value.String()))
+		}
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactURLs(err.Error()))
+		}
+
+		return a
+	}
+}
+
+// urlPattern matches the urls in a text, up to the quotes and spaces that
+// errors put around them
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// redactURLs redacts the passwords of the urls in s
+func redactURLs(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, config.RedactURL)
+}
+
+// contextHandler adds the request id and the user of the context of the
+// records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if username := m2.Username(ctx); username != "" {
+		r.AddAttrs(slog.String("user", username))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Middleware logs every request once it is served, with the chi route that
+// served it and the user that the auth middlewares further down the chain
+// authenticated. It must come after middleware.RequestID.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m2.TrackUsername(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("remote", r.RemoteAddr),
+			}
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				attrs = append(attrs, slog.String("route", rctx.RoutePattern()))
+			}
+
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		}))
+	}
+}
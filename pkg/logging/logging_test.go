@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/pkg/errors"
+
+	"github.com/oxtyped/gpodder2go/pkg/config"
+	m2 "github.com/oxtyped/gpodder2go/pkg/middleware"
+)
+
+// TestMiddleware tests that the lines logged by handlers and the line of the
+// request carry the request id and the user, with credentials redacted and
+// payloads only when they are asked for
+func TestMiddleware(t *testing.T) {
+	for _, payloads := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		logger, err := New(buf, Options{Format: FormatJSON, Payloads: payloads})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := chi.NewRouter()
+		r.Use(middleware.RequestID)
+		r.Use(Middleware(logger))
+		r.With(m2.BasicAuth(nil, true)).Post("/api/2/subscriptions/{username}/{deviceid}.json", func(w http.ResponseWriter, r *http.Request) {
+			logger.InfoContext(r.Context(), "uploading", PayloadKey, []string{"https://example.com/feed.xml"}, "password", "hunter2", "cache", "redis://:hunter2@redis:6379/0", "error", errors.New(`invalid cache "redis://:hunter2@redis:6379/0": connection refused`))
+			w.WriteHeader(400)
+		})
+
+		req := httptest.NewRequest("POST", "/api/2/subscriptions/alice/phone.json", nil)
+		req.SetBasicAuth("alice", "hunter2")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if strings.Contains(buf.String(), "hunter2") {
+			t.Errorf("expecting the credentials to be redacted but got %s", buf.String())
+		}
+
+		lines := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			entry := map[string]interface{}{}
+			err := json.Unmarshal([]byte(line), &entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, entry)
+		}
+		if len(lines) != 2 {
+			t.Fatalf("expecting the line of the handler and the request but got %d", len(lines))
+		}
+
+		handler, request := lines[0], lines[1]
+		for _, entry := range lines {
+			if entry["request_id"] == nil || entry["request_id"] == "" || entry["user"] != "alice" {
+				t.Errorf("expecting the request id and the user but got %v", entry)
+			}
+		}
+		if handler["request_id"] != request["request_id"] {
+			t.Errorf("expecting the lines of a request to share its id but got %v and %v", handler["request_id"], request["request_id"])
+		}
+
+		if handler["password"] != config.Redacted || handler["cache"] != "redis://:"+config.Redacted+"@redis:6379/0" ||
+			handler["error"] != `invalid cache "redis://:`+config.Redacted+`@redis:6379/0": connection refused` {
+			t.Errorf("expecting the credentials to be redacted but got %v", handler)
+		}
+		if omitted := handler[PayloadKey] == Omitted; omitted == payloads {
+			t.Errorf("expecting the payload to be logged %t but got %v", payloads, handler[PayloadKey])
+		}
+
+		if request["status"] != float64(400) || request["route"] != "/api/2/subscriptions/{username}/{deviceid}.json" {
+			t.Errorf("expecting the status and the route of the request but got %v", request)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, Options{Format: "xml"})
+	if err == nil {
+		t.Errorf("expecting an invalid format to be rejected")
+	}
+
+	level, err := ParseLevel("warn")
+	if err != nil || level.String() != "WARN" {
+		t.Errorf("expecting the warn level but got %v %v", level, err)
+	}
+	_, err = ParseLevel("loud")
+	if err == nil {
+		t.Errorf("expecting an invalid level to be rejected")
+	}
+}
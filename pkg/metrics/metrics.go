@@ -0,0 +1,199 @@
+// Package metrics exposes how the server behaves in the Prometheus format:
+// the requests per route, the uploads per user, the latencies of the
+// database, the cache hit rates, the feed refreshes and the active sessions.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/oxtyped/gpodder2go/pkg/feeds"
+)
+
+// Namespace of the metrics
+const Namespace = "g2g"
+
+// unmatchedRoute is the route of the requests that match no route, so that
+// the paths that scanners try do not each get their own series
+const unmatchedRoute = "unmatched"
+
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	uploads         *prometheus.CounterVec
+	queryDuration   *prometheus.HistogramVec
+	cacheRequests   *prometheus.CounterVec
+	feedFetches     *prometheus.CounterVec
+	refreshDuration prometheus.Histogram
+	lastRefresh     prometheus.Gauge
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // Expiry of the session of each user
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "http_requests_total",
+			Help:      "Requests by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of the requests by method and route pattern.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "uploads_total",
+			Help:      "Uploads of subscriptions and episode actions by user.",
+		}, []string{"user", "kind"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Latency of the statements of the database by kind (query, exec, begin, commit or rollback).",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"kind"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "cache_requests_total",
+			Help:      "Keys looked up in the cache by result (hit, miss or error).",
+		}, []string{"result"}),
+		feedFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "feed_fetches_total",
+			Help:      "Feeds fetched to refresh the podcast metadata by result (ok or error).",
+		}, []string{"result"}),
+		refreshDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "feed_refresh_duration_seconds",
+			Help:      "Duration of the refreshes of the podcast metadata.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "feed_refresh_last_timestamp_seconds",
+			Help:      "Time of the end of the last refresh of the podcast metadata.",
+		}),
+		sessions: map[string]time.Time{},
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.uploads,
+		m.queryDuration,
+		m.cacheRequests,
+		m.feedFetches,
+		m.refreshDuration,
+		m.lastRefresh,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "sessions_active",
+			Help:      "Users with a session that has not expired nor logged out, as seen by this instance.",
+		}, m.activeSessions),
+	)
+
+	// the buckets of the results are there before the first lookups and
+	// refreshes, so that rates do not start from nothing
+	for _, result := range []string{"hit", "miss", "error"} {
+		m.cacheRequests.WithLabelValues(result)
+	}
+	for _, result := range []string{"ok", "error"} {
+		m.feedFetches.WithLabelValues(result)
+	}
+
+	return m
+}
+
+// Handler serves the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// Middleware counts and times the requests by the pattern of the chi route
+// that handled them, such as /api/2/episodes/{username}.{format}. It must be
+// used on the root router, which the route patterns are resolved from.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Uploaded counts an upload of a user, see apis.Observer
+func (m *Metrics) Uploaded(username string, kind string) {
+	m.uploads.WithLabelValues(username, kind).Inc()
+}
+
+// LoggedIn counts the session of a user as active until it expires, see
+// apis.Observer
+func (m *Metrics) LoggedIn(username string, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[username] = expires
+}
+
+// LoggedOut stops counting the session of a user, see apis.Observer
+func (m *Metrics) LoggedOut(username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, username)
+}
+
+func (m *Metrics) activeSessions() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for username, expires := range m.sessions {
+		if !expires.After(now) {
+			delete(m.sessions, username)
+		}
+	}
+
+	return float64(len(m.sessions))
+}
+
+// ObserveQuery times a statement of the database, see data.QueryObserver
+func (m *Metrics) ObserveQuery(kind string, d time.Duration) {
+	m.queryDuration.WithLabelValues(kind).Observe(d.Seconds())
+}
+
+// ObserveRefresh records the stats of a refresh of the podcast metadata, see
+// feeds.Refresher
+func (m *Metrics) ObserveRefresh(stats feeds.Stats) {
+	m.feedFetches.WithLabelValues("ok").Add(float64(stats.Refreshed))
+	m.feedFetches.WithLabelValues("error").Add(float64(stats.Failed))
+	m.refreshDuration.Observe(stats.Duration.Seconds())
+	m.lastRefresh.SetToCurrentTime()
+}
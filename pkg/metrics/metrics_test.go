@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/oxtyped/gpodder2go/pkg/feeds"
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Get("/api/2/episodes/{username}.{format}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Route("/index.php/apps/gpoddersync", func(r chi.Router) {
+		r.Post("/subscription_change/create", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(401)
+		})
+	})
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/2/episodes/alice.json"},
+		{"GET", "/api/2/episodes/bob.json"},
+		{"POST", "/index.php/apps/gpoddersync/subscription_change/create"},
+		{"GET", "/wp-login.php"},
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	for labels, expected := range map[[3]string]float64{
+		{"GET", "/api/2/episodes/{username}.{format}", "200"}:                     2,
+		{"POST", "/index.php/apps/gpoddersync/subscription_change/create", "401"}: 1,
+		{"GET", unmatchedRoute, "404"}:                                            1,
+	} {
+		if count := testutil.ToFloat64(m.requests.WithLabelValues(labels[:]...)); count != expected {
+			t.Errorf("expecting %d requests of %v but got %v", int(expected), labels, count)
+		}
+	}
+	if count := testutil.CollectAndCount(m.requestDuration); count != 3 {
+		t.Errorf("expecting the latencies of 3 routes but got %d", count)
+	}
+}
+
+func TestStore(t *testing.T) {
+	m := New()
+	s := m.Store(store.NewCacheStore())
+
+	s.Set("a", "1")
+	s.Get("a")
+	s.Get("b")
+	s.GetMulti([]string{"a", "b", "c"})
+
+	for result, expected := range map[string]float64{"hit": 2, "miss": 3, "error": 0} {
+		if count := testutil.ToFloat64(m.cacheRequests.WithLabelValues(result)); count != expected {
+			t.Errorf("expecting %d cache %ss but got %v", int(expected), result, count)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m := New()
+
+	m.LoggedIn("alice", time.Now().Add(time.Hour))
+	m.LoggedIn("alice", time.Now().Add(time.Hour))
+	m.LoggedIn("bob", time.Now().Add(time.Hour))
+	m.LoggedIn("carol", time.Now().Add(-time.Second))
+	if active := m.activeSessions(); active != 2 {
+		t.Errorf("expecting 2 active sessions but got %v", active)
+	}
+
+	m.LoggedOut("bob")
+	if active := m.activeSessions(); active != 1 {
+		t.Errorf("expecting 1 active session after a logout but got %v", active)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.Uploaded("alice", "episode_actions")
+	m.ObserveQuery("query", time.Millisecond)
+	m.ObserveRefresh(feeds.Stats{Refreshed: 3, Failed: 1, Duration: time.Second})
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := io.ReadAll(w.Body)
+
+	for _, line := range []string{
+		`g2g_uploads_total{kind="episode_actions",user="alice"} 1`,
+		`g2g_db_query_duration_seconds_count{kind="query"} 1`,
+		`g2g_feed_fetches_total{result="ok"} 3`,
+		`g2g_feed_fetches_total{result="error"} 1`,
+		`g2g_feed_refresh_duration_seconds_count 1`,
+		`g2g_sessions_active 0`,
+		`g2g_cache_requests_total{result="hit"} 0`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("expecting the metrics to contain %s", line)
+		}
+	}
+}
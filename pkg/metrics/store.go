@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+// observedStore counts the hits and misses of the lookups of a store
+type observedStore struct {
+	store.Store
+	metrics *Metrics
+}
+
+// Store returns s with its lookups counted in the cache hit rate
+func (m *Metrics) Store(s store.Store) store.Store {
+	return &observedStore{Store: s, metrics: m}
+}
+
+func (s *observedStore) Get(key string) (string, error) {
+	value, err := s.Store.Get(key)
+
+	switch err {
+	case nil:
+		s.metrics.cacheRequests.WithLabelValues("hit").Inc()
+	case store.ErrNotFound:
+		s.metrics.cacheRequests.WithLabelValues("miss").Inc()
+	default:
+		s.metrics.cacheRequests.WithLabelValues("error").Inc()
+	}
+
+	return value, err
+}
+
+func (s *observedStore) GetMulti(keys []string) (map[string]string, error) {
+	values, err := s.Store.GetMulti(keys)
+	if err != nil {
+		s.metrics.cacheRequests.WithLabelValues("error").Add(float64(len(keys)))
+		return values, err
+	}
+
+	s.metrics.cacheRequests.WithLabelValues("hit").Add(float64(len(values)))
+	s.metrics.cacheRequests.WithLabelValues("miss").Add(float64(len(keys) - len(values)))
+	return values, nil
+}
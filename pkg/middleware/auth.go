@@ -2,17 +2,92 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"database/sql"
 	b64 "encoding/base64"
-	"log"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+
+	"github.com/oxtyped/gpodder2go/pkg/store"
+)
+
+type contextKey string
+
+const (
+	usernameKey       contextKey = "username"
+	usernameHolderKey contextKey = "username_holder"
 )
 
+// Username returns the username that was authenticated by BasicAuth or the
+// session cookie of Verify for the request, or an empty string if there is none
+func Username(ctx context.Context) string {
+	if username, ok := ctx.Value(usernameKey).(string); ok {
+		return username
+	}
+	if holder, ok := ctx.Value(usernameHolderKey).(*string); ok {
+		return *holder
+	}
+	return ""
+}
+
+// TrackUsername makes the username that the auth middlewares further down the
+// chain authenticate readable by Username from the context of the requests
+// that pass through it, such as to log who made them once they are served
+func TrackUsername(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), usernameHolderKey, new(string))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withUsername returns r with the username that it was authenticated as
+func withUsername(r *http.Request, username string) *http.Request {
+	ctx := r.Context()
+	if holder, ok := ctx.Value(usernameHolderKey).(*string); ok {
+		*holder = username
+	}
+	return r.WithContext(context.WithValue(ctx, usernameKey, username))
+}
+
+// SessionKey returns the key of the store that the session of a session
+// cookie is kept at until it expires or the user logs out
+func SessionKey(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return "session_" + hex.EncodeToString(sum[:])
+}
+
+// SessionSignature returns the signature of the session cookies of username,
+// which are signed with key and the session secret of the user so that they
+// are no longer valid once the secret is replaced
+func SessionSignature(key string, username string, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
+
 func Verify(key string, noAuth bool) func(http.Handler) http.Handler {
+	return VerifySessions(key, noAuth, nil, nil)
+}
+
+// VerifySessions is Verify that also requires the session of the cookie to be
+// in sessions, where the login handler keeps it for its lifetime, and to be
+// signed with the session secret of the user that secrets returns. secrets
+// returns sql.ErrNoRows for users that can no longer have sessions. Sessions
+// are only checked by their signature when sessions is nil, and signed without
+// a secret when secrets is nil.
+func VerifySessions(key string, noAuth bool, sessions store.Store, secrets func(username string) (string, error)) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
 			if noAuth {
+				// clients that do not login may still say who they are
+				if username, _, ok := r.BasicAuth(); ok && username != "" {
+					r = withUsername(r, username)
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -20,12 +95,12 @@ func Verify(key string, noAuth bool) func(http.Handler) http.Handler {
 			ck, err := r.Cookie("sessionid")
 			if err != nil {
 				if err == http.ErrNoCookie {
-					log.Printf("missing cookie, have you logged in yet: %#v", err)
+					slog.InfoContext(r.Context(), "missing cookie, have you logged in yet", "error", err)
 					w.WriteHeader(401)
 					return
 				} else {
 					w.WriteHeader(400)
-					log.Printf("error retrieving cookie: %#v", err)
+					slog.WarnContext(r.Context(), "error retrieving cookie", "error", err)
 					return
 				}
 			}
@@ -33,14 +108,14 @@ func Verify(key string, noAuth bool) func(http.Handler) http.Handler {
 			session, err := b64.StdEncoding.DecodeString(ck.Value)
 			if err != nil {
 				w.WriteHeader(400)
-				log.Println(err)
+				slog.WarnContext(r.Context(), "error decoding cookie", "error", err)
 				return
 			}
 
 			i := bytes.LastIndexByte(session, '.')
 			if i < 0 {
 				w.WriteHeader(400)
-				log.Println("invalid cookie format")
+				slog.WarnContext(r.Context(), "invalid cookie format")
 				return
 			}
 
@@ -49,16 +124,42 @@ func Verify(key string, noAuth bool) func(http.Handler) http.Handler {
 				user = session[i+1:] // FIXME: how to handle usernames with a dot '.' ?
 			)
 
-			mac := hmac.New(sha256.New, []byte(key))
-			mac.Write(user)
+			var secret string
+			if secrets != nil {
+				secret, err = secrets(string(user))
+				if err == sql.ErrNoRows {
+					slog.InfoContext(r.Context(), "user no longer exists or is disabled", "username", string(user))
+					w.WriteHeader(401)
+					return
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "error retrieving session secret", "error", err)
+					w.WriteHeader(500)
+					return
+				}
+			}
 
-			if !hmac.Equal([]byte(sign), mac.Sum(nil)) {
+			if !hmac.Equal([]byte(sign), SessionSignature(key, string(user), secret)) {
 				w.WriteHeader(401)
 				return
 
 			}
 
-			next.ServeHTTP(w, r)
+			if sessions != nil {
+				username, err := sessions.Get(SessionKey(ck.Value))
+				if err == store.ErrNotFound || (err == nil && username != string(user)) {
+					slog.InfoContext(r.Context(), "session has expired or was logged out", "username", string(user))
+					w.WriteHeader(401)
+					return
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "error retrieving session", "error", err)
+					w.WriteHeader(500)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, withUsername(r, string(user)))
 		}
 		return http.HandlerFunc(hfn)
 	}
@@ -70,4 +171,31 @@ func Verifier(key string, noAuth bool) func(http.Handler) http.Handler {
 	}
 }
 
-// CheckBasicAuth is a middleware that checks the authenticity of the user attempting to access secured endpoints
+// BasicAuth is a middleware that checks the HTTP Basic Auth credentials of
+// every request with check and stores the username in the request context.
+// Clients such as the Nextcloud gpoddersync ones send their credentials on
+// every request instead of logging in for a session cookie.
+//
+// When noAuth is set the password is not checked, but a username is still
+// required as it is the only way to know whose data is being accessed.
+func BasicAuth(check func(username, password string) bool, noAuth bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || username == "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="gpodder2go"`)
+				w.WriteHeader(401)
+				return
+			}
+
+			if !noAuth && !check(username, password) {
+				slog.WarnContext(r.Context(), "invalid credentials", "username", username)
+				w.WriteHeader(401)
+				return
+			}
+
+			next.ServeHTTP(w, withUsername(r, username))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
@@ -0,0 +1,113 @@
+// Package sanitize cleans up the podcast and episode URLs that clients send so
+// that the same feed is always stored under the same URL.
+// https://gpoddernet.readthedocs.io/en/latest/api/reference/general.html#url-sanitizing
+package sanitize
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ErrRejected is returned for URLs that cannot be podcast or episode URLs
+var ErrRejected = errors.New("url rejected")
+
+// podcastSchemes are the pseudo schemes that podcast directories use to open
+// feeds in podcast clients, they all point to a http feed
+var podcastSchemes = map[string]bool{
+	"feed":    true,
+	"itpc":    true,
+	"itms":    true,
+	"pcast":   true,
+	"podcast": true,
+}
+
+// trackingParams are query parameters that are only used for tracking and do
+// not change the content of the URL
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"igshid": true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+// URL returns the sanitized form of raw. Whitespace is stripped, the scheme
+// and host are lower-cased, default ports, fragments and tracking parameters
+// are removed. ErrRejected is returned for URLs that are not http(s).
+func URL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", ErrRejected
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ErrRejected
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if podcastSchemes[u.Scheme] {
+		u.Scheme = "http"
+
+		// feed:https://example.com/feed.xml
+		if u.Opaque != "" {
+			return URL(u.Opaque)
+		}
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ErrRejected
+	}
+
+	if u.Host == "" {
+		return "", ErrRejected
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	u.RawQuery = stripTrackingParams(u.RawQuery)
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// stripTrackingParams removes the tracking parameters from a raw query. The
+// other parameters are kept as they were sent, in their order and encoding,
+// so that the URLs without tracking parameters are left as is.
+func stripTrackingParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	params := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+
+		key = strings.ToLower(key)
+		if trackingParams[key] || strings.HasPrefix(key, "utm_") {
+			continue
+		}
+
+		params = append(params, param)
+	}
+
+	return strings.Join(params, "&")
+}
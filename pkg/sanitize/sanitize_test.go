@@ -0,0 +1,48 @@
+package sanitize
+
+import (
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+		err      error
+	}{
+		{"https://example.com/feed.xml", "https://example.com/feed.xml", nil},
+		{"  https://example.com/feed.xml\n", "https://example.com/feed.xml", nil},
+		{"HTTPS://Example.COM/Feed.xml", "https://example.com/Feed.xml", nil},
+		{"http://example.com:80/feed.xml", "http://example.com/feed.xml", nil},
+		{"https://example.com:443/feed.xml", "https://example.com/feed.xml", nil},
+		{"https://example.com:8443/feed.xml", "https://example.com:8443/feed.xml", nil},
+		{"https://Example.com", "https://example.com", nil},
+		{"https://example.com/feed.xml#latest", "https://example.com/feed.xml", nil},
+		{"https://example.com/feed.xml?utm_source=ios&utm_medium=share", "https://example.com/feed.xml", nil},
+		{"https://example.com/feed.xml?fbclid=abc&id=3", "https://example.com/feed.xml?id=3", nil},
+		{"https://example.com/feed.xml?", "https://example.com/feed.xml", nil},
+		{"https://example.com/feed.xml?b=2&a=1", "https://example.com/feed.xml?b=2&a=1", nil},
+		{"https://example.com/feed.xml?token", "https://example.com/feed.xml?token", nil},
+		{"https://example.com/feed.xml?q=a%20b&UTM_Campaign=x&c=%2F", "https://example.com/feed.xml?q=a%20b&c=%2F", nil},
+		{"https://example.com/feed.xml?b=2&gclid=abc&a=1", "https://example.com/feed.xml?b=2&a=1", nil},
+		{"feed://example.com/feed.xml", "http://example.com/feed.xml", nil},
+		{"itpc://example.com/feed.xml", "http://example.com/feed.xml", nil},
+		{"feed:https://example.com/feed.xml", "https://example.com/feed.xml", nil},
+		{"ftp://example.com/feed.xml", "", ErrRejected},
+		{"javascript:alert(1)", "", ErrRejected},
+		{"example.com/feed.xml", "", ErrRejected},
+		{"   ", "", ErrRejected},
+	}
+
+	for _, tt := range tests {
+		got, err := URL(tt.raw)
+		if err != tt.err {
+			t.Errorf("URL(%q): expecting error %v but got %v", tt.raw, tt.err, err)
+			continue
+		}
+
+		if got != tt.expected {
+			t.Errorf("URL(%q): expecting %q but got %q", tt.raw, tt.expected, got)
+		}
+	}
+}
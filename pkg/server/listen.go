@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Listen listens on an address, either host:port or tcp://host:port for TCP,
+// or unix:///path/to/socket for a Unix socket that is created with mode, such
+// as for a reverse proxy on the same host. A socket that is left over from a
+// server that did not stop cleanly is replaced.
+func Listen(address string, mode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return listenUnix(path, mode)
+	}
+
+	l, err := net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listening on %s", address)
+	}
+
+	return l, nil
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("expecting unix:///path/to/socket")
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("error listening on %s: the file exists and is not a socket", path)
+		}
+		// a socket that still accepts connections belongs to a running server
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("error listening on %s: the socket is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	// the socket is created with mode rather than changed to it, so that it
+	// is never reachable with wider permissions
+	var l net.Listener
+	err := withUmask(int(0o777&^mode.Perm()), func() error {
+		var err error
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listening on %s", path)
+	}
+
+	return l, nil
+}
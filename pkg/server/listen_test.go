@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestListenUnix tests that the server is served on a Unix socket with the
+// given permissions, replacing a socket left over by a crash
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "g2g.sock")
+
+	// a server that was killed leaves its socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix://"+path, 0o660)
+	if err != nil {
+		t.Fatalf("expecting the stale socket to be replaced but got %#v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Errorf("expecting the socket to be 0660 but got %o", info.Mode().Perm())
+	}
+
+	_, err = Listen("unix://"+path, 0o660)
+	if err == nil {
+		t.Error("expecting a socket in use to be rejected")
+	}
+
+	s := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), Timeouts{Shutdown: time.Second})
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://g2g/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Errorf("expecting the server to answer on the socket but got %q", b)
+	}
+	client.CloseIdleConnections()
+
+	stop()
+	<-served
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expecting the socket to be removed once stopped but got %#v", err)
+	}
+
+	notSocket := filepath.Join(t.TempDir(), "file")
+	err = os.WriteFile(notSocket, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Listen("unix://"+notSocket, 0o660)
+	if err == nil {
+		t.Error("expecting a file that is not a socket not to be replaced")
+	}
+}
@@ -0,0 +1,102 @@
+// Package server runs the HTTP server of gpodder2go until it is told to stop,
+// then drains the connections before closing what the handlers use, so that
+// no request is cut off halfway through its database transaction.
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Timeouts of the connections of the server, 0 for no timeout
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+
+	// Shutdown is how long the in-flight requests have to complete once the
+	// server is stopping, they are cut off after
+	Shutdown time.Duration
+}
+
+type Server struct {
+	HTTP     *http.Server
+	Timeouts Timeouts
+
+	// Closers are closed in order once the connections are drained, such
+	// as the stores and the database
+	Closers []io.Closer
+}
+
+func New(handler http.Handler, timeouts Timeouts, closers ...io.Closer) *Server {
+	return &Server{
+		HTTP: &http.Server{
+			Handler:      handler,
+			ReadTimeout:  timeouts.Read,
+			WriteTimeout: timeouts.Write,
+			IdleTimeout:  timeouts.Idle,
+		},
+		Timeouts: timeouts,
+		Closers:  closers,
+	}
+}
+
+// Serve serves the connections of l, over TLS when the TLSConfig of the
+// HTTP server is set, until ctx is done, then stops accepting
+// connections, waits for the in-flight requests and closes the Closers. It
+// returns the first error of serving, draining or closing.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	served := make(chan error, 1)
+	go func() {
+		if s.HTTP.TLSConfig != nil {
+			served <- s.HTTP.ServeTLS(l, "", "")
+			return
+		}
+		served <- s.HTTP.Serve(l)
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+		// the server failed on its own, there is nothing to drain
+	case <-ctx.Done():
+		slog.Info("🛑 Shutting down, waiting for the requests in flight", "timeout", s.Timeouts.Shutdown)
+		err = s.shutdown()
+		<-served
+	}
+
+	for _, c := range s.Closers {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = errors.Wrap(closeErr, "error closing")
+		}
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) shutdown() error {
+	ctx := context.Background()
+	if s.Timeouts.Shutdown > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeouts.Shutdown)
+		defer cancel()
+	}
+
+	err := s.HTTP.Shutdown(ctx)
+	if err != nil {
+		// the requests that did not complete in time are cut off
+		s.HTTP.Close()
+		return errors.Wrap(err, "error draining connections")
+	}
+
+	return nil
+}
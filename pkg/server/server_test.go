@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type closer struct {
+	name   string
+	closed *[]string
+	mu     *sync.Mutex
+}
+
+func (c closer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.closed = append(*c.closed, c.name)
+	return nil
+}
+
+// TestServeDrains tests that a stopping server completes the requests in
+// flight before closing the data and the stores
+func TestServeDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	mu := &sync.Mutex{}
+	closed := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(closed) > 0 {
+			t.Errorf("expecting nothing to be closed during a request but got %#v", closed)
+		}
+		w.Write([]byte("uploaded"))
+	})
+
+	s := New(handler, Timeouts{Read: time.Second, Write: 5 * time.Second, Shutdown: 5 * time.Second}, closer{"store", &closed, mu}, closer{"data", &closed, mu})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+
+	type response struct {
+		status int
+		body   string
+		err    error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Post("http://"+l.Addr().String()+"/upload", "application/json", nil)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		responses <- response{resp.StatusCode, string(b), err}
+	}()
+
+	<-started
+	stop()
+
+	// the listener is closed right away while the request is in flight
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expecting new connections to be refused while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("expecting the server to wait for the request but it returned %#v", err)
+	default:
+	}
+
+	close(release)
+
+	r := <-responses
+	if r.err != nil || r.status != 200 || r.body != "uploaded" {
+		t.Errorf("expecting the request in flight to complete but got %d %q %#v", r.status, r.body, r.err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expecting a clean shutdown but got %#v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the server to stop once drained")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != 2 || closed[0] != "store" || closed[1] != "data" {
+		t.Errorf("expecting the store then the data to be closed but got %#v", closed)
+	}
+}
+
+// TestServeCutsOff tests that the requests that do not complete within the
+// shutdown timeout are cut off
+func TestServeCutsOff(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	s := New(handler, Timeouts{Shutdown: 50 * time.Millisecond})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	stop()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("expecting the draining to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the request to be cut off")
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertCheckInterval is how often the certificate files are checked for
+// changes by default
+const CertCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate and its key from files, reloading them
+// once they change so that renewed certificates are picked up without a
+// restart
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	// CheckInterval is how often the files are checked for changes, by the
+	// first handshake once it has passed
+	CheckInterval time.Duration
+
+	cert    atomic.Pointer[tls.Certificate]
+	checked atomic.Int64 // unix nanoseconds of the last check
+
+	// mu is held by the handshake that checks the files, the others keep
+	// serving the current certificate meanwhile
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and the key, failing when they are
+// not a valid pair
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile, CheckInterval: CertCheckInterval}
+
+	modTime, err := c.lastModified()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	c.checked.Store(time.Now().UnixNano())
+
+	return c, nil
+}
+
+// GetCertificate is the tls.Config GetCertificate of the certificate. A
+// certificate that fails to reload, such as one that is halfway written, is
+// logged and the previous one kept until the files change again.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if time.Since(time.Unix(0, c.checked.Load())) >= c.CheckInterval && c.mu.TryLock() {
+		c.reload()
+		c.mu.Unlock()
+	}
+
+	return c.cert.Load(), nil
+}
+
+// reload loads the files when they changed since they were last loaded, it
+// is called with mu held
+func (c *CertReloader) reload() {
+	c.checked.Store(time.Now().UnixNano())
+
+	modTime, err := c.lastModified()
+	if err == nil && !modTime.Equal(c.modTime) {
+		err = c.load(modTime)
+		if err == nil {
+			slog.Info("🔐 Reloaded certificate", "file", c.CertFile)
+		}
+	}
+	if err != nil {
+		slog.Error("error reloading certificate", "error", err)
+	}
+}
+
+func (c *CertReloader) load(modTime time.Time) error {
+	// retried only once the files change again when it fails
+	c.modTime = modTime
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading certificate")
+	}
+
+	c.cert.Store(&cert)
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and
+// the key, which are not always renewed together
+func (c *CertReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, errors.Wrap(err, "error reading certificate")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// TLSConfig returns the TLS configuration that serves the certificate of c
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// RedirectHandler redirects plain HTTP requests to HTTPS on the same host.
+// httpsAddr is the address that HTTPS is served at, its port is kept in the
+// redirects unless it is 443.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+
+		// only the idempotent requests keep their method through a 301
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, u.String(), status)
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost named name, with
+// a modification time of modTime
+func writeCert(t *testing.T, dir string, name string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		err = os.WriteFile(file, pem.EncodeToMemory(block), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return certFile, keyFile
+}
+
+// TestServeTLS tests that the server serves its certificate over TLS and
+// picks up the renewed one without a restart, checking the files at most once
+// per interval
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first", time.Now().Add(-time.Minute))
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.CheckInterval = time.Hour
+	// the interval has passed for the next handshake
+	expire := func() {
+		reloader.checked.Store(0)
+	}
+
+	s := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), Timeouts{Shutdown: time.Second})
+	s.HTTP.TLSConfig = reloader.TLSConfig()
+
+	l, err := Listen("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go s.Serve(ctx, l)
+
+	// the certificate that a new connection is served, which the client
+	// trusts whatever it is
+	get := func() (string, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(b)
+	}
+
+	name, body := get()
+	if name != "first" || body != "ok" {
+		t.Errorf("expecting the first certificate to be served but got %s, %q", name, body)
+	}
+
+	// a certificate halfway written keeps the previous one
+	err = os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire()
+	if name, _ = get(); name != "first" {
+		t.Errorf("expecting the first certificate to be kept but got %s", name)
+	}
+
+	writeCert(t, dir, "renewed", time.Now())
+	if name, _ = get(); name != "first" {
+		t.Errorf("expecting the files not to be checked again within the interval but got %s", name)
+	}
+	expire()
+	if name, _ = get(); name != "renewed" {
+		t.Errorf("expecting the renewed certificate to be served but got %s", name)
+	}
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	if err == nil {
+		t.Error("expecting a missing certificate to be rejected")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct {
+		httpsAddr string
+		method    string
+		target    string
+		location  string
+		status    int
+	}{
+		{":443", "GET", "http://g2g.example.com/toplist/10.json?x=1", "https://g2g.example.com/toplist/10.json?x=1", 301},
+		{"0.0.0.0:8443", "GET", "http://g2g.example.com:8080/", "https://g2g.example.com:8443/", 301},
+		{":443", "POST", "http://g2g.example.com/api/2/auth/alice/login.json", "https://g2g.example.com/api/2/auth/alice/login.json", 308},
+	} {
+		w := httptest.NewRecorder()
+		RedirectHandler(tc.httpsAddr).ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+
+		if w.Code != tc.status || w.Header().Get("Location") != tc.location {
+			t.Errorf("expecting %s %s to be redirected to %s with %d but got %d %s", tc.method, tc.target, tc.location, tc.status, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+// withUmask runs f, the platform has no umask and the permissions of the
+// files are left to it
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package server
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the listeners that change the umask, which is shared by
+// the whole process
+var umaskMu sync.Mutex
+
+// withUmask runs f with the umask of the process set to mask, such as to
+// create files with restricted permissions from the start
+func withUmask(mask int, f func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	previous := syscall.Umask(mask)
+	defer syscall.Umask(previous)
+
+	return f()
+}
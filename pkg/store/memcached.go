@@ -2,18 +2,25 @@ package store
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	memcached "github.com/bradfitz/gomemcache/memcache"
 )
 
+// memcachedMaxRelativeTTL is the longest expiration that memcached takes as
+// relative, longer ones are unix timestamps
+const memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+
 type MemcachedStore struct {
 	Cache  *memcached.Client
 	Prefix string
 }
 
+// NewMemcachedStore connects to the memcached servers of a comma separated list
+// of host:port
 func NewMemcachedStore(hosts string, prefix string) *MemcachedStore {
-	cache := memcached.New(hosts)
+	cache := memcached.New(strings.Split(hosts, ",")...)
 	cache.Timeout = 3 * time.Second
 	return &MemcachedStore{
 		Cache:  cache,
@@ -25,12 +32,21 @@ func (m *MemcachedStore) Ping() error {
 	return m.Cache.Ping()
 }
 
+// Close closes nothing as the memcached client only keeps idle connections,
+// which the server drops
+func (m *MemcachedStore) Close() error {
+	return nil
+}
+
+func (m *MemcachedStore) key(key string) string {
+	return fmt.Sprintf("%s_%s", m.Prefix, key)
+}
+
 func (m *MemcachedStore) Get(key string) (string, error) {
-	if err := m.Ping(); err != nil {
-		return "", err
+	item, err := m.Cache.Get(m.key(key))
+	if err == memcached.ErrCacheMiss {
+		return "", ErrNotFound
 	}
-
-	item, err := m.Cache.Get(fmt.Sprintf("%s_%s", m.Prefix, key))
 	if err != nil {
 		return "", err
 	}
@@ -39,14 +55,52 @@ func (m *MemcachedStore) Get(key string) (string, error) {
 }
 
 func (m *MemcachedStore) Set(key string, value string) error {
-	if err := m.Ping(); err != nil {
-		return err
-	}
+	return m.SetWithTTL(key, value, 0)
+}
 
+func (m *MemcachedStore) SetWithTTL(key string, value string, ttl time.Duration) error {
 	item := &memcached.Item{
-		Key:   fmt.Sprintf("%s_%s", m.Prefix, key),
+		Key:   m.key(key),
 		Value: []byte(value),
 	}
 
+	switch {
+	case ttl <= 0:
+	case ttl > memcachedMaxRelativeTTL:
+		item.Expiration = int32(time.Now().Add(ttl).Unix())
+	default:
+		// memcached counts in seconds, round up not to expire right away
+		item.Expiration = int32((ttl + time.Second - 1) / time.Second)
+	}
+
 	return m.Cache.Set(item)
 }
+
+func (m *MemcachedStore) Delete(key string) error {
+	err := m.Cache.Delete(m.key(key))
+	if err == memcached.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (m *MemcachedStore) GetMulti(keys []string) (map[string]string, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = m.key(key)
+	}
+
+	items, err := m.Cache.GetMulti(prefixed)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for i, key := range keys {
+		if item, ok := items[prefixed[i]]; ok {
+			values[key] = string(item.Value)
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+// NewRedisStore connects to the redis server of a redis:// or rediss:// url,
+// e.g. redis://:password@localhost:6379/0
+func NewRedisStore(url string, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	opts.DialTimeout = 3 * time.Second
+	opts.ReadTimeout = 3 * time.Second
+	opts.WriteTimeout = 3 * time.Second
+
+	return &RedisStore{
+		Client: redis.NewClient(opts),
+		Prefix: prefix,
+	}, nil
+}
+
+func (s *RedisStore) key(key string) string {
+	return fmt.Sprintf("%s_%s", s.Prefix, key)
+}
+
+func (s *RedisStore) Ping() error {
+	return s.Client.Ping(context.Background()).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.Client.Close()
+}
+
+func (s *RedisStore) Get(key string) (string, error) {
+	value, err := s.Client.Get(context.Background(), s.key(key)).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return value, err
+}
+
+func (s *RedisStore) Set(key string, value string) error {
+	return s.SetWithTTL(key, value, 0)
+}
+
+func (s *RedisStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return s.Client.Set(context.Background(), s.key(key), value, ttl).Err()
+}
+
+func (s *RedisStore) Delete(key string) error {
+	return s.Client.Del(context.Background(), s.key(key)).Err()
+}
+
+func (s *RedisStore) GetMulti(keys []string) (map[string]string, error) {
+	values := map[string]string{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.key(key)
+	}
+
+	results, err := s.Client.MGet(context.Background(), prefixed...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		if v, ok := result.(string); ok {
+			values[keys[i]] = v
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Prefix is the prefix of the keys of the shared backends, so that instances
+// can share a server with other applications
+const Prefix = "g2g"
+
+// New returns the store of a cache backend:
+//
+//	memory                          the memory of the process
+//	memcached://host:port[,host...] memcached servers
+//	redis://[:password@]host:port   a redis server, rediss:// for TLS
+func New(backend string) (Store, error) {
+	scheme, rest, _ := strings.Cut(backend, "://")
+
+	switch scheme {
+	case "", "memory":
+		return NewCacheStore(), nil
+	case "memcached":
+		hosts := strings.TrimSuffix(rest, "/")
+		if hosts == "" {
+			return nil, errors.New("expecting memcached://host:port")
+		}
+		return NewMemcachedStore(hosts, Prefix), nil
+	case "redis", "rediss":
+		s, err := NewRedisStore(backend, Prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing redis url")
+		}
+		return s, nil
+	}
+
+	return nil, errors.Errorf("unknown cache backend %s, expecting memory, memcached:// or redis://", backend)
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStore runs the same checks against every backend, fastForward moves
+// the clock of the backend past the expiry of keys
+func testStore(t *testing.T, s Store, fastForward func(time.Duration)) {
+	err := s.Ping()
+	if err != nil {
+		t.Fatalf("expecting the store to be reachable but got %#v", err)
+	}
+
+	_, err = s.Get("missing")
+	if err != ErrNotFound {
+		t.Errorf("expecting a missing key to be ErrNotFound but got %#v", err)
+	}
+
+	err = s.Set("forever", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetWithTTL("short", "2", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetWithTTL("long", "3", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := s.Get("short")
+	if err != nil || value != "2" {
+		t.Errorf("expecting short to be 2 but got %q, %#v", value, err)
+	}
+
+	values, err := s.GetMulti([]string{"forever", "short", "missing", "long"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"forever": "1", "short": "2", "long": "3"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expecting %#v but got %#v", expected, values)
+	}
+
+	fastForward(2 * time.Second)
+
+	_, err = s.Get("short")
+	if err != ErrNotFound {
+		t.Errorf("expecting short to have expired but got %#v", err)
+	}
+	values, err = s.GetMulti([]string{"forever", "short", "long"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"forever": "1", "long": "3"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expecting %#v after the expiry but got %#v", expected, values)
+	}
+
+	err = s.Delete("forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get("forever")
+	if err != ErrNotFound {
+		t.Errorf("expecting forever to be deleted but got %#v", err)
+	}
+	err = s.Delete("forever")
+	if err != nil {
+		t.Errorf("expecting deleting a missing key to succeed but got %#v", err)
+	}
+
+	values, err = s.GetMulti(nil)
+	if err != nil || len(values) != 0 {
+		t.Errorf("expecting no values for no keys but got %#v, %#v", values, err)
+	}
+}
+
+func TestLocalCacheStore(t *testing.T) {
+	testStore(t, NewCacheStore(), time.Sleep)
+}
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	s, err := New("redis://" + server.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s, server.FastForward)
+
+	// keys are prefixed not to clash with the other users of the server
+	err = s.Set("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists(Prefix + "_key") {
+		t.Errorf("expecting key to be stored as %s_key but got %#v", Prefix, server.Keys())
+	}
+}
+
+func TestNew(t *testing.T) {
+	backends := map[string]interface{}{
+		"":                               &LocalCacheStore{},
+		"memory":                         &LocalCacheStore{},
+		"memcached://a:11211,b:11211":    &MemcachedStore{},
+		"redis://:pass@localhost:6379/1": &RedisStore{},
+		"rediss://localhost:6380":        &RedisStore{},
+	}
+	for backend, expected := range backends {
+		s, err := New(backend)
+		if err != nil {
+			t.Errorf("expecting %q to be a valid backend but got %#v", backend, err)
+			continue
+		}
+		if reflect.TypeOf(s) != reflect.TypeOf(expected) {
+			t.Errorf("expecting %q to be a %T but got %T", backend, expected, s)
+		}
+	}
+
+	for _, backend := range []string{"memcached://", "redis://localhost:6379/db", "mongodb://localhost"} {
+		_, err := New(backend)
+		if err == nil {
+			t.Errorf("expecting %q to be rejected", backend)
+		}
+	}
+}
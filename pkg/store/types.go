@@ -7,9 +7,26 @@ import (
 	"github.com/patrickmn/go-cache"
 )
 
+// ErrNotFound is returned by Get for the keys that are missing or expired
+var ErrNotFound = errors.New("error retrieving value")
+
 type Store interface {
 	Get(key string) (string, error)
 	Set(key string, value string) error
+
+	// SetWithTTL sets a value that expires after ttl, a ttl of 0 never
+	// expires as with Set
+	SetWithTTL(key string, value string, ttl time.Duration) error
+	Delete(key string) error
+
+	// GetMulti returns the values of the keys that are found, the missing
+	// ones are left out
+	GetMulti(keys []string) (map[string]string, error)
+
+	Ping() error
+
+	// Close flushes the cache and closes the connections to its servers
+	Close() error
 }
 
 type LocalCacheStore struct {
@@ -24,6 +41,15 @@ func NewCacheStore() *LocalCacheStore {
 	return localCacheStore
 }
 
+func (s *LocalCacheStore) Ping() error {
+	return nil
+}
+
+func (s *LocalCacheStore) Close() error {
+	s.Cache.Flush()
+	return nil
+}
+
 func (s *LocalCacheStore) Get(key string) (string, error) {
 	c := s.Cache
 
@@ -32,11 +58,33 @@ func (s *LocalCacheStore) Get(key string) (string, error) {
 		return k.(string), nil
 	}
 
-	return "", errors.New("error retrieving value")
+	return "", ErrNotFound
 }
 
 func (s *LocalCacheStore) Set(key string, value string) error {
-	c := s.Cache
-	c.Set(key, value, cache.NoExpiration)
+	return s.SetWithTTL(key, value, 0)
+}
+
+func (s *LocalCacheStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	s.Cache.Set(key, value, ttl)
 	return nil
 }
+
+func (s *LocalCacheStore) Delete(key string) error {
+	s.Cache.Delete(key)
+	return nil
+}
+
+func (s *LocalCacheStore) GetMulti(keys []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range keys {
+		if v, ok := s.Cache.Get(key); ok {
+			values[key] = v.(string)
+		}
+	}
+
+	return values, nil
+}